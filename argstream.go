@@ -0,0 +1,103 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+var typeOfArgStream = reflect.TypeOf((*ArgStream)(nil))
+
+//服务端方法收到的流式参数,方法签名为 func (t *T) MethodName(ctx context.Context, args *ArgStream, reply *R) error
+//客户端通过CallArgStream把slice的每个元素单独发送,方法通过Next逐个解码,服务端只缓冲客户端窗口内还没有处理的元素
+type ArgStream struct {
+	stream *ServerStream
+	//客户端的发送窗口,0表示客户端不等待确认
+	window int
+	//已取出还没有确认的字节数
+	unacked int
+	//解码或接收出错的原因
+	err error
+}
+
+//把下一个元素解码到item,没有更多元素或出错时返回false,出错的原因通过Err获取
+func (a *ArgStream) Next(item interface{}) bool {
+	if a.err != nil {
+		return false
+	}
+	data, err := a.stream.recvData()
+	if err != nil {
+		if err != io.EOF {
+			a.err = err
+		}
+		return false
+	}
+	a.unacked += len(data)
+	if a.window > 0 && a.unacked >= a.window/2 {
+		//确认失败时连接会被关闭,之后的Next返回false
+		_ = a.stream.write(bidiAck, a.unacked)
+		a.unacked = 0
+	}
+	if err := codec.Unmarshal(a.stream.t, data, item); err != nil {
+		a.err = err
+		return false
+	}
+	return true
+}
+
+//Next返回false的原因,元素全部读完时为nil
+func (a *ArgStream) Err() error {
+	return a.err
+}
+
+//调用arg类型为*ArgStream的方法,items需要是slice,每个元素单独编码后按顺序发送,方法通过ArgStream.Next逐个解码
+//服务端还没有处理的元素不超过MaxStreamBufferBytes的一半,超出时等待服务端确认,单个元素不能超过该大小的一半
+//方法提前返回时剩余的元素不再发送;返回方法的错误,正常返回时结果解码到reply;ctx结束时放弃调用并取消服务端的方法
+func (client *Client) CallArgStream(ctx context.Context, serviceMethod string, items interface{}, reply interface{}) error {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("rpc client: stream arg must be a slice, got %T", items)
+	}
+	if isNil(reply) {
+		return ErrNilReply
+	}
+	size := MaxStreamBufferBytes / 2
+	window := newStreamWindow(size)
+	call := newCall(serviceMethod, invalidRequest, reply, make(chan *Call, 1))
+	call.metadata = map[string]string{BidiKey: bidiOpen, StreamWindowKey: strconv.Itoa(size)}
+	stream, err := client.openStream(call, window)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < v.Len() && ctx.Err() == nil; i++ {
+		data, err := codec.Marshal(stream.t, v.Index(i).Interface())
+		if err != nil {
+			_ = stream.Close()
+			return fmt.Errorf("rpc client: encode stream arg %d: %w", i, err)
+		}
+		//方法返回后窗口结束,ctx结束时在下面放弃调用
+		if _, err := window.wait(ctx, len(data)); err != nil {
+			break
+		}
+		window.consume(len(data))
+		if err := stream.sendData(data); err != nil {
+			break
+		}
+	}
+	if ctx.Err() == nil {
+		_ = stream.CloseSend()
+	}
+	select {
+	case <-stream.done:
+		return call.Error
+	case <-ctx.Done():
+		_ = stream.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrCallTimeout
+		}
+		return ctx.Err()
+	}
+}
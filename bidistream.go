@@ -0,0 +1,425 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//双向流的消息在请求头和响应头Metadata中的标记,同一seq的最后一条普通响应表示流结束
+const BidiKey = "bidi"
+
+const (
+	//客户端打开流,消息体为空
+	bidiOpen = "open"
+	//流上的一条消息,消息体为按流的协议编码后的[]byte
+	bidiMsg = "msg"
+	//发送方不再发送消息(半关闭),对端的Recv读完已收到的消息后返回io.EOF
+	bidiCloseSend = "close-send"
+	//客户端放弃整个流,服务端取消方法的ctx
+	bidiCancel = "cancel"
+	//服务端处理了一部分流式参数后发给客户端的确认,消息体为处理的字节数,客户端据此继续发送
+	bidiAck = "ack"
+)
+
+//调用CloseSend之后再Send返回的错误
+var ErrStreamSendClosed = errors.New("rpc: stream send direction closed")
+
+//接收方未读取的消息超过MaxStreamBufferBytes时流被终止,Recv返回该错误
+var ErrStreamBufferFull = errors.New("rpc: stream receive buffer full")
+
+//每个流已接收未读取的消息的字节数上限,超过时终止该流,避免对端发送过快耗尽内存
+//连接的读取协程不能等待Recv,因此超过上限时不阻塞,发送方需要按对端的处理速度发送
+var MaxStreamBufferBytes = 4 << 20
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+//双向流一端的收发状态,客户端和服务端共用
+type msgStream struct {
+	//保护接收方向,连接的读取协程也需要获取,持有期间不能读写连接
+	lock sync.Mutex
+	cond *sync.Cond
+	//已接收未读取的消息
+	queue [][]byte
+	//queue中消息的字节数
+	queued int
+	//接收结束的原因,对端半关闭或流正常结束为io.EOF
+	recvErr error
+	//保护发送方向,写出期间持有,保证消息按顺序发送
+	sendLock sync.Mutex
+	//本端是否已半关闭
+	sendClosed bool
+	//消息的编码协议
+	t codec.Type
+	//按kind向对端写出一条消息
+	write func(kind string, body interface{}) error
+}
+
+func newMsgStream(t codec.Type, write func(kind string, body interface{}) error) *msgStream {
+	s := &msgStream{t: t, write: write}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+//流上的消息使用的协议,连接的协议不能编码独立的消息体(如cbor)时使用json
+func streamCodecOf(opt *Option) codec.Type {
+	if t := frameCodecOf(opt.BodyCodec, opt.CodecType); codec.SupportsBodyCodec(t) {
+		return t
+	}
+	return codec.JsonType
+}
+
+//收到对端的一条消息,未读取的消息超过MaxStreamBufferBytes时终止接收并返回false
+func (s *msgStream) push(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.cond.Broadcast()
+	if s.recvErr != nil {
+		return true
+	}
+	if s.queued+len(data) > MaxStreamBufferBytes {
+		s.queue, s.queued = nil, 0
+		s.recvErr = ErrStreamBufferFull
+		return false
+	}
+	s.queue = append(s.queue, data)
+	s.queued += len(data)
+	return true
+}
+
+//接收方向结束,之后的Recv读完已收到的消息后返回err,只有第一次调用生效
+func (s *msgStream) finishRecv(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.recvErr == nil {
+		s.recvErr = err
+	}
+	s.cond.Broadcast()
+}
+
+//阻塞到收到下一条消息并解码到v,对端半关闭后读完已收到的消息返回io.EOF
+func (s *msgStream) Recv(v interface{}) error {
+	data, err := s.recvData()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(s.t, data, v)
+}
+
+//阻塞到收到下一条消息,返回还没有解码的消息
+func (s *msgStream) recvData() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.queue) == 0 && s.recvErr == nil {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return nil, s.recvErr
+	}
+	data := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.queued -= len(data)
+	return data, nil
+}
+
+//向对端发送一条消息,CloseSend之后返回ErrStreamSendClosed
+func (s *msgStream) Send(v interface{}) error {
+	data, err := codec.Marshal(s.t, v)
+	if err != nil {
+		return err
+	}
+	return s.sendData(data)
+}
+
+//发送一条已编码的消息
+func (s *msgStream) sendData(data []byte) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if s.sendClosed {
+		return ErrStreamSendClosed
+	}
+	return s.write(bidiMsg, data)
+}
+
+//半关闭发送方向,对端的Recv随后返回io.EOF,本端仍可以继续Recv,重复调用不会再次发送
+func (s *msgStream) CloseSend() error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	return s.write(bidiCloseSend, invalidRequest)
+}
+
+//不再允许发送,不通知对端
+func (s *msgStream) stopSend() {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.sendClosed = true
+}
+
+//服务端方法收到的双向流,方法签名为 func (t *T) MethodName(ctx context.Context, stream *ServerStream, reply *struct{}) error
+//方法返回即结束整个流,返回的错误作为调用方ClientStream.Wait的结果,reply被丢弃
+type ServerStream struct {
+	*msgStream
+	//客户端放弃流时取消方法的ctx
+	cancel context.CancelFunc
+}
+
+//一个连接上打开的服务端流
+type serverStreams struct {
+	lock sync.Mutex
+	m    map[uint64]*ServerStream
+}
+
+func (ss *serverStreams) get(seq uint64) *ServerStream {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.m[seq]
+}
+
+func (ss *serverStreams) remove(seq uint64) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	delete(ss.m, seq)
+}
+
+//连接断开时结束所有流的接收,并取消方法的ctx
+func (ss *serverStreams) closeAll() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	for seq, stream := range ss.m {
+		stream.finishRecv(io.ErrUnexpectedEOF)
+		stream.cancel()
+		delete(ss.m, seq)
+	}
+}
+
+//处理客户端发来的双向流消息,返回的错误表示连接已不可用
+func (server *Server) receiveBidi(ctx context.Context, c codec.Codec, h *codec.Header, streams *serverStreams, sc *serverConn, sendLock *sendQueue, wg *sync.WaitGroup) error {
+	switch h.Metadata[BidiKey] {
+	case bidiOpen:
+		return server.openStream(ctx, c, h, streams, sc, sendLock, wg)
+	case bidiMsg:
+		var data []byte
+		if err := c.ReadBody(&data); err != nil {
+			return err
+		}
+		//流已结束时丢弃,客户端发送过快时取消方法
+		if stream := streams.get(h.Seq); stream != nil && !stream.push(data) {
+			stream.cancel()
+		}
+		return nil
+	}
+	if err := c.ReadBody(nil); err != nil {
+		return err
+	}
+	if stream := streams.get(h.Seq); stream != nil {
+		switch h.Metadata[BidiKey] {
+		case bidiCloseSend:
+			stream.finishRecv(io.EOF)
+		case bidiCancel:
+			stream.finishRecv(ErrStreamClosed)
+			stream.cancel()
+		}
+	}
+	return nil
+}
+
+//打开一个服务端流,并在新的协程中调用方法
+func (server *Server) openStream(ctx context.Context, c codec.Codec, h *codec.Header, streams *serverStreams, sc *serverConn, sendLock *sendQueue, wg *sync.WaitGroup) error {
+	if err := c.ReadBody(nil); err != nil {
+		return err
+	}
+	req := &request{h: h, c: c, start: time.Now()}
+	delete(h.Metadata, BidiKey)
+	var unknown bool
+	var intercept InterceptHandler
+	var err error
+	req.service, req.mType, intercept, unknown, err = server.dispatch(h)
+	if err == nil && (unknown || intercept != nil || (req.mType.ArgType != typeOfServerStream && req.mType.ArgType != typeOfArgStream)) {
+		err = errors.New("rpc server: " + h.ServiceMethod + " is not a stream method")
+	}
+	if err == nil && !sc.beginRequest() {
+		err = ErrConnClosing
+	}
+	if err != nil {
+		h.Error = err.Error()
+		encodeTime := server.sendResponse(c, h, invalidRequest, sendLock)
+		server.reportStats(req, encodeTime)
+		return nil
+	}
+	ctx = context.WithValue(ctx, requestIDKey, requestIDOf(h))
+	ctx = context.WithValue(ctx, metadataKey, h.Metadata)
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &ServerStream{cancel: cancel}
+	stream.msgStream = newMsgStream(streamCodecOf(connInfoFromContext(ctx).option), func(kind string, body interface{}) error {
+		mh := &codec.Header{
+			ServiceMethod: h.ServiceMethod,
+			Seq:           h.Seq,
+			Metadata:      map[string]string{BidiKey: kind, RequestIDKey: requestIDOf(h)},
+		}
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		return c.Write(mh, body)
+	})
+	//在读取下一条消息之前登记,之后到达的消息都能找到该流
+	streams.lock.Lock()
+	streams.m[h.Seq] = stream
+	streams.lock.Unlock()
+	req.argv = reflect.ValueOf(stream)
+	if req.mType.ArgType == typeOfArgStream {
+		//客户端没有带窗口时不发送确认
+		window, _ := strconv.Atoi(h.Metadata[StreamWindowKey])
+		req.argv = reflect.ValueOf(&ArgStream{stream: stream, window: window})
+	}
+	req.replyv = req.mType.newReply()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer sc.endRequest()
+		defer cancel()
+		err := server.invoke(ctx, req)
+		streams.remove(h.Seq)
+		stream.stopSend()
+		stream.finishRecv(ErrStreamClosed)
+		//双向流的reply被丢弃,流式参数的方法正常返回时把reply作为结果
+		var body interface{} = invalidRequest
+		if err != nil {
+			h.Error = err.Error()
+		} else if req.mType.ArgType == typeOfArgStream {
+			body = req.replyv.Interface()
+		}
+		encodeTime := server.sendResponse(c, h, body, sendLock)
+		server.reportStats(req, encodeTime)
+	}()
+	return nil
+}
+
+//客户端打开的双向流
+type ClientStream struct {
+	*msgStream
+	client *Client
+	call   *Call
+	//服务端方法返回或流被关闭后关闭
+	done chan struct{}
+	//发送流式参数时服务端的接收窗口,双向流为nil
+	window *streamWindow
+}
+
+//打开服务端方法的双向流,方法的arg类型需要为*ServerStream
+//消息在客户端缓冲,Recv慢时不会阻塞同一连接上的其他调用;服务端方法返回后Recv读完已收到的消息返回io.EOF或方法的错误
+func (client *Client) OpenStream(serviceMethod string) (*ClientStream, error) {
+	call := newCall(serviceMethod, invalidRequest, nil, make(chan *Call, 1))
+	call.metadata = map[string]string{BidiKey: bidiOpen}
+	return client.openStream(call, nil)
+}
+
+//发送打开流的请求,window不为nil时在方法返回后结束发送窗口
+func (client *Client) openStream(call *Call, window *streamWindow) (*ClientStream, error) {
+	stream := &ClientStream{client: client, call: call, done: make(chan struct{}), window: window}
+	stream.msgStream = newMsgStream(streamCodecOf(client.option), func(kind string, body interface{}) error {
+		h := &codec.Header{
+			ServiceMethod: call.ServiceMethod,
+			Seq:           call.Seq,
+			Metadata:      map[string]string{BidiKey: kind},
+		}
+		client.sendLock.Lock()
+		defer client.sendLock.Unlock()
+		return client.c.Write(h, body)
+	})
+	call.bidi = stream
+	client.send(call)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+	default:
+	}
+	go func() {
+		<-call.Done
+		defer close(stream.done)
+		if window != nil {
+			window.grant(-1, ErrStreamClosed)
+		}
+		stream.stopSend()
+		err := call.Error
+		if err == nil {
+			err = io.EOF
+		}
+		stream.finishRecv(err)
+	}()
+	return stream, nil
+}
+
+//等待服务端方法返回,返回方法的错误
+func (s *ClientStream) Wait() error {
+	<-s.done
+	return s.call.Error
+}
+
+//放弃整个流,服务端方法的ctx被取消,之后收到的消息被丢弃,Wait返回ErrStreamClosed
+func (s *ClientStream) Close() error {
+	return s.abort(ErrStreamClosed)
+}
+
+//放弃整个流并通知服务端,Wait返回reason
+func (s *ClientStream) abort(reason error) error {
+	call := s.client.removeCall(s.call.Seq)
+	if call == nil {
+		return nil
+	}
+	s.stopSend()
+	s.finishRecv(reason)
+	err := s.write(bidiCancel, invalidRequest)
+	call.Error = reason
+	s.client.finishCall(call)
+	return err
+}
+
+//接收服务端发来的双向流消息,调用不存在(如已被关闭)时丢弃
+func (client *Client) receiveBidi(h *codec.Header) error {
+	client.lock.Lock()
+	call := client.pending[h.Seq]
+	client.lock.Unlock()
+	var stream *ClientStream
+	if call != nil {
+		stream = call.bidi
+	}
+	if h.Metadata[BidiKey] == bidiMsg {
+		var data []byte
+		if err := client.c.ReadBody(&data); err != nil {
+			return err
+		}
+		if stream != nil && !stream.push(data) {
+			//服务端发送过快,放弃整个流,Close需要写连接,不能在读取协程中等待
+			go func() { _ = stream.abort(ErrStreamBufferFull) }()
+		}
+		return nil
+	}
+	if h.Metadata[BidiKey] == bidiAck {
+		var n int
+		if err := client.c.ReadBody(&n); err != nil {
+			return err
+		}
+		if stream != nil && stream.window != nil && n > 0 {
+			stream.window.grant(n, nil)
+		}
+		return nil
+	}
+	if err := client.c.ReadBody(nil); err != nil {
+		return err
+	}
+	if stream != nil && h.Metadata[BidiKey] == bidiCloseSend {
+		stream.finishRecv(io.EOF)
+	}
+	return nil
+}
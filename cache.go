@@ -0,0 +1,117 @@
+package gorpc
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//CallCached缓存的最大条目数,超过时淘汰最久未使用的条目
+var DefaultCacheSize = 1024
+
+//客户端的响应缓存,按LRU淘汰
+type responseCache struct {
+	lock sync.Mutex
+	//最大条目数
+	size int
+	//key -> 链表中的元素
+	entries map[cacheKey]*list.Element
+	//按最近使用排序,最前面的是最近使用的
+	order *list.List
+}
+
+//缓存的key,同一方法和参数按不同的reply类型分别缓存
+type cacheKey struct {
+	serviceMethod string
+	replyType     reflect.Type
+	//编码后的参数
+	args string
+}
+
+type cacheEntry struct {
+	key cacheKey
+	//编码后的reply,命中时解码出新的对象,调用方之间互不影响
+	data    []byte
+	expires time.Time
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *responseCache) get(key cacheKey) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.data, true
+}
+
+func (c *responseCache) put(key cacheKey, data []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &cacheEntry{key: key, data: data, expires: time.Now().Add(ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+//带缓存的调用,适用于幂等的读方法
+//按方法名,参数和reply类型缓存reply,ttl内相同的调用直接从缓存返回,不经过网络;调用出错时不缓存
+//参数和reply按连接的消息体协议编码,与CallCoalesced相同,gob编码的map参数顺序不固定,可能不命中
+func (client *Client) CallCached(serviceMethod string, args, reply interface{}, ttl time.Duration) error {
+	dst := reflect.ValueOf(reply)
+	if isNil(reply) || dst.Kind() != reflect.Ptr {
+		return ErrNilReply
+	}
+	t := streamCodecOf(client.option)
+	encodedArgs, err := codec.Marshal(t, args)
+	if err != nil {
+		return fmt.Errorf("rpc client: encode cache key: %w", err)
+	}
+	key := cacheKey{serviceMethod: serviceMethod, replyType: dst.Type(), args: string(encodedArgs)}
+	client.cacheOnce.Do(func() {
+		client.cache = newResponseCache(DefaultCacheSize)
+	})
+	if data, ok := client.cache.get(key); ok {
+		copied := reflect.New(key.replyType.Elem())
+		if err := codec.Unmarshal(t, data, copied.Interface()); err != nil {
+			return fmt.Errorf("rpc client: copy cached reply: %w", err)
+		}
+		dst.Elem().Set(copied.Elem())
+		return nil
+	}
+	if err := client.Call(serviceMethod, args, reply); err != nil {
+		return err
+	}
+	data, err := codec.Marshal(t, reply)
+	if err != nil {
+		return fmt.Errorf("rpc client: copy cached reply: %w", err)
+	}
+	client.cache.put(key, data, ttl)
+	return nil
+}
@@ -0,0 +1,83 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"sync"
+)
+
+//方法在返回结果前发送的事件(如日志行)在响应头Metadata中的标记,消息体为string
+const EventKey = "event"
+
+//ctx不是服务端传入方法的context,或方法已经返回时SendEvent返回的错误
+var ErrNoEventStream = errors.New("rpc server: no event stream for this context")
+
+//向一个请求的调用方发送事件
+type eventSender struct {
+	c        codec.Codec
+	h        *codec.Header
+	sendLock *sendQueue
+	//保护closed
+	lock sync.Mutex
+	//方法返回后不能再发送
+	closed bool
+}
+
+//在方法中向调用方发送一行事件,调用方通过CallWithEvents的onEvent依次收到,方法的返回值仍作为最终结果
+//方法返回后再调用返回ErrNoEventStream
+func SendEvent(ctx context.Context, line string) error {
+	sender, ok := ctx.Value(eventSenderKey).(*eventSender)
+	if !ok {
+		return ErrNoEventStream
+	}
+	sender.lock.Lock()
+	defer sender.lock.Unlock()
+	if sender.closed {
+		return ErrNoEventStream
+	}
+	//复制请求头,不影响最终响应使用的请求头
+	h := &codec.Header{
+		ServiceMethod: sender.h.ServiceMethod,
+		Seq:           sender.h.Seq,
+		BodyCodec:     sender.h.ReplyCodec,
+		Metadata:      map[string]string{EventKey: "true", RequestIDKey: requestIDOf(sender.h)},
+	}
+	sender.sendLock.Lock()
+	defer sender.sendLock.Unlock()
+	return sender.c.Write(h, line)
+}
+
+//方法返回后调用,之后的SendEvent返回错误
+func (sender *eventSender) close() {
+	sender.lock.Lock()
+	defer sender.lock.Unlock()
+	sender.closed = true
+}
+
+//读取一个事件并交给调用的onEvent,调用已结束或不接收事件时丢弃
+func (client *Client) receiveEvent(seq uint64) error {
+	client.lock.Lock()
+	call := client.pending[seq]
+	client.lock.Unlock()
+	var line string
+	if err := client.c.ReadBody(&line); err != nil {
+		return err
+	}
+	if call != nil && call.onEvent != nil {
+		call.onEvent(line)
+	}
+	return nil
+}
+
+//调用服务端的方法,方法通过SendEvent发送的每一行事件依次传给onEvent,返回方法最终的错误,方法的reply被丢弃
+//onEvent在接收协程中调用,不能阻塞或调用该客户端的方法;ctx结束时放弃等待,之后到达的事件和响应被丢弃
+func (client *Client) CallWithEvents(ctx context.Context, serviceMethod string, args interface{}, onEvent func(line string)) error {
+	//reply为nil,最终响应的消息体被读出并丢弃
+	call := newCall(serviceMethod, args, nil, make(chan *Call, 1))
+	call.onEvent = onEvent
+	if _, err := client.callContext(ctx, call, client.send); err != nil {
+		return err
+	}
+	return call.Error
+}
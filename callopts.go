@@ -0,0 +1,34 @@
+package gorpc
+
+import (
+	"context"
+	"time"
+)
+
+//以最后一个参数的形式传给方法的调用信息,是context.Context之外更轻量的选择
+//方法签名为 func (t *T) MethodName(argType T1, replyType *T2, opts CallOptions) error
+type CallOptions struct {
+	//处理的截止时间,没有截止时间时为零值
+	Deadline time.Time
+	//请求头中的元数据,方法不应修改
+	Metadata map[string]string
+	//客户端地址,连接不是net.Conn时为空
+	PeerAddr string
+	//服务端为连接分配的id
+	ConnID uint64
+	//请求id
+	RequestID string
+}
+
+//根据服务端传给请求的context生成CallOptions
+func callOptionsFromContext(ctx context.Context) CallOptions {
+	info := connInfoFromContext(ctx)
+	opts := CallOptions{
+		PeerAddr: info.remoteAddr,
+		ConnID:   info.id,
+	}
+	opts.Deadline, _ = ctx.Deadline()
+	opts.Metadata, _ = ctx.Value(metadataKey).(map[string]string)
+	opts.RequestID, _ = RequestIDFromContext(ctx)
+	return opts
+}
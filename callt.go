@@ -0,0 +1,22 @@
+package gorpc
+
+import (
+	"context"
+	"reflect"
+)
+
+//调用serviceMethod并返回Reply类型的结果,不需要手动创建reply
+//Reply为指针类型时创建其指向的值并传入,否则传入&reply,出错时返回Reply的零值
+func CallT[Reply any](client *Client, ctx context.Context, serviceMethod string, args interface{}) (Reply, error) {
+	var reply Reply
+	target := interface{}(&reply)
+	if t := reflect.TypeOf((*Reply)(nil)).Elem(); t.Kind() == reflect.Ptr {
+		reply = reflect.New(t.Elem()).Interface().(Reply)
+		target = reply
+	}
+	if err := client.CallContext(ctx, serviceMethod, args, target); err != nil {
+		var zero Reply
+		return zero, err
+	}
+	return reply, nil
+}
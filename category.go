@@ -0,0 +1,68 @@
+package gorpc
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+//方法的类别,处理请求时按类别给context设置超时
+type MethodCategory int32
+
+const (
+	//不设置超时
+	CategoryDefault MethodCategory = iota
+	//快方法,使用较短的超时
+	CategoryFast
+	//慢方法,使用较长的超时
+	CategorySlow
+)
+
+const (
+	//Server.FastMethodTimeout为0时快方法的超时时间
+	DefaultFastMethodTimeout = time.Second
+	//Server.SlowMethodTimeout为0时慢方法的超时时间
+	DefaultSlowMethodTimeout = 30 * time.Second
+)
+
+func (c MethodCategory) String() string {
+	switch c {
+	case CategoryDefault:
+		return "default"
+	case CategoryFast:
+		return "fast"
+	case CategorySlow:
+		return "slow"
+	}
+	return fmt.Sprintf("MethodCategory(%d)", int32(c))
+}
+
+//设置已注册方法的类别,方法需要接收context才能感知超时
+func (server *Server) SetMethodCategory(serviceMethod string, category MethodCategory) error {
+	if category < CategoryDefault || category > CategorySlow {
+		return fmt.Errorf("rpc server: invalid method category %s", category)
+	}
+	_, mType, err := server.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&mType.category, int32(category))
+	return nil
+}
+
+//方法所属类别的超时时间,0表示不设置超时
+func (server *Server) categoryTimeout(m *methodType) time.Duration {
+	switch MethodCategory(atomic.LoadInt32(&m.category)) {
+	case CategoryFast:
+		if server.FastMethodTimeout > 0 {
+			return server.FastMethodTimeout
+		}
+		return DefaultFastMethodTimeout
+	case CategorySlow:
+		if server.SlowMethodTimeout > 0 {
+			return server.SlowMethodTimeout
+		}
+		return DefaultSlowMethodTimeout
+	}
+	return 0
+}
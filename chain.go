@@ -0,0 +1,110 @@
+package gorpc
+
+import "fmt"
+
+//按名字组合拦截器,可以声明某个拦截器在另一个之前或之后执行,Build后得到Server.Interceptors使用的有序slice
+//位置约束在Build时统一处理,与各模块调用Add的先后无关;没有约束的拦截器保持添加的顺序
+type InterceptorChain struct {
+	entries []*chainEntry
+}
+
+type chainEntry struct {
+	name        string
+	interceptor Interceptor
+	//需要在这些拦截器之前执行
+	before []string
+	//需要在这些拦截器之后执行
+	after []string
+}
+
+func NewInterceptorChain() *InterceptorChain {
+	return &InterceptorChain{}
+}
+
+//添加一个拦截器,之后的Before和After作用于它
+func (c *InterceptorChain) Add(name string, interceptor Interceptor) *InterceptorChain {
+	c.entries = append(c.entries, &chainEntry{name: name, interceptor: interceptor})
+	return c
+}
+
+//最近添加的拦截器在name之前执行
+func (c *InterceptorChain) Before(name string) *InterceptorChain {
+	if last := c.last(); last != nil {
+		last.before = append(last.before, name)
+	}
+	return c
+}
+
+//最近添加的拦截器在name之后执行
+func (c *InterceptorChain) After(name string) *InterceptorChain {
+	if last := c.last(); last != nil {
+		last.after = append(last.after, name)
+	}
+	return c
+}
+
+func (c *InterceptorChain) last() *chainEntry {
+	if len(c.entries) == 0 {
+		return nil
+	}
+	return c.entries[len(c.entries)-1]
+}
+
+//按约束排序,名字重复,引用了不存在的名字或约束有环时返回错误
+func (c *InterceptorChain) Build() ([]Interceptor, error) {
+	index := make(map[string]int, len(c.entries))
+	for i, e := range c.entries {
+		if _, dup := index[e.name]; dup {
+			return nil, fmt.Errorf("rpc: interceptor %q already added", e.name)
+		}
+		index[e.name] = i
+	}
+	//next[i]为需要在i之后执行的拦截器
+	next := make([][]int, len(c.entries))
+	indegree := make([]int, len(c.entries))
+	link := func(from, to int) {
+		next[from] = append(next[from], to)
+		indegree[to]++
+	}
+	for i, e := range c.entries {
+		for _, name := range e.before {
+			j, ok := index[name]
+			if !ok {
+				return nil, unknownInterceptor(e.name, name)
+			}
+			link(i, j)
+		}
+		for _, name := range e.after {
+			j, ok := index[name]
+			if !ok {
+				return nil, unknownInterceptor(e.name, name)
+			}
+			link(j, i)
+		}
+	}
+	//每次取可以执行的拦截器中添加最早的一个,使没有约束的部分保持添加顺序
+	done := make([]bool, len(c.entries))
+	ordered := make([]Interceptor, 0, len(c.entries))
+	for len(ordered) < len(c.entries) {
+		pick := -1
+		for i := range c.entries {
+			if !done[i] && indegree[i] == 0 {
+				pick = i
+				break
+			}
+		}
+		if pick < 0 {
+			return nil, fmt.Errorf("rpc: interceptor ordering has a cycle")
+		}
+		done[pick] = true
+		ordered = append(ordered, c.entries[pick].interceptor)
+		for _, j := range next[pick] {
+			indegree[j]--
+		}
+	}
+	return ordered, nil
+}
+
+func unknownInterceptor(name, target string) error {
+	return fmt.Errorf("rpc: interceptor %q refers to unknown interceptor %q", name, target)
+}
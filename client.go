@@ -1,13 +1,19 @@
 package gorpc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
 	"log"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 //调用结构体
@@ -24,6 +30,43 @@ type Call struct {
 	Error error
 	//当该调用完成时的通知chan
 	Done chan *Call
+	//请求编码后的字节数,Go返回后可读取
+	bytesSent uint64
+	//响应的消息头和消息体的字节数,调用完成后可读取
+	bytesReceived uint64
+	//Codec统计的编码请求和解码响应的耗时,与字节数一样在Go返回后和调用完成后可读取
+	encodeTime time.Duration
+	decodeTime time.Duration
+	//随请求头发送的额外元数据
+	metadata map[string]string
+	//响应头中的元数据,调用完成后可读取
+	replyMetadata map[string]string
+	//流式响应的接收缓冲区,普通调用为nil
+	stream *replyStream
+	//OpenStream打开的双向流,不是双向流时为nil
+	bidi *ClientStream
+	//已收到的响应帧,只由接收协程访问
+	frames []byte
+	//是否已发出CallFirstByte事件,只由接收协程访问
+	firstByte bool
+	//是否已发出CallSent事件,原子访问
+	sentEvent uint32
+	//注册调用的时间
+	start time.Time
+	//只用于这次调用的消息体协议,为空时使用Option.BodyCodec
+	bodyCodec codec.Type
+	//接收服务端通过SendEvent发送的事件,为nil时丢弃事件
+	onEvent func(line string)
+	//Retry重发时沿用的序列号,0表示分配新的序列号
+	retrySeq uint64
+}
+
+//调用的消息体协议
+func (call *Call) bodyCodecOf(option *Option) codec.Type {
+	if call.bodyCodec != "" {
+		return call.bodyCodec
+	}
+	return option.BodyCodec
 }
 
 //当调用结束时会通知调用方
@@ -37,33 +80,95 @@ type Client struct {
 	//请求Option信息
 	option *Option
 	//发送锁(保证请求都被完整发送)
-	sendLock sync.Mutex
+	sendLock sendQueue
 	//请求header(多个请求都复用该header)
 	header codec.Header
 	//加锁保证修改和访问pending和设置变量时没有并发问题
 	lock sync.Mutex
 	//序列号
 	seq uint64
+	//ReserveSeqRange保留的序列号区间,registerCall分配时跳过
+	reserved []seqRange
 	//存储未处理完的请求
 	pending map[uint64]*Call
 	//用户调用是否关闭
 	closed bool
 	//服务端是否通知关闭
 	shutdown bool
+	//连接关闭的原因
+	closeReason CloseReason
+	//保护coalescing
+	coalesceLock sync.Mutex
+	//合并调用的key->进行中的调用
+	coalescing map[string]*coalescedCall
+	//统计读写字节数的连接
+	conn *countingConn
+	//协议事件追踪
+	trace tracer
+	//客户端注册的供服务端回调的实例
+	handlers *Server
+	//正在处理的服务端回调,Close时等待它们返回
+	handlerWG sync.WaitGroup
+	//服务端回调的方法的context,Close或连接断开时取消
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+	//请求id的前缀,每个客户端随机生成,与seq一起组成全局唯一的请求id
+	requestIDPrefix string
+	//CallCached的响应缓存,第一次使用时创建
+	cacheOnce sync.Once
+	cache     *responseCache
+	//保活ping测得的往返时延
+	rtt rttStats
+	//调用生命周期各阶段的回调,默认为nil不回调;在接收协程或持有锁时调用,不能阻塞或调用该客户端的方法
+	OnCallEvent func(evt CallEvent)
+}
+
+//一次被合并的调用,所有相同key的调用方共享它的结果
+type coalescedCall struct {
+	//调用结束时关闭
+	done chan struct{}
+	//reply的类型,各调用方必须一致
+	replyType reflect.Type
+	//编码后的结果,等待的调用方各自从中解码出独立的副本
+	data []byte
+	//data的编码协议
+	t   codec.Type
+	err error
 }
 
 var ErrShutdown = errors.New("conn is shut down")
 
+//reply为nil时调用返回的错误,服务端总会返回一个消息体,需要有地方存放
+var ErrNilReply = errors.New("rpc client: reply must not be nil")
+
+//args为nil时发送的空参数,服务端解码到结构体类型的参数时得到零值,其他类型会返回解码错误
+var emptyArgs = struct{}{}
+
+//判断v是否为nil或者nil指针
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
 //主动关闭连接
+//服务端回调的方法的context被取消,Close等待它们返回,因此不能在回调的方法中调用Close
 func (clent *Client) Close() error {
 	clent.lock.Lock()
-	defer clent.lock.Unlock()
 	if clent.closed {
+		clent.lock.Unlock()
 		//如果已经关闭
 		return ErrShutdown
 	}
 	clent.closed = true
-	return clent.c.Close()
+	err := clent.c.Close()
+	clent.lock.Unlock()
+	//closed设置后不再开始新的回调,等待已经开始的回调返回
+	clent.cancelHandlers()
+	clent.handlerWG.Wait()
+	return err
 }
 
 //判断客户端目前是否可用
@@ -73,6 +178,20 @@ func (client *Client) IsAvailable() bool {
 	return !client.shutdown && !client.closed
 }
 
+//把Codec中缓冲的待发送数据写到连接,可以与发送请求并发调用
+//内置的gob,json和cbor在Write中就把整条消息写到了连接,Flush对它们不做任何事,只对自己实现codec.Flusher并缓冲写入的Codec有作用
+func (client *Client) Flush() error {
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	if !client.IsAvailable() {
+		return ErrShutdown
+	}
+	if f, ok := client.c.(codec.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 //注册调用方法,返回调用对象的序列号
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.lock.Lock()
@@ -81,8 +200,23 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	if client.closed || client.shutdown {
 		return 0, ErrShutdown
 	}
+	if call.retrySeq != 0 {
+		//重发的调用沿用原来的序列号,原来的调用还在等待响应时不能重发
+		if client.pending[call.retrySeq] != nil {
+			return 0, fmt.Errorf("rpc client: call seq=%d is still pending", call.retrySeq)
+		}
+		call.Seq = call.retrySeq
+		call.start = time.Now()
+		client.pending[call.Seq] = call
+		return call.Seq, nil
+	}
+	//序列号回绕后跳过0(表示没有序列号),仍在等待响应的序列号和保留的区间
+	for client.seq == 0 || client.pending[client.seq] != nil || client.skipReserved() {
+		client.seq++
+	}
 	//将调用序列号设为客户端的序列号
 	call.Seq = client.seq
+	call.start = time.Now()
 	//将该seq->call加入到pending
 	client.pending[call.Seq] = call
 	//序列号自增
@@ -90,6 +224,37 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	return call.Seq, nil
 }
 
+//正在等待响应的调用数
+func (client *Client) PendingCount() int {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return len(client.pending)
+}
+
+//正在等待响应的调用信息
+type InFlightCall struct {
+	//调用的序列号
+	Seq uint64
+	//服务名和方法名
+	ServiceMethod string
+	//从发起调用到现在经过的时间
+	Age time.Duration
+}
+
+//返回所有正在等待响应的调用,按序列号排序,用于排查卡住的调用
+func (client *Client) InFlight() []InFlightCall {
+	//结果在锁外分配,避免分配内存时阻塞收发
+	calls := make([]InFlightCall, 0, client.PendingCount())
+	now := time.Now()
+	client.lock.Lock()
+	for seq, call := range client.pending {
+		calls = append(calls, InFlightCall{Seq: seq, ServiceMethod: call.ServiceMethod, Age: now.Sub(call.start)})
+	}
+	client.lock.Unlock()
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Seq < calls[j].Seq })
+	return calls
+}
+
 //删除调用方法
 func (client *Client) removeCall(seq uint64) *Call {
 	client.lock.Lock()
@@ -99,6 +264,13 @@ func (client *Client) removeCall(seq uint64) *Call {
 	return call
 }
 
+//返回连接关闭的原因,连接仍可用时返回UnknownReason
+func (client *Client) CloseReason() CloseReason {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.closeReason
+}
+
 //当客户端或者服务端发生故障时,调用该函数将shutdown改成true并且通知所有的pending中的call
 func (client *Client) terminateCalls(err error) {
 	client.sendLock.Lock()
@@ -106,48 +278,135 @@ func (client *Client) terminateCalls(err error) {
 	client.lock.Lock()
 	defer client.lock.Unlock()
 	client.shutdown = true
+	//用户主动关闭时读取必然出错,以主动关闭为准
+	if client.closed {
+		client.closeReason = ClientClosed
+	} else {
+		client.closeReason = closeReasonOf(err, ServerClosed)
+	}
 	for _, call := range client.pending {
 		call.Error = err
-		call.done()
+		client.finishCall(call)
 	}
+	//连接已断开,回调的响应无法再发回服务端
+	client.cancelHandlers()
 }
 
-//接受响应
-func (client *Client) receive() {
+//接受响应,started在开始读取前关闭,用于通知创建方receive已经就绪
+func (client *Client) receive(started chan struct{}) {
 	var err error
+	close(started)
 	for err == nil {
 		var h codec.Header
+		read := client.conn.BytesRead()
 		//从客户端的codec读取请求Header
 		if err = client.c.ReadHeader(&h); err != nil {
 			//报错退出循环
 			break
 		}
+		if client.trace.enabled() {
+			client.trace.printf("recv header seq=%d method=%s request-id=%s error=%q", h.Seq, h.ServiceMethod, requestIDOf(&h), h.Error)
+		}
+		if h.Reverse {
+			//服务端发起的调用
+			client.serveReverse(&h)
+			continue
+		}
+		if h.Metadata[KeepaliveKey] == keepalivePong {
+			client.rtt.finish(time.Now())
+			err = client.c.ReadBody(nil)
+			continue
+		}
+		client.markFirstByte(h.Seq)
+		if h.Metadata[FrameKey] == frameMore {
+			//分帧的响应,收到最后一帧前不删除调用
+			err = client.receiveFrame(h.Seq)
+			continue
+		}
+		if h.Metadata[EventKey] != "" {
+			//方法返回前发送的事件,最终响应到达前不删除调用
+			err = client.receiveEvent(h.Seq)
+			continue
+		}
+		if h.Metadata[BidiKey] != "" {
+			//双向流的消息,方法返回前不删除调用
+			err = client.receiveBidi(&h)
+			continue
+		}
+		if h.Metadata[StreamKey] == streamChunk {
+			//流式响应的数据块,流结束前不删除调用
+			err = client.receiveChunk(h.Seq)
+			continue
+		}
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.replyMetadata = h.Metadata
+		}
 		switch {
 		//当根据seq获取的调用实例为空
 		case call == nil:
 			err = client.c.ReadBody(nil)
 		case h.Error != "":
 			//当header中的错误信息不为空
-			call.Error = fmt.Errorf(h.Error)
-			err = client.c.ReadBody(nil)
+			if h.Metadata[ErrorChainKey] != "" {
+				//消息体是错误链
+				var chain errorChain
+				if err = client.c.ReadBody(&chain); err == nil {
+					call.Error = chain.build()
+				}
+				//错误链为空时只有消息头中的错误信息,调用仍然是失败的
+				if call.Error == nil {
+					call.Error = errors.New(h.Error)
+				}
+			} else {
+				call.Error = fmt.Errorf(h.Error)
+				err = client.c.ReadBody(nil)
+			}
+			call.bytesReceived = client.conn.BytesRead() - read
 			//调用结束
-			call.done()
+			client.finishCall(call)
+		case h.Metadata[NotModifiedKey] != "":
+			//响应未变化,消息体为空,保留调用方缓存的reply
+			call.Error = ErrNotModified
+			err = client.c.ReadBody(nil)
+			call.bytesReceived = client.conn.BytesRead() - read
+			client.finishCall(call)
+		case h.Metadata[FrameKey] == frameLast:
+			err = client.receiveLastFrame(call)
+			call.bytesReceived = client.conn.BytesRead() - read
+			client.finishCall(call)
 		default:
 			//读取Body然后赋值给call.Reply
 			err = client.c.ReadBody(call.Reply)
-			if err != nil {
+			call.decodeTime = decodeTimeOf(client.c)
+			if errors.Is(err, codec.ErrChecksumMismatch) {
+				//消息体已完整读出,只有这个调用失败
+				call.Error = err
+				err = nil
+			} else if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
-			call.done()
+			call.bytesReceived = client.conn.BytesRead() - read
+			client.finishCall(call)
+		}
+		if err == nil {
+			if client.trace.enabled() {
+				client.trace.printf("recv body seq=%d", h.Seq)
+			}
 		}
 	}
 	//有错误时
+	client.trace.printf("connection terminated: %v", err)
 	client.terminateCalls(err)
 }
 
 //初始化Client,发送option完成协议交换,然后创建一个子协程来接收响应
 func NewClient(conn net.Conn, option *Option) (*Client, error) {
+	return newClient(conn, option)
+}
+
+//NewClient的实现,conn可以是任意字节流,如WebSocket连接
+func newClient(conn io.ReadWriteCloser, option *Option) (*Client, error) {
 	//根据CodecType获取对应协议的构造方法
 	codecFunc := codec.NewCodeFuncMap[option.CodecType]
 	if codecFunc == nil {
@@ -156,24 +415,85 @@ func NewClient(conn net.Conn, option *Option) (*Client, error) {
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	if option.BodyCodec != "" && !codec.SupportsBodyCodec(option.BodyCodec) {
+		err := fmt.Errorf("invalid body codec type %s", option.BodyCodec)
+		log.Println("rpc client: codec error:", err)
+		return nil, err
+	}
+	if option.FallbackCodec != "" && !codec.SupportsBodyCodec(option.FallbackCodec) {
+		err := fmt.Errorf("invalid fallback codec type %s", option.FallbackCodec)
+		log.Println("rpc client: codec error:", err)
+		return nil, err
+	}
+	if option.Checksum {
+		if !codec.SupportsChecksum(option.CodecType) {
+			err := fmt.Errorf("codec type %s does not support checksum", option.CodecType)
+			log.Println("rpc client: codec error:", err)
+			return nil, err
+		}
+	}
+	if option.NoDelay {
+		setNoDelay(conn)
+	}
+	if option.WireTap != nil {
+		conn = newTapConn(conn, option.WireTap, new(sync.Mutex))
+	}
+	//每个客户端使用新的会话,服务端按会话去重,不会把之前客户端的结果返回给seq相同的调用
+	sent := option
+	if option.ClientID != "" {
+		copied := *option
+		copied.Session = newRandomID()
+		sent = &copied
+	}
 	//发送options到服务端来确定协议
-	if err := json.NewEncoder(conn).Encode(option); err != nil {
+	if err := writeOption(conn, sent); err != nil {
 		log.Println("rpc client: options error:", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(codecFunc(conn), option), nil
+	counting := newCountingConn(conn)
+	cc := codecFunc(counting)
+	//消息头和消息体使用不同的协议
+	if setter, ok := cc.(codec.BodyCodecSetter); ok && option.BodyCodec != "" {
+		setter.SetBodyCodec(option.BodyCodec)
+	}
+	if option.Checksum {
+		cc.(codec.ChecksumSetter).SetChecksum(true)
+	}
+	if setter, ok := cc.(codec.FallbackSetter); ok && option.FallbackCodec != "" {
+		setter.SetFallbackBodyCodec(option.FallbackCodec)
+	}
+	if sizer, ok := cc.(codec.BufferSizer); ok && option.BufferSize > 0 {
+		sizer.SetBufferSize(option.BufferSize)
+	}
+	client := newClientCodec(cc, option, counting)
+	if client.trace.enabled() {
+		client.trace.printf("handshake remote=%s codec=%s", remoteAddrOf(conn), option.CodecType)
+	}
+	return client, nil
 }
 
-//根据codec和option来创建客户端
-func newClientCodec(c codec.Codec, option *Option) *Client {
+//根据codec和option来创建客户端,conn为codec使用的连接
+func newClientCodec(c codec.Codec, option *Option, conn *countingConn) *Client {
 	client := &Client{
-		seq:     1,
-		c:       c,
-		option:  option,
-		pending: make(map[uint64]*Call),
+		seq:             1,
+		c:               c,
+		option:          option,
+		pending:         make(map[uint64]*Call),
+		conn:            conn,
+		trace:           tracer{prefix: "rpc client"},
+		handlers:        NewServer(),
+		requestIDPrefix: newRandomID(),
+	}
+	client.handlerCtx, client.cancelHandlers = context.WithCancel(context.Background())
+	client.trace.setWriter(option.Trace)
+	//等待receive协程真正开始读取后再返回,避免首个调用与启动过程竞争
+	started := make(chan struct{})
+	go client.receive(started)
+	<-started
+	if option.KeepaliveInterval > 0 {
+		go client.keepalive(option.KeepaliveInterval)
 	}
-	go client.receive()
 	return client
 }
 
@@ -186,6 +506,9 @@ func Dial(network string, address string, options ...*Option) (client *Client, e
 	}
 	//与服务端获取连接
 	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
 	//最后如果返回的client为空,此时直接关闭连接
 	defer func() {
 		if client == nil {
@@ -195,6 +518,23 @@ func Dial(network string, address string, options ...*Option) (client *Client, e
 	return NewClient(conn, option)
 }
 
+//依次尝试每个地址,返回第一个连接成功的客户端,全部失败时返回汇总的错误
+func DialAny(network string, addresses []string, options ...*Option) (*Client, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("rpc client: no address to dial")
+	}
+	errs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		client, err := Dial(network, address, options...)
+		if err == nil {
+			return client, nil
+		}
+		log.Printf("rpc client: dial %s error: %v", address, err)
+		errs = append(errs, address+": "+err.Error())
+	}
+	return nil, errors.New("rpc client: all addresses failed: " + strings.Join(errs, "; "))
+}
+
 //解析传入的Option
 func parseOptions(options ...*Option) (*Option, error) {
 	//如果没有传option,则使用默认option
@@ -217,6 +557,9 @@ func parseOptions(options ...*Option) (*Option, error) {
 
 //发送调用信息
 func (client *Client) send(call *Call) {
+	if client.sendFrames(call) {
+		return
+	}
 	//发送加锁,保证发送完整的请求
 	client.sendLock.Lock()
 	defer client.sendLock.Unlock()
@@ -226,43 +569,110 @@ func (client *Client) send(call *Call) {
 	if err != nil {
 		call.Error = err
 		//结束调用,给调用方发消息(by chan)
-		call.done()
+		client.finishCall(call)
 		return
 	}
+	client.emitCallEvent(call, CallRegistered)
 
 	//准备请求头
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.ArgType = argTypeName(reflect.TypeOf(call.Args))
+	client.header.BodyCodec = call.bodyCodecOf(client.option)
+	client.header.ReplyCodec = client.option.ReplyCodec
+	requestID := client.requestIDPrefix + "-" + strconv.FormatUint(seq, 10)
+	client.header.Metadata = map[string]string{RequestIDKey: requestID}
+	for k, v := range call.metadata {
+		client.header.Metadata[k] = v
+	}
 
-	//编码并发送
+	//编码并发送,写阻塞超时后连接会被关闭,防止一直占用发送锁
+	timeout := client.option.SendTimeout
+	deadliner, canDeadline := client.c.(codec.WriteDeadliner)
+	if timeout > 0 && canDeadline {
+		_ = deadliner.SetWriteDeadline(time.Now().Add(timeout))
+		defer func() { _ = deadliner.SetWriteDeadline(time.Time{}) }()
+	}
+	written := client.conn.BytesWritten()
 	if err := client.c.Write(&client.header, call.Args); err != nil {
+		if closeReasonOf(err, UnknownReason) == Timeout {
+			err = fmt.Errorf("rpc client: send timeout after %s: %w", timeout, err)
+		}
+		if client.trace.enabled() {
+			client.trace.printf("send seq=%d method=%s request-id=%s error=%v", seq, call.ServiceMethod, requestID, err)
+		}
 		//报错则将该调用删去
 		call := client.removeCall(seq)
 		if call != nil {
 			call.Error = err
 			//结束调用,给调用方发消息(by chan)
-			call.done()
+			client.finishCall(call)
 		}
+		return
+	}
+	call.bytesSent = client.conn.BytesWritten() - written
+	call.encodeTime = encodeTimeOf(client.c)
+	if client.trace.enabled() {
+		client.trace.printf("send seq=%d method=%s request-id=%s bytes=%d", seq, call.ServiceMethod, requestID, call.bytesSent)
 	}
+	client.markSent(call)
 }
 
+//Go未传入done时创建的chan的缓冲大小,必须为正数
+var DefaultDoneBuffer = 10
+
 func (client *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	client.start(call)
+	return call
+}
+
+//用原来的序列号重新发送已经结束的调用,如CallContext超时后重试,返回新的调用
+//连接设置了ClientID且服务端开启DedupWindow时,方法至多执行一次,重复的请求得到第一次执行的结果
+//call必须是该客户端发出的调用,还在等待响应时新的调用返回错误
+func (client *Client) Retry(call *Call, done chan *Call) *Call {
+	retry := newCall(call.ServiceMethod, call.Args, call.Reply, done)
+	retry.metadata = call.metadata
+	retry.bodyCodec = call.bodyCodec
+	retry.onEvent = call.onEvent
+	retry.retrySeq = call.Seq
+	client.start(retry)
+	return retry
+}
+
+//创建调用,done为空时创建带缓冲的chan
+func newCall(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
 	if done == nil {
-		done = make(chan *Call, 10)
+		if DefaultDoneBuffer <= 0 {
+			log.Panicf("rpc client: invalid DefaultDoneBuffer %d", DefaultDoneBuffer)
+		}
+		done = make(chan *Call, DefaultDoneBuffer)
 	} else if cap(done) == 0 {
 		//还未完成
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	//nil参数按空结构体发送,gob和json都无法直接编码nil
+	if isNil(args) {
+		args = emptyArgs
+	}
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
+}
+
+//发起调用,需要额外设置的字段(如metadata)在调用前设置好
+func (client *Client) start(call *Call) {
+	if isNil(call.Reply) {
+		call.Error = ErrNilReply
+		call.done()
+		return
+	}
 	//调用
 	client.send(call)
-	return call
 }
 
 func (client *Client) Call(serviceMethod string, args, reply interface{}) error {
@@ -270,3 +680,165 @@ func (client *Client) Call(serviceMethod string, args, reply interface{}) error
 	call := <-client.Go(serviceMethod, args, reply, make(chan *Call, 1)).Done
 	return call.Error
 }
+
+//ctx超时导致调用结束时返回的错误
+var ErrCallTimeout = errors.New("rpc client: call timeout")
+
+//与Call相同,ctx结束时放弃等待响应,超时返回ErrCallTimeout,取消返回ctx.Err()
+//ctx在发送前已经结束时不发送请求,发送阻塞(如对端读取过慢)期间ctx结束时也立即返回
+func (client *Client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	if _, err := client.callContext(ctx, call, client.start); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+//与CallContext相同,但这次调用的参数按bodyCodec编码并在请求头中标明,服务端按该协议解码,连接上的其他调用不受影响
+//例如在gob连接上发送Json的参数便于调试,bodyCodec需要被codec.SupportsBodyCodec支持
+func (client *Client) CallWithBodyCodec(ctx context.Context, bodyCodec codec.Type, serviceMethod string, args, reply interface{}) error {
+	if !codec.SupportsBodyCodec(bodyCodec) {
+		return fmt.Errorf("rpc client: invalid body codec type %s", bodyCodec)
+	}
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	call.bodyCodec = bodyCodec
+	if _, err := client.callContext(ctx, call, client.start); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+//用send发送call并等待完成,返回的sent为false时ctx在发送完成前结束,call.Seq还不能读取
+//ctx可能结束时在新的协程中发送,发送阻塞期间ctx结束也立即返回,请求发送完成后再删除该调用
+func (client *Client) callContext(ctx context.Context, call *Call, send func(*Call)) (sent bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, contextCallError(err)
+	}
+	if ctx.Done() == nil {
+		send(call)
+		return true, client.wait(ctx, call)
+	}
+	done := make(chan struct{})
+	go func() {
+		send(call)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true, client.wait(ctx, call)
+	case <-ctx.Done():
+		go func() {
+			<-done
+			client.removeCall(call.Seq)
+		}()
+		return false, contextCallError(ctx.Err())
+	}
+}
+
+//等待调用完成,ctx先结束时删除该调用,之后到达的响应会被丢弃
+func (client *Client) wait(ctx context.Context, call *Call) error {
+	select {
+	case <-call.Done:
+		return nil
+	case <-ctx.Done():
+		client.removeCall(call.Seq)
+		return contextCallError(ctx.Err())
+	}
+}
+
+//ctx结束导致调用结束时返回的错误,超时返回ErrCallTimeout
+func contextCallError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrCallTimeout
+	}
+	return err
+}
+
+//带有调用细节的调用结果
+type CallResult struct {
+	//请求的序列号
+	Seq uint64
+	//服务端地址
+	ServerAddr string
+	//请求编码后发送的字节数
+	BytesSent uint64
+	//接收到的响应的字节数,按codec从连接读取的字节统计,多个响应连续到达时因缓冲可能有偏差
+	BytesReceived uint64
+	//从发起调用到收到响应的总耗时
+	Latency time.Duration
+	//Codec统计的编码请求和解码响应的耗时,不包括阻塞在连接上读写的时间,Codec不支持codec.Timer时为0
+	EncodeTime time.Duration
+	DecodeTime time.Duration
+}
+
+//与Call相同,同时返回本次调用的序列号,收发字节数和耗时,ctx结束时放弃等待响应
+//ctx在请求发送完成前结束时不等待发送,返回的Seq为0
+func (client *Client) CallDetailed(ctx context.Context, serviceMethod string, args, reply interface{}) (CallResult, error) {
+	start := time.Now()
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	result := CallResult{ServerAddr: remoteAddrOf(client.conn.ReadWriteCloser)}
+	sent, err := client.callContext(ctx, call, client.start)
+	if sent {
+		result.Seq = call.Seq
+	}
+	if err != nil {
+		result.Latency = time.Since(start)
+		return result, err
+	}
+	result.BytesSent = call.bytesSent
+	result.BytesReceived = call.bytesReceived
+	result.EncodeTime = call.encodeTime
+	result.DecodeTime = call.decodeTime
+	result.Latency = time.Since(start)
+	return result, call.Error
+}
+
+//合并调用:key相同的调用在已有调用进行中时不再发送请求,而是等待它完成并共享其结果
+//每个调用方得到独立的reply(通过重新解码结果得到深拷贝),各调用方的reply类型必须一致
+func (client *Client) CallCoalesced(key string, serviceMethod string, args, reply interface{}) error {
+	dst := reflect.ValueOf(reply)
+	if isNil(reply) || dst.Kind() != reflect.Ptr {
+		return ErrNilReply
+	}
+	client.coalesceLock.Lock()
+	if client.coalescing == nil {
+		client.coalescing = make(map[string]*coalescedCall)
+	}
+	if c, ok := client.coalescing[key]; ok {
+		client.coalesceLock.Unlock()
+		<-c.done
+		if c.err != nil {
+			return c.err
+		}
+		if dst.Type() != c.replyType {
+			return fmt.Errorf("rpc client: coalesced reply type %T mismatch %s", reply, c.replyType)
+		}
+		copied := reflect.New(c.replyType.Elem())
+		if err := codec.Unmarshal(c.t, c.data, copied.Interface()); err != nil {
+			return fmt.Errorf("rpc client: copy coalesced reply: %w", err)
+		}
+		dst.Elem().Set(copied.Elem())
+		return nil
+	}
+	c := &coalescedCall{done: make(chan struct{}), replyType: dst.Type(), t: streamCodecOf(client.option)}
+	client.coalescing[key] = c
+	client.coalesceLock.Unlock()
+
+	//结果解码到合并调用自己的reply,编码成data后只交给发起调用者,不与等待者共享
+	owned := reflect.New(c.replyType.Elem())
+	c.err = client.Call(serviceMethod, args, owned.Interface())
+	if c.err == nil {
+		if c.data, c.err = codec.Marshal(c.t, owned.Interface()); c.err != nil {
+			c.err = fmt.Errorf("rpc client: copy coalesced reply: %w", c.err)
+		}
+	}
+	client.coalesceLock.Lock()
+	delete(client.coalescing, key)
+	client.coalesceLock.Unlock()
+	close(c.done)
+	if c.err != nil {
+		return c.err
+	}
+	dst.Elem().Set(owned.Elem())
+	return nil
+}
@@ -0,0 +1,1466 @@
+package gorpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+//启动一个注册了给定实例的服务端,返回监听地址
+func startTestServer(t *testing.T, server *Server, instances ...interface{}) string {
+	t.Helper()
+	for _, instance := range instances {
+		if err := server.Register(instance); err != nil {
+			t.Fatal("register error:", err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+//Dial之后立即发起调用,配合-race确认receive启动没有竞争
+func TestClientCallImmediatelyAfterDial(t *testing.T) {
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &foo)
+	for i := 0; i < 50; i++ {
+		client, err := Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil {
+			t.Fatal("call error:", i, err)
+		}
+		if reply != i+1 {
+			t.Fatalf("expect %d, got %d", i+1, reply)
+		}
+		_ = client.Close()
+	}
+}
+
+//记录SetNoDelay调用的连接包装
+type recordNoDelayConn struct {
+	net.Conn
+	noDelay bool
+}
+
+func (c *recordNoDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = noDelay
+	return nil
+}
+
+func TestOptionNoDelay(t *testing.T) {
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &foo)
+	for _, noDelay := range []bool{false, true} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		wrapped := &recordNoDelayConn{Conn: conn}
+		client, err := NewClient(wrapped, &Option{MagicNumber: MagicNumber, CodecType: DefaultOption.CodecType, NoDelay: noDelay})
+		if err != nil {
+			t.Fatal("new client error:", err)
+		}
+		if wrapped.noDelay != noDelay {
+			t.Fatalf("expect no delay %v, got %v", noDelay, wrapped.noDelay)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestServerNoDelay(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.NoDelay = true
+	_ = server.Register(&foo)
+	serverConn, clientConn := net.Pipe()
+	wrapped := &recordNoDelayConn{Conn: serverConn}
+	go server.ServeConn(wrapped)
+	client, err := NewClient(clientConn, DefaultOption)
+	if err != nil {
+		t.Fatal("new client error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if !wrapped.noDelay {
+		t.Fatal("expect server to set no delay")
+	}
+}
+
+//接收连接后开启Nagle算法的监听器,作为基准测试的对照
+type nagleListener struct {
+	net.Listener
+}
+
+func (l nagleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		_ = conn.(*net.TCPConn).SetNoDelay(false)
+	}
+	return conn, err
+}
+
+//大量顺序的小请求,对比双方都开启Nagle算法与Go默认禁用Nagle算法的延迟
+func BenchmarkTinySequentialCalls(b *testing.B) {
+	var foo Foo
+	for _, nagle := range []bool{true, false} {
+		nagle := nagle
+		name := "NoDelay"
+		if nagle {
+			name = "Nagle"
+		}
+		b.Run(name, func(b *testing.B) {
+			server := NewServer()
+			_ = server.Register(&foo)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal("network error:", err)
+			}
+			defer func() { _ = l.Close() }()
+			if nagle {
+				go server.Accept(nagleListener{l})
+			} else {
+				go server.Accept(l)
+			}
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal("dial error:", err)
+			}
+			if nagle {
+				_ = conn.(*net.TCPConn).SetNoDelay(false)
+			}
+			client, err := NewClient(conn, DefaultOption)
+			if err != nil {
+				b.Fatal("new client error:", err)
+			}
+			defer func() { _ = client.Close() }()
+			var reply int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil {
+					b.Fatal("call error:", err)
+				}
+			}
+		})
+	}
+}
+
+type RawEcho struct{}
+
+func (e *RawEcho) Echo(args codec.RawBytes, reply *codec.RawBytes) error {
+	*reply = args
+	return nil
+}
+
+func TestRawBytes(t *testing.T) {
+	var echo RawEcho
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &echo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	args := make(codec.RawBytes, 1024)
+	for i := range args {
+		args[i] = byte(i)
+	}
+	var reply codec.RawBytes
+	if err := client.Call("RawEcho.Echo", args, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if !bytes.Equal(args, reply) {
+		t.Fatal("reply bytes differ from args")
+	}
+}
+
+func TestDialAny(t *testing.T) {
+	//先占用一个端口再关闭,得到一个无人监听的地址
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	down := l.Addr().String()
+	_ = l.Close()
+
+	var foo Foo
+	up := startTestServer(t, NewServer(), &foo)
+	client, err := DialAny("tcp", []string{down, up})
+	if err != nil {
+		t.Fatal("dial any error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err)
+	}
+
+	if _, err := DialAny("tcp", []string{down}); err == nil || !strings.Contains(err.Error(), down) {
+		t.Fatal("expect aggregate error containing failed address, got:", err)
+	}
+}
+
+func TestDefaultDoneBuffer(t *testing.T) {
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	old := DefaultDoneBuffer
+	defer func() { DefaultDoneBuffer = old }()
+	DefaultDoneBuffer = 1
+	var reply int
+	call := client.Go("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, nil)
+	if cap(call.Done) != 1 {
+		t.Fatal("expect done channel capacity 1, got", cap(call.Done))
+	}
+	<-call.Done
+}
+
+func TestJsonCodecCall(t *testing.T) {
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo), &Option{CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+	if err := client.Call("Foo.Missing", Args{}, &reply); err == nil {
+		t.Fatal("expect error for missing method")
+	}
+	if err := client.Call("Foo.Sum", Args{Num1: 2, Num2: 2}, &reply); err != nil || reply != 4 {
+		t.Fatal("call error after failed call:", err, reply)
+	}
+}
+
+//统计被调用次数的服务
+type Counter struct {
+	hits int32
+}
+
+func (c *Counter) Hit(args int, reply *int) error {
+	atomic.AddInt32(&c.hits, 1)
+	time.Sleep(100 * time.Millisecond)
+	*reply = args
+	return nil
+}
+
+func TestCallCoalesced(t *testing.T) {
+	var counter Counter
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &counter))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			if err := client.CallCoalesced("key", "Counter.Hit", 7, &reply); err != nil || reply != 7 {
+				t.Error("coalesced call error:", err, reply)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits := atomic.LoadInt32(&counter.hits); hits != 1 {
+		t.Fatal("expect one rpc to reach server, got", hits)
+	}
+}
+
+//服务端接受连接后从不读取,大请求会填满发送缓冲区,发送需要超时返回
+func TestSendTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(3 * time.Second)
+		_ = conn.Close()
+	}()
+	client, err := Dial("tcp", l.Addr().String(), &Option{SendTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	start := time.Now()
+	var reply int
+	err = client.Call("Foo.Sum", make([]byte, 64<<20), &reply)
+	if err == nil || !strings.Contains(err.Error(), "send timeout") {
+		t.Fatal("expect send timeout error, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("send took too long:", elapsed)
+	}
+}
+
+//并发安全的输出缓冲
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+//按顺序检查输出中包含每个事件
+func assertEventOrder(t *testing.T, output string, events ...string) {
+	t.Helper()
+	rest := output
+	for _, event := range events {
+		i := strings.Index(rest, event)
+		if i < 0 {
+			t.Fatalf("expect event %q in order, output:\n%s", event, output)
+		}
+		rest = rest[i+len(event):]
+	}
+}
+
+func TestTraceTo(t *testing.T) {
+	var foo Foo
+	var serverTrace, clientTrace syncBuffer
+	server := NewServer()
+	server.TraceTo(&serverTrace)
+	//通过Option设置时握手也被追踪
+	client, err := Dial("tcp", startTestServer(t, server, &foo), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Trace: &clientTrace})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	_ = client.Close()
+	time.Sleep(50 * time.Millisecond)
+	assertEventOrder(t, clientTrace.String(),
+		"rpc client: handshake remote=", "codec=application/gob",
+		"rpc client: send seq=1 method=Foo.Sum request-id=", "bytes=",
+		"rpc client: recv header seq=1 method=Foo.Sum",
+		"rpc client: recv body seq=1",
+		"rpc client: connection terminated")
+	assertEventOrder(t, serverTrace.String(),
+		"rpc server: handshake remote=",
+		"rpc server: recv header seq=1 method=Foo.Sum",
+		"rpc server: send seq=1 method=Foo.Sum",
+		"rpc server: connection closed: client closed")
+}
+
+func TestNilArgsAndReply(t *testing.T) {
+	var foo Foo
+	var counter Counter
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo, &counter))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, nil); !errors.Is(err, ErrNilReply) {
+		t.Fatal("expect nil reply error, got:", err)
+	}
+	var nilReply *int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, nilReply); !errors.Is(err, ErrNilReply) {
+		t.Fatal("expect nil reply error for typed nil, got:", err)
+	}
+	//结构体参数可以省略,得到零值
+	reply := -1
+	if err := client.Call("Foo.Sum", nil, &reply); err != nil || reply != 0 {
+		t.Fatal("expect nil args accepted for struct arg:", err, reply)
+	}
+	var nilArgs *Args
+	if err := client.Call("Foo.Sum", nilArgs, &reply); err != nil || reply != 0 {
+		t.Fatal("expect typed nil args accepted for struct arg:", err, reply)
+	}
+	//非结构体参数不能省略,但不应影响连接
+	if err := client.Call("Counter.Count", nil, &reply); err == nil {
+		t.Fatal("expect error for nil args of int arg")
+	}
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error after nil args:", err, reply)
+	}
+}
+
+//gob连接上发送gob编码的请求,接收json编码的响应
+func TestPerRequestBodyCodec(t *testing.T) {
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &foo)
+	client, err := Dial("tcp", addr, &Option{BodyCodec: codec.GobType, ReplyCodec: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 3; i++ {
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 2}, &reply); err != nil || reply != i+2 {
+			t.Fatal("call error:", err, reply)
+		}
+	}
+	var reply int
+	if err := client.Call("Foo.Missing", Args{}, &reply); err == nil {
+		t.Fatal("expect error for missing method")
+	}
+	if err := client.Call("Foo.Sum", Args{Num1: 2, Num2: 2}, &reply); err != nil || reply != 4 {
+		t.Fatal("call error after failed call:", err, reply)
+	}
+}
+
+func TestCallDetailed(t *testing.T) {
+	var echo RawEcho
+	addr := startTestServer(t, NewServer(), &echo)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	payload := codec.RawBytes(bytes.Repeat([]byte("x"), 64<<10))
+	var reply codec.RawBytes
+	result, err := client.CallDetailed(context.Background(), "RawEcho.Echo", payload, &reply)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if result.Latency <= 0 || result.Seq == 0 || result.ServerAddr != addr {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	//请求和响应都只比消息体多出消息头和类型信息
+	for name, n := range map[string]uint64{"sent": result.BytesSent, "received": result.BytesReceived} {
+		if n < uint64(len(payload)) || n > uint64(len(payload))+1024 {
+			t.Fatalf("expect %s bytes close to %d, got %d", name, len(payload), n)
+		}
+	}
+}
+
+//以流的形式返回数据的服务
+type Files struct {
+	data    []byte
+	counter *countingReader
+}
+
+func (f *Files) Open(args int, reply *io.ReadCloser) error {
+	*reply = io.NopCloser(bytes.NewReader(f.data))
+	return nil
+}
+
+//记录服务端已经从中读取的字节数
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (f *Files) Counted(args int, reply *io.ReadCloser) error {
+	*reply = io.NopCloser(f.counter)
+	return nil
+}
+
+func (f *Files) Broken(args int, reply *io.ReadCloser) error {
+	*reply = io.NopCloser(io.MultiReader(bytes.NewReader(f.data[:10]), iotest.ErrReader(errors.New("disk error"))))
+	return nil
+}
+
+func TestCallStreamReply(t *testing.T) {
+	files := &Files{data: make([]byte, 1<<20)}
+	for i := range files.data {
+		files.data[i] = byte(i * 7)
+	}
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), files, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	r, err := client.CallStreamReply("Files.Open", 0)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatal("read error:", err)
+	}
+	//流没有读完时同一连接上的其他调用不受影响
+	var sum int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatal("call error:", err, sum)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(append(head, rest...), files.data) {
+		t.Fatal("stream data mismatch")
+	}
+	_ = r.Close()
+
+	r, err = client.CallStreamReply("Files.Broken", 0)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	data, err := io.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), "disk error") || len(data) != 10 {
+		t.Fatalf("expect disk error after 10 bytes, got %d bytes err=%v", len(data), err)
+	}
+}
+
+//客户端不读取时服务端最多发送一个接收窗口的数据,请求没有发出时直接返回错误
+func TestCallStreamReplyWindow(t *testing.T) {
+	defer func(n int) { MaxStreamBufferBytes = n }(MaxStreamBufferBytes)
+	MaxStreamBufferBytes = 256 << 10
+	files := &Files{data: make([]byte, 4<<20)}
+	for i := range files.data {
+		files.data[i] = byte(i * 7)
+	}
+	files.counter = &countingReader{r: bytes.NewReader(files.data)}
+	client, err := Dial("tcp", startTestServer(t, NewServer(), files))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	r, err := client.CallStreamReply("Files.Counted", 0)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if read := atomic.LoadInt64(&files.counter.read); read > int64(MaxStreamBufferBytes) {
+		t.Fatalf("expect server to pause after one window, read %d bytes", read)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(data, files.data) {
+		t.Fatal("stream data mismatch:", err, len(data))
+	}
+	_ = r.Close()
+
+	_ = client.Close()
+	if _, err := client.CallStreamReply("Files.Open", 0); err != ErrShutdown {
+		t.Fatal("expect ErrShutdown from a closed client, got:", err)
+	}
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	var slow Slow
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &slow, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var reply int
+	if err := client.CallContext(ctx, "Slow.Wait", 200, &reply); !errors.Is(err, ErrCallTimeout) {
+		t.Fatalf("expect ErrCallTimeout, got %v", err)
+	}
+	client.lock.Lock()
+	pending := len(client.pending)
+	client.lock.Unlock()
+	if pending != 0 {
+		t.Fatalf("expect timed out call removed, %d pending", pending)
+	}
+	//迟到的响应被丢弃,不影响之后的调用
+	time.Sleep(250 * time.Millisecond)
+	if reply != 0 {
+		t.Fatalf("expect late reply discarded, got %d", reply)
+	}
+	if err := client.CallContext(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := client.CallContext(ctx, "Slow.Wait", 200, &reply); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+}
+
+func TestCallContextBeforeSend(t *testing.T) {
+	var counter Counter
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &counter))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	//ctx已经结束时不发送请求
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	var reply int
+	if err := client.CallContext(ctx, "Counter.Count", 1, &reply); !errors.Is(err, ErrCallTimeout) {
+		t.Fatal("expect ErrCallTimeout, got", err)
+	}
+	if result, err := client.CallDetailed(ctx, "Counter.Count", 1, &reply); !errors.Is(err, ErrCallTimeout) || result.Seq != 0 {
+		t.Fatal("expect ErrCallTimeout without seq, got", err, result.Seq)
+	}
+	if err := client.Call("Counter.Count", 2, &reply); err != nil || reply != 2 {
+		t.Fatal("call error:", err, reply)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 1 {
+		t.Fatalf("expect only the last call sent, got %d", hits)
+	}
+
+	//对端不再读取,发送阻塞期间ctx超时也立即返回
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	go func() {
+		var opt Option
+		_ = json.NewDecoder(serverConn).Decode(&opt)
+	}()
+	blocked, err := NewClient(clientConn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+	if err != nil {
+		t.Fatal("client error:", err)
+	}
+	defer func() { _ = blocked.Close() }()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() {
+		returned <- blocked.CallContext(ctx, "Counter.Count", 1, &reply)
+	}()
+	select {
+	case err := <-returned:
+		if !errors.Is(err, ErrCallTimeout) {
+			t.Fatal("expect ErrCallTimeout, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CallContext blocked in send after ctx deadline")
+	}
+}
+
+func TestCallCached(t *testing.T) {
+	var counter Counter
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &counter))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 2; i++ {
+		var reply int
+		if err := client.CallCached("Counter.Count", 7, &reply, 200*time.Millisecond); err != nil || reply != 7 {
+			t.Fatal("call error:", err, reply)
+		}
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 1 {
+		t.Fatalf("expect 1 rpc within ttl, got %d", hits)
+	}
+	//参数不同时不命中
+	var reply int
+	if err := client.CallCached("Counter.Count", 8, &reply, 200*time.Millisecond); err != nil || reply != 8 {
+		t.Fatal("call error:", err, reply)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := client.CallCached("Counter.Count", 7, &reply, 200*time.Millisecond); err != nil || reply != 7 {
+		t.Fatal("call error:", err, reply)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 3 {
+		t.Fatalf("expect 3 rpcs after ttl expired, got %d", hits)
+	}
+	//reply类型不同时分别缓存
+	var wide int64
+	if err := client.CallCached("Counter.Count", 7, &wide, 200*time.Millisecond); err != nil || wide != 7 {
+		t.Fatal("call error:", err, wide)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 4 {
+		t.Fatalf("expect a separate entry per reply type, got %d rpcs", hits)
+	}
+	if err := client.CallCached("Counter.Count", 7, nil, time.Second); err != ErrNilReply {
+		t.Fatal("expect ErrNilReply, got", err)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(2)
+	key := func(name string) cacheKey {
+		return cacheKey{serviceMethod: name}
+	}
+	cache.put(key("a"), []byte("a"), time.Minute)
+	cache.put(key("b"), []byte("b"), time.Minute)
+	cache.get(key("a"))
+	cache.put(key("c"), []byte("c"), time.Minute)
+	if _, ok := cache.get(key("b")); ok {
+		t.Fatal("expect least recently used entry evicted")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := cache.get(key(name)); !ok {
+			t.Fatalf("expect %s cached", name)
+		}
+	}
+}
+
+//返回包装错误的服务
+type Storage struct{}
+
+func (s *Storage) Open(args string, reply *int) error {
+	return fmt.Errorf("open %s: %w", args, os.ErrNotExist)
+}
+
+func TestErrorChain(t *testing.T) {
+	server := NewServer()
+	server.EncodeErrorChains = true
+	var storage Storage
+	client, err := Dial("tcp", startTestServer(t, server, &storage))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Storage.Open", "a.txt", &reply)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expect os.ErrNotExist in chain, got %v", err)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		t.Fatal("expect os.ErrPermission not in chain")
+	}
+	if err.Error() != "open a.txt: "+os.ErrNotExist.Error() {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+
+	//未开启时只有错误信息
+	plain, err := Dial("tcp", startTestServer(t, NewServer(), &storage))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = plain.Close() }()
+	if err := plain.Call("Storage.Open", "a.txt", &reply); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expect flattened error, got %v", err)
+	}
+
+	//错误链超过MaxReplyBytes时改为普通的错误响应,调用仍然失败
+	limited := NewServer()
+	limited.EncodeErrorChains = true
+	limited.MaxReplyBytes = 64
+	small, err := Dial("tcp", startTestServer(t, limited, &storage))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = small.Close() }()
+	if err := small.Call("Storage.Open", strings.Repeat("x", 1000), &reply); err == nil || !strings.Contains(err.Error(), codec.ErrBodyTooLarge.Error()) {
+		t.Fatalf("expect oversized error chain to fail the call, got %v", err)
+	}
+}
+
+//返回gob无法直接编码的interface切片
+type Document struct{}
+
+func (d *Document) Get(args int, reply *map[string]interface{}) error {
+	(*reply)["items"] = []interface{}{1, "two", true}
+	return nil
+}
+
+//握手时协商gob消息头和json消息体
+func TestNegotiatedBodyCodec(t *testing.T) {
+	var doc Document
+	addr := startTestServer(t, NewServer(), &doc)
+	client, err := Dial("tcp", addr, &Option{BodyCodec: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply map[string]interface{}
+	if err := client.Call("Document.Get", 1, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if items, ok := reply["items"].([]interface{}); !ok || len(items) != 3 || items[1] != "two" {
+		t.Fatalf("unexpected reply %#v", reply)
+	}
+	if _, err := Dial("tcp", addr, &Option{BodyCodec: "application/unknown"}); err == nil {
+		t.Fatal("expect error for unsupported body codec")
+	}
+}
+
+func TestPendingCount(t *testing.T) {
+	var slow Slow
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &slow))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	calls := make([]*Call, 3)
+	for i := range calls {
+		calls[i] = client.Go("Slow.Wait", 100, new(int), nil)
+	}
+	if n := client.PendingCount(); n != 3 {
+		t.Fatalf("expect 3 pending, got %d", n)
+	}
+	for _, call := range calls {
+		if c := <-call.Done; c.Error != nil {
+			t.Fatal("call error:", c.Error)
+		}
+	}
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("expect 0 pending, got %d", n)
+	}
+}
+
+//序列号回绕后不会复用0和仍在等待的序列号
+func TestSeqWraparound(t *testing.T) {
+	client := &Client{pending: map[uint64]*Call{1: {}}, seq: math.MaxUint64}
+	for _, expect := range []uint64{math.MaxUint64, 2} {
+		seq, err := client.registerCall(&Call{})
+		if err != nil || seq != expect {
+			t.Fatalf("expect seq %d, got %d (err=%v)", expect, seq, err)
+		}
+	}
+}
+
+//写入连接时只写到缓冲区,需要Flush才发出的Codec
+type bufferedCodec struct {
+	codec.Codec
+	w *bufio.Writer
+}
+
+func (c *bufferedCodec) Flush() error {
+	return c.w.Flush()
+}
+
+type bufferedConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func TestClientFlush(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	w := bufio.NewWriter(c1)
+	counting := newCountingConn(&bufferedConn{Conn: c1, w: w})
+	client := newClientCodec(&bufferedCodec{Codec: codec.NewGobCodecFunc(counting), w: w}, DefaultOption, counting)
+	headers := make(chan string, 1)
+	go func() {
+		var h codec.Header
+		if err := gob.NewDecoder(c2).Decode(&h); err == nil {
+			headers <- h.ServiceMethod
+		}
+	}()
+	var reply int
+	client.Go("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, nil)
+	select {
+	case <-headers:
+		t.Fatal("request reached peer before Flush")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal("flush error:", err)
+	}
+	select {
+	case name := <-headers:
+		if name != "Foo.Sum" {
+			t.Fatal("unexpected service method:", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request did not reach peer after Flush")
+	}
+	_ = client.Close()
+	if err := client.Flush(); err != ErrShutdown {
+		t.Fatal("expect ErrShutdown after close, got", err)
+	}
+}
+
+//内置的JsonCodec实现了Flusher,但Write已经把请求写到连接,不需要Flush
+func TestClientFlushJsonCodec(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	counting := newCountingConn(c1)
+	client := newClientCodec(codec.NewJsonCodecFunc(counting), &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType}, counting)
+	headers := make(chan string, 1)
+	go func() {
+		var h codec.Header
+		if err := json.NewDecoder(c2).Decode(&h); err == nil {
+			headers <- h.ServiceMethod
+		}
+	}()
+	var reply int
+	client.Go("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, nil)
+	select {
+	case name := <-headers:
+		if name != "Foo.Sum" {
+			t.Fatal("unexpected service method:", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request did not reach peer without Flush")
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal("flush error:", err)
+	}
+	_ = client.Close()
+	if err := client.Flush(); err != ErrShutdown {
+		t.Fatal("expect ErrShutdown after close, got", err)
+	}
+}
+
+//每次写之前等待delay的连接
+type delayConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *delayConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(p)
+}
+
+func TestKeepaliveRTT(t *testing.T) {
+	c1, c2 := net.Pipe()
+	const delay = 50 * time.Millisecond
+	go NewServer().ServeConn(&delayConn{Conn: c2, delay: delay})
+	client, err := NewClient(c1, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, KeepaliveInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("client error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	deadline := time.Now().Add(2 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no rtt measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rtt := client.RTT(); rtt < delay || rtt > time.Second {
+		t.Fatal("rtt does not reflect delay:", rtt)
+	}
+	if client.PendingCount() != 0 {
+		t.Fatal("pings should not register calls")
+	}
+}
+
+type Inventory struct{}
+
+type Item struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func (i *Inventory) Get(args string, reply *Item) error {
+	*reply = Item{Name: args, Count: 3, Tags: []string{"a", "b"}}
+	return nil
+}
+
+func (i *Inventory) Counts(args []string, reply *map[string]int) error {
+	for n, name := range args {
+		(*reply)[name] = n
+	}
+	return nil
+}
+
+func TestCborCodec(t *testing.T) {
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &Inventory{}), &Option{CodecType: codec.CborType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var item Item
+	if err := client.Call("Inventory.Get", "apple", &item); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if item.Name != "apple" || item.Count != 3 || len(item.Tags) != 2 {
+		t.Fatalf("unexpected reply: %+v", item)
+	}
+	var counts map[string]int
+	if err := client.Call("Inventory.Counts", []string{"x", "y"}, &counts); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if len(counts) != 2 || counts["x"] != 0 || counts["y"] != 1 {
+		t.Fatal("unexpected reply:", counts)
+	}
+	//找不到方法时连接仍然可用
+	if err := client.Call("Inventory.Missing", "", &item); err == nil {
+		t.Fatal("expect error for missing method")
+	}
+	if err := client.Call("Inventory.Get", "pear", &item); err != nil || item.Name != "pear" {
+		t.Fatal("call error:", err, item)
+	}
+}
+
+type Shard struct {
+	name string
+	keys sync.Map
+}
+
+func (s *Shard) Put(key string, reply *string) error {
+	s.keys.Store(key, true)
+	*reply = s.name
+	return nil
+}
+
+func TestShardedCall(t *testing.T) {
+	shards := []*Shard{{name: "shard-0"}, {name: "shard-1"}}
+	addrs := make([]string, len(shards))
+	for i, shard := range shards {
+		addrs[i] = startTestServer(t, NewServer(), shard)
+	}
+	resolve := func(key string) (string, error) {
+		if key == "" {
+			return "", errors.New("empty key")
+		}
+		return addrs[int(key[0])%len(addrs)], nil
+	}
+	client := NewShardedClient("tcp", resolve)
+	defer func() { _ = client.Close() }()
+	for _, key := range []string{"a", "b", "c", "d", "a"} {
+		var reply string
+		if err := client.ShardedCall(key, "Shard.Put", key, &reply); err != nil {
+			t.Fatal("call error:", err)
+		}
+		if want := shards[int(key[0])%len(shards)].name; reply != want {
+			t.Fatalf("key %s routed to %s, want %s", key, reply, want)
+		}
+	}
+	client.lock.Lock()
+	if len(client.clients) != 2 {
+		t.Fatal("expect one client per shard, got", len(client.clients))
+	}
+	client.lock.Unlock()
+	if _, ok := shards[1].keys.Load("a"); !ok {
+		t.Fatal("key a should be stored on shard-1")
+	}
+	var reply string
+	if err := client.ShardedCall("", "Shard.Put", "", &reply); err == nil {
+		t.Fatal("expect resolve error")
+	}
+}
+
+//第一次写出包含marker的数据时翻转marker中的一位,模拟传输损坏
+type flipConn struct {
+	net.Conn
+	marker  []byte
+	flipped int32
+}
+
+func (c *flipConn) Write(p []byte) (int, error) {
+	if i := bytes.Index(p, c.marker); i >= 0 && atomic.CompareAndSwapInt32(&c.flipped, 0, 1) {
+		corrupted := append([]byte(nil), p...)
+		corrupted[i] ^= 0x01
+		return c.Conn.Write(corrupted)
+	}
+	return c.Conn.Write(p)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	for _, checksum := range []bool{true, false} {
+		serverConn, clientConn := net.Pipe()
+		server := NewServer()
+		if err := server.Register(&Inventory{}); err != nil {
+			t.Fatal("register error:", err)
+		}
+		go server.ServeConn(&flipConn{Conn: serverConn, marker: []byte("corrupt-me")})
+		client, err := NewClient(clientConn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Checksum: checksum})
+		if err != nil {
+			t.Fatal("client error:", err)
+		}
+		var item Item
+		err = client.Call("Inventory.Get", "corrupt-me", &item)
+		if checksum && !errors.Is(err, codec.ErrChecksumMismatch) {
+			t.Fatal("expect checksum mismatch, got", err, item.Name)
+		}
+		if !checksum && (err != nil || item.Name == "corrupt-me") {
+			t.Fatal("expect silently corrupted reply without checksum, got", err, item.Name)
+		}
+		//连接不受影响
+		if err := client.Call("Inventory.Get", "apple", &item); err != nil || item.Name != "apple" {
+			t.Fatal("call error:", err, item.Name)
+		}
+		_ = client.Close()
+	}
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	if _, err := NewClient(clientConn, &Option{MagicNumber: MagicNumber, CodecType: codec.CborType, Checksum: true}); err == nil {
+		t.Fatal("expect error for codec without checksum support")
+	}
+}
+
+func TestNewTestServer(t *testing.T) {
+	var foo Foo
+	ts, err := NewTestServer(&foo)
+	if err != nil {
+		t.Fatal("new test server error:", err)
+	}
+	defer func() { _ = ts.Close() }()
+	client, err := ts.Dial()
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+}
+
+//Close关闭已接收的连接,返回时连接都已处理完
+func TestTestServerCloseConns(t *testing.T) {
+	var foo Foo
+	ts, err := NewTestServer(&foo)
+	if err != nil {
+		t.Fatal("new test server error:", err)
+	}
+	client, err := ts.Dial()
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	//还在握手中的连接也被关闭
+	idle, err := net.Dial("tcp", ts.Addr())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = idle.Close() }()
+	if err := ts.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+	if n := ts.Server.Stats().Connections; n != 0 {
+		t.Fatal("expect no connections after close, got:", n)
+	}
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err == nil {
+		t.Fatal("expect calls after close to fail")
+	}
+	_ = idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatal("expect handshaking connection closed, got:", err)
+	}
+}
+
+func TestCallT(t *testing.T) {
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	sum, err := CallT[int](client, context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2})
+	if err != nil || sum != 3 {
+		t.Fatal("call error:", err, sum)
+	}
+	//Reply为指针类型时同样可以直接使用
+	ptr, err := CallT[*int](client, context.Background(), "Foo.Sum", Args{Num1: 3, Num2: 4})
+	if err != nil || ptr == nil || *ptr != 7 {
+		t.Fatal("call error:", err, ptr)
+	}
+	if _, err := CallT[int](client, context.Background(), "Foo.Missing", Args{}); err == nil {
+		t.Fatal("expect error for unknown method")
+	}
+}
+
+func TestClientOnCallEvent(t *testing.T) {
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var lock sync.Mutex
+	var phases []CallPhase
+	client.OnCallEvent = func(evt CallEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		phases = append(phases, evt.Phase)
+	}
+	take := func() []CallPhase {
+		lock.Lock()
+		defer lock.Unlock()
+		got := phases
+		phases = nil
+		return got
+	}
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	expect := []CallPhase{CallRegistered, CallSent, CallFirstByte, CallCompleted}
+	if got := take(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect events %v, got %v", expect, got)
+	}
+	if err := client.Call("Foo.Missing", Args{}, &reply); err == nil {
+		t.Fatal("expect error for unknown method")
+	}
+	expect = []CallPhase{CallRegistered, CallSent, CallFirstByte, CallErrored}
+	if got := take(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect events %v, got %v", expect, got)
+	}
+}
+
+func TestWireTap(t *testing.T) {
+	var foo Foo
+	serverTap := new(syncBuffer)
+	server := NewServer()
+	server.WireTap = serverTap
+	addr := startTestServer(t, server, &foo)
+	clientTap := new(syncBuffer)
+	client, err := Dial("tcp", addr, &Option{WireTap: clientTap})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	//两端都从握手的Json开始,之后是请求和响应的原始字节
+	for name, tap := range map[string]*syncBuffer{"client": clientTap, "server": serverTap} {
+		output := tap.String()
+		if !strings.HasPrefix(output, `{"MagicNumber":`) {
+			t.Fatalf("%s tap does not start with the handshake: %q", name, output)
+		}
+		if !strings.Contains(output, "Foo.Sum") {
+			t.Fatalf("%s tap misses the request: %q", name, output)
+		}
+	}
+}
+
+func TestClientInFlight(t *testing.T) {
+	var identity ConnIdentity
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &identity))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var calls []*Call
+	for i := 0; i < 3; i++ {
+		calls = append(calls, client.Go("ConnIdentity.ID", 300, new(uint64), nil))
+		time.Sleep(20 * time.Millisecond)
+	}
+	inFlight := client.InFlight()
+	if len(inFlight) != 3 {
+		t.Fatalf("expect 3 in-flight calls, got %+v", inFlight)
+	}
+	//先发起的调用序列号更小,等待的时间更长
+	for i, call := range inFlight {
+		if call.ServiceMethod != "ConnIdentity.ID" || call.Seq != calls[i].Seq {
+			t.Fatalf("unexpected in-flight call %+v", call)
+		}
+		if i > 0 && call.Age >= inFlight[i-1].Age {
+			t.Fatalf("expect older calls first: %+v", inFlight)
+		}
+	}
+	for _, call := range calls {
+		<-call.Done
+	}
+	if inFlight := client.InFlight(); len(inFlight) != 0 {
+		t.Fatalf("expect no in-flight calls, got %+v", inFlight)
+	}
+}
+
+func TestCallWithBodyCodec(t *testing.T) {
+	var foo Foo
+	tap := new(syncBuffer)
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo), &Option{CodecType: codec.GobType, WireTap: tap})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.CallWithBodyCodec(context.Background(), codec.JsonType, "Foo.Sum", Args{Num1: 3, Num2: 4}, &reply); err != nil || reply != 7 {
+		t.Fatal("call error:", err, reply)
+	}
+	if !strings.Contains(tap.String(), `{"Num1":3,"Num2":4}`) {
+		t.Fatalf("expect a Json body on the wire: %q", tap.String())
+	}
+	//同一连接上的其他调用仍使用gob
+	if err := client.Call("Foo.Sum", Args{Num1: 5, Num2: 6}, &reply); err != nil || reply != 11 {
+		t.Fatal("call error:", err, reply)
+	}
+	if err := client.CallWithBodyCodec(context.Background(), "application/unknown", "Foo.Sum", Args{}, &reply); err == nil {
+		t.Fatal("expect error for unsupported body codec")
+	}
+}
+
+//部署过程中逐行输出日志
+type Deploy struct{}
+
+type DeployArgs struct {
+	Lines int
+	Fail  bool
+}
+
+func (d *Deploy) Run(ctx context.Context, args DeployArgs, reply *bool) error {
+	for i := 0; i < args.Lines; i++ {
+		if err := SendEvent(ctx, fmt.Sprintf("step %d", i)); err != nil {
+			return err
+		}
+	}
+	if args.Fail {
+		return errors.New("deploy failed")
+	}
+	*reply = true
+	return nil
+}
+
+//发送一个事件后一直运行到ctx结束
+func (d *Deploy) Hang(ctx context.Context, args DeployArgs, reply *bool) error {
+	if err := SendEvent(ctx, "started"); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+func TestCallWithEvents(t *testing.T) {
+	var deploy Deploy
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &deploy))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var lines []string
+	if err := client.CallWithEvents(context.Background(), "Deploy.Run", DeployArgs{Lines: 10}, func(line string) {
+		lines = append(lines, line)
+	}); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if len(lines) != 10 || lines[0] != "step 0" || lines[9] != "step 9" {
+		t.Fatalf("unexpected events %q", lines)
+	}
+	lines = nil
+	err = client.CallWithEvents(context.Background(), "Deploy.Run", DeployArgs{Lines: 2, Fail: true}, func(line string) {
+		lines = append(lines, line)
+	})
+	if err == nil || err.Error() != "deploy failed" || len(lines) != 2 {
+		t.Fatal("expect final error after events:", err, lines)
+	}
+	//普通调用时事件被丢弃
+	var reply bool
+	if err := client.Call("Deploy.Run", DeployArgs{Lines: 3}, &reply); err != nil || !reply {
+		t.Fatal("call error:", err, reply)
+	}
+	if err := SendEvent(context.Background(), "x"); err != ErrNoEventStream {
+		t.Fatal("expect ErrNoEventStream, got:", err)
+	}
+	//方法一直不返回时按ctx放弃等待
+	started := make(chan string, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.CallWithEvents(ctx, "Deploy.Hang", DeployArgs{}, func(line string) {
+		started <- line
+	})
+	if err != ErrCallTimeout {
+		t.Fatal("expect ErrCallTimeout, got:", err)
+	}
+	if line := <-started; line != "started" {
+		t.Fatal("unexpected event:", line)
+	}
+}
+
+func TestReserveSeqRange(t *testing.T) {
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	start := client.ReserveSeqRange(100)
+	inRange := func(seq uint64) bool { return seq >= start && seq < start+100 }
+	var reply int
+	for i := 0; i < 5; i++ {
+		call := <-client.Go("Foo.Sum", Args{Num1: i, Num2: 1}, &reply, nil).Done
+		if call.Error != nil || inRange(call.Seq) {
+			t.Fatal("call reused a reserved seq:", call.Error, call.Seq)
+		}
+	}
+	//序列号回绕到保留区间时同样跳过
+	client.lock.Lock()
+	client.seq = start + 10
+	client.lock.Unlock()
+	call := <-client.Go("Foo.Sum", Args{Num1: 1, Num2: 1}, &reply, nil).Done
+	if call.Error != nil || call.Seq != start+100 {
+		t.Fatal("expect seq after the reserved range:", call.Error, call.Seq)
+	}
+	//归还后可以重新分配
+	if !client.ReleaseSeqRange(start) || client.ReleaseSeqRange(start) {
+		t.Fatal("expect the range to be released exactly once")
+	}
+	client.lock.Lock()
+	client.seq = start
+	client.lock.Unlock()
+	call = <-client.Go("Foo.Sum", Args{Num1: 1, Num2: 1}, &reply, nil).Done
+	if call.Error != nil || call.Seq != start {
+		t.Fatal("expect released seq to be reused:", call.Error, call.Seq)
+	}
+}
+
+//返回map,用于检查合并调用的各调用方是否共享了reply
+type Tagger struct{}
+
+func (t *Tagger) Tags(args int, reply *map[string]int) error {
+	time.Sleep(100 * time.Millisecond)
+	*reply = map[string]int{"n": args}
+	return nil
+}
+
+func TestCallCoalescedIndependentReplies(t *testing.T) {
+	var tagger Tagger
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &tagger))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply map[string]int
+			if err := client.CallCoalesced("tags", "Tagger.Tags", 7, &reply); err != nil || reply["n"] != 7 {
+				t.Error("coalesced call error:", err, reply)
+				return
+			}
+			//每个调用方修改自己的reply,不影响其他调用方
+			for j := 0; j < 100; j++ {
+				reply["n"] = j
+				reply[strconv.Itoa(j)] = j
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,76 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//连接正在通过CloseConn关闭时,新到达的请求返回的错误
+var ErrConnClosing = errors.New("rpc server: connection is closing")
+
+//关闭id为connID的连接:不再处理新的请求,等已在处理的请求都响应后再关闭,不影响其他连接
+//connID可以通过InFlight或在方法中通过ConnIDFromContext获得,连接关闭的原因为ServerClosed
+//ctx结束时不再等待,直接关闭连接并返回ctx.Err();在该连接的方法中调用时不等待,连接在该方法响应后关闭
+func (server *Server) CloseConn(ctx context.Context, connID uint64) error {
+	v, ok := server.conns.Load(connID)
+	if !ok {
+		return fmt.Errorf("rpc server: connection %d not found", connID)
+	}
+	sc := v.(*serverConn)
+	sc.lock.Lock()
+	if !sc.draining {
+		sc.draining = true
+		sc.drained = make(chan struct{})
+		if sc.active == 0 {
+			sc.closeDrained()
+		}
+	}
+	drained := sc.drained
+	sc.lock.Unlock()
+	if connInfoFromContext(ctx).id == connID {
+		//调用方自己就是该连接上正在处理的请求,由endRequest在所有请求结束后关闭
+		return nil
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		_ = sc.c.Close()
+		return ctx.Err()
+	}
+}
+
+//开始处理一个请求,连接正在关闭时返回false
+func (sc *serverConn) beginRequest() bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.active++
+	return true
+}
+
+//请求处理完成,连接正在关闭且没有其他请求时关闭连接
+func (sc *serverConn) endRequest() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.active--
+	if sc.active == 0 && sc.draining {
+		sc.closeDrained()
+	}
+}
+
+//所有请求都已响应,关闭连接并通知CloseConn,调用时需持有lock
+func (sc *serverConn) closeDrained() {
+	close(sc.drained)
+	_ = sc.c.Close()
+}
+
+//连接是否正在通过CloseConn关闭
+func (sc *serverConn) isDraining() bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.draining
+}
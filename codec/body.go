@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+//按单个请求指定的协议把消息体编码成独立的[]byte,再由连接的协议写出
+//gob每次使用新的编码器,保证数据自带类型信息,可以单独解码
+func marshalBody(t Type, body interface{}) ([]byte, error) {
+	if m := lookupMarshaler(body); m != nil {
+		return m.MarshalRPC(body)
+	}
+	switch t {
+	case GobType:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case JsonType:
+		return json.Marshal(body)
+	}
+	return nil, fmt.Errorf("rpc codec: unsupported body codec %q", t)
+}
+
+//marshalBody的逆过程
+func unmarshalBody(t Type, data []byte, body interface{}) error {
+	if m := lookupMarshaler(body); m != nil {
+		return m.UnmarshalRPC(data, body)
+	}
+	switch t {
+	case GobType:
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+	case JsonType:
+		return json.Unmarshal(data, body)
+	}
+	return fmt.Errorf("rpc codec: unsupported body codec %q", t)
+}
+
+//编码消息体,bodyType为空时直接使用连接的协议
+func writeBody(bodyType Type, body interface{}, encode func(interface{}) error) error {
+	if bodyType == "" {
+		return encodeBody(body, encode)
+	}
+	data, err := marshalBody(bodyType, body)
+	if err != nil {
+		return err
+	}
+	return encode(data)
+}
+
+//解码消息体,bodyType为空时直接使用连接的协议,body为nil时读出并丢弃
+func readBody(bodyType Type, body interface{}, decode func(interface{}) error) error {
+	if bodyType == "" {
+		return decodeBody(body, decode)
+	}
+	var data []byte
+	if err := decode(&data); err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	return unmarshalBody(bodyType, data, body)
+}
+
+//读取未解码的消息体,按请求指定协议的消息体本身就是独立的[]byte,否则由decodeRaw按连接的协议读取
+func readRawBody(bodyType Type, decode func(interface{}) error, decodeRaw func() ([]byte, error)) ([]byte, error) {
+	if bodyType == "" {
+		return decodeRaw()
+	}
+	var data []byte
+	if err := decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//按协议t把body编码成可以单独解码的[]byte,t只支持SupportsBodyCodec返回true的协议
+func Marshal(t Type, body interface{}) ([]byte, error) {
+	return marshalBody(t, body)
+}
+
+//Marshal的逆过程
+func Unmarshal(t Type, data []byte, body interface{}) error {
+	return unmarshalBody(t, data, body)
+}
@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+)
+
+type bodyArgs struct {
+	Num1, Num2 int
+}
+
+func TestPerRequestBodyCodec(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn)
+	if err := c.Write(&Header{Seq: 1}, bodyArgs{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if err := c.Write(&Header{Seq: 2, BodyCodec: JsonType}, bodyArgs{Num1: 3, Num2: 4}); err != nil {
+		t.Fatal("write error:", err)
+	}
+
+	//用普通的gob解码器确认第二条消息体是json编码的[]byte
+	raw := *conn
+	dec := gob.NewDecoder(&raw.Buffer)
+	var h Header
+	var args bodyArgs
+	var data []byte
+	if err := dec.Decode(&h); err != nil || dec.Decode(&args) != nil {
+		t.Fatal("decode first message error:", err)
+	}
+	if err := dec.Decode(&h); err != nil || dec.Decode(&data) != nil {
+		t.Fatal("decode second message error:", err)
+	}
+	var fromJson bodyArgs
+	if err := json.Unmarshal(data, &fromJson); err != nil || fromJson.Num1 != 3 {
+		t.Fatalf("expect json body, got %q (err=%v)", data, err)
+	}
+
+	for _, expect := range []bodyArgs{{1, 2}, {3, 4}} {
+		var h Header
+		var got bodyArgs
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatal("read header error:", err)
+		}
+		if err := c.ReadBody(&got); err != nil || got != expect {
+			t.Fatalf("expect %v, got %v (err=%v)", expect, got, err)
+		}
+	}
+}
+
+func TestSetBodyCodec(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn)
+	c.(BodyCodecSetter).SetBodyCodec(JsonType)
+	if err := c.Write(&Header{Seq: 1}, bodyArgs{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal("write error:", err)
+	}
+	//消息头是gob,消息体是json
+	raw := *conn
+	dec := gob.NewDecoder(&raw.Buffer)
+	var h Header
+	var data []byte
+	if err := dec.Decode(&h); err != nil || dec.Decode(&data) != nil || h.Seq != 1 {
+		t.Fatal("decode error:", err)
+	}
+	var fromJson bodyArgs
+	if err := json.Unmarshal(data, &fromJson); err != nil || fromJson != (bodyArgs{1, 2}) {
+		t.Fatalf("expect json body, got %q (err=%v)", data, err)
+	}
+	var got bodyArgs
+	if err := c.ReadHeader(&h); err != nil || c.ReadBody(&got) != nil || got != (bodyArgs{1, 2}) {
+		t.Fatalf("expect %v, got %v (err=%v)", bodyArgs{1, 2}, got, err)
+	}
+}
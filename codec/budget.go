@@ -0,0 +1,79 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+//解码一个消息体的耗时超过预算时ReadBody返回的错误
+//在消息体读完之后超出时连接仍可使用,在读取过程中超出时解码被中断,之后的读取都返回该错误
+var ErrDecodeBudget = errors.New("rpc codec: decoding body exceeded the time budget")
+
+//可以限制解码消息体耗时的Codec,耗时不包括阻塞在连接上等待数据的时间
+type DecodeBudgeter interface {
+	//设置解码一个消息体的耗时上限,d<=0表示不限制
+	SetDecodeBudget(d time.Duration)
+}
+
+//包裹Codec读取的连接,统计阻塞在连接上的时间,并在解码消息体期间检查预算
+type decodeClock struct {
+	r io.Reader
+	//累计阻塞在r上的时间
+	blocked time.Duration
+	//解码耗时上限,0表示不限制
+	budget time.Duration
+	//正在解码的消息体开始的时间,以及当时的blocked,不在解码时start为零值
+	start        time.Time
+	startBlocked time.Duration
+	//最近一次解码消息体的耗时
+	last time.Duration
+	//解码被中断后连接上的数据已不完整,之后的读取都返回该错误
+	err error
+}
+
+func newDecodeClock(r io.Reader) *decodeClock {
+	return &decodeClock{r: r}
+}
+
+func (c *decodeClock) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.exceeded() {
+		c.err = ErrDecodeBudget
+		return 0, c.err
+	}
+	start := time.Now()
+	n, err := c.r.Read(p)
+	c.blocked += time.Since(start)
+	return n, err
+}
+
+//开始解码一个消息体
+func (c *decodeClock) begin() {
+	c.start, c.startBlocked = time.Now(), c.blocked
+}
+
+//消息体解码结束,记录解码耗时,解码本身没有出错但超过预算时返回ErrDecodeBudget
+func (c *decodeClock) end(err error) error {
+	c.last = c.elapsed()
+	if err == nil && c.exceeded() {
+		err = ErrDecodeBudget
+	}
+	c.start = time.Time{}
+	return err
+}
+
+//本次解码扣除阻塞时间后的耗时
+func (c *decodeClock) elapsed() time.Duration {
+	return time.Since(c.start) - (c.blocked - c.startBlocked)
+}
+
+//本次解码扣除阻塞时间后的耗时是否超过预算
+func (c *decodeClock) exceeded() bool {
+	if c.budget <= 0 || c.start.IsZero() {
+		return false
+	}
+	return c.elapsed() > c.budget
+}
@@ -0,0 +1,26 @@
+package codec
+
+//没有设置时codec读写缓冲区的大小,与bufio的默认值相同
+const DefaultBufferSize = 4096
+
+//SetBufferSize接受的缓冲区大小上限,避免对端声明过大的值占用内存
+const MaxBufferSize = 1 << 20
+
+//可以按对端消息的大小分配读写缓冲区的Codec,需要在读写第一条消息之前调用
+type BufferSizer interface {
+	//n不大于DefaultBufferSize时不修改,大于MaxBufferSize时按MaxBufferSize分配
+	SetBufferSize(n int)
+	//返回当前缓冲区的大小
+	BufferSize() int
+}
+
+//把声明的缓冲区大小限制在[DefaultBufferSize, MaxBufferSize]内
+func clampBufferSize(n int) int {
+	if n < DefaultBufferSize {
+		return DefaultBufferSize
+	}
+	if n > MaxBufferSize {
+		return MaxBufferSize
+	}
+	return n
+}
@@ -0,0 +1,188 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"io"
+	"log"
+	"time"
+)
+
+//Cbor协议的编码解码结构,CBOR自描述且紧凑,适合与其他语言的程序通信
+type CborCodec struct {
+	//链接实例
+	conn io.ReadWriteCloser
+	//编码缓冲区,消息头和消息体都编码成功后再一次写出到连接
+	buf *bytes.Buffer
+	//编码器通过它写入buf,消息体超过maxWriteBody后不再写入
+	out *bodyLimitWriter
+	//读取和写出的消息体的大小上限,0表示不限制
+	maxReadBody  int
+	maxWriteBody int
+	//统计阻塞在连接上的时间,限制解码消息体的耗时
+	clock *decodeClock
+	//解码器通过它从clock读取,限制读取一个消息体时读出的字节数
+	in *bodyLimitReader
+	//统计写出时阻塞在连接上的时间,用于计算编码耗时
+	encClock *encodeClock
+	//解码器
+	dec *cbor.Decoder
+	//编码器
+	enc *cbor.Encoder
+	//最近读到的消息头指定的消息体协议
+	bodyType Type
+	//消息头没有指定时消息体默认使用的协议,为空时与连接的协议相同
+	defaultBody Type
+}
+
+//构造函数
+func NewCborCodecFunc(conn io.ReadWriteCloser) Codec {
+	buf := new(bytes.Buffer)
+	out := &bodyLimitWriter{w: buf}
+	clock := newDecodeClock(conn)
+	in := &bodyLimitReader{r: clock}
+	return &CborCodec{
+		conn:     conn,
+		buf:      buf,
+		out:      out,
+		clock:    clock,
+		in:       in,
+		encClock: newEncodeClock(conn),
+		dec:      cbor.NewDecoder(in),
+		enc:      cbor.NewEncoder(out),
+	}
+}
+
+//实现Codec接口中的ReadHeader方法
+func (c *CborCodec) ReadHeader(h *Header) error {
+	if err := c.dec.Decode(h); err != nil {
+		return err
+	}
+	//ReadBody紧跟在ReadHeader之后调用,记录下消息体的协议
+	c.bodyType = c.bodyCodecOf(h)
+	return nil
+}
+
+func (c *CborCodec) ReadBody(body interface{}) error {
+	c.clock.begin()
+	return c.clock.end(c.readBody(body))
+}
+
+func (c *CborCodec) readBody(body interface{}) error {
+	//需要丢弃的消息体同样按上限读取,不会被整个读入内存
+	return c.in.limitBody(c.maxReadBody, func() error {
+		return c.decodeBody(body)
+	})
+}
+
+func (c *CborCodec) decodeBody(body interface{}) error {
+	//需要丢弃时解码到RawMessage
+	if body == nil {
+		_, err := c.decodeRaw()
+		return err
+	}
+	decode := c.dec.Decode
+	if c.maxReadBody > 0 {
+		decode = limitedDecode(c.maxReadBody, c.decodeRaw, cbor.Unmarshal)
+	}
+	return readBody(c.bodyType, body, decode)
+}
+
+func (c *CborCodec) decodeRaw() ([]byte, error) {
+	var raw cbor.RawMessage
+	err := c.dec.Decode(&raw)
+	return raw, err
+}
+
+//实现RawBodyReader,没有按请求指定消息体协议时返回原始的CBOR
+func (c *CborCodec) ReadRawBody() ([]byte, error) {
+	var raw []byte
+	err := c.in.limitBody(c.maxReadBody, func() (err error) {
+		raw, err = readRawBody(c.bodyType, c.dec.Decode, c.decodeRaw)
+		return err
+	})
+	return raw, err
+}
+
+func (c *CborCodec) Write(h *Header, body interface{}) (err error) {
+	c.encClock.begin()
+	defer c.encClock.end()
+	defer func() {
+		//连接出错时关闭连接,消息体编码失败不影响连接
+		if err != nil && !errors.Is(err, ErrEncodeBody) {
+			_ = c.Close()
+		}
+	}()
+	c.buf.Reset()
+	c.out.reset(0)
+	//对Header进行编码
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: cbor error encoding header:", err)
+		return err
+	}
+	//对Body编码,CBOR没有状态,编码失败或超过上限时整条消息都不发送
+	c.out.reset(c.maxWriteBody)
+	err = writeBody(c.bodyCodecOf(h), body, c.enc.Encode)
+	if err == nil && c.out.exceeded() {
+		err = c.out.err()
+	}
+	if err != nil {
+		log.Println("rpc codec: cbor error encoding body:", err)
+		return fmt.Errorf("%w: %v", ErrEncodeBody, err)
+	}
+	_, err = c.encClock.Write(c.buf.Bytes())
+	return err
+}
+
+//实现BodyLimiter
+func (c *CborCodec) SetMaxReadBodyBytes(n int) {
+	c.maxReadBody = n
+}
+
+//实现BodyLimiter
+func (c *CborCodec) SetMaxWriteBodyBytes(n int) {
+	c.maxWriteBody = n
+}
+
+//实现DecodeBudgeter
+func (c *CborCodec) SetDecodeBudget(d time.Duration) {
+	c.clock.budget = d
+}
+
+//实现Timer
+func (c *CborCodec) LastEncodeTime() time.Duration {
+	return c.encClock.last
+}
+
+//实现Timer
+func (c *CborCodec) LastDecodeTime() time.Duration {
+	return c.clock.last
+}
+
+//实现BodyCodecSetter
+func (c *CborCodec) SetBodyCodec(t Type) {
+	c.defaultBody = t
+}
+
+func (c *CborCodec) bodyCodecOf(h *Header) Type {
+	if h.BodyCodec != "" {
+		return h.BodyCodec
+	}
+	return c.defaultBody
+}
+
+//实现Flusher,Write已经把整条消息一次写到连接,没有缓冲的数据
+func (c *CborCodec) Flush() error {
+	return nil
+}
+
+//实现WriteDeadliner
+func (c *CborCodec) SetWriteDeadline(t time.Time) error {
+	return setWriteDeadline(c.conn, t)
+}
+
+func (c *CborCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+//消息体的校验和与内容不一致时返回的错误,只影响这一个消息,连接仍然可用
+var ErrChecksumMismatch = errors.New("rpc: checksum mismatch")
+
+//可以在消息体后附加CRC32校验和的Codec,用于发现TCP校验之外的传输损坏(如不稳定的隧道)
+type ChecksumSetter interface {
+	SetChecksum(enabled bool)
+}
+
+//协议是否支持校验和
+func SupportsChecksum(t Type) bool {
+	return t == GobType || t == JsonType
+}
+
+//开启校验和时消息体先单独编码成[]byte,再依次写出该[]byte和它的CRC32
+//t为空时使用连接自身的协议connType
+func writeChecksumBody(t, connType Type, body interface{}, encode func(interface{}) error) error {
+	if t == "" {
+		t = connType
+	}
+	data, err := marshalBody(t, body)
+	if err != nil {
+		return err
+	}
+	if err := encode(data); err != nil {
+		return err
+	}
+	return encode(crc32.ChecksumIEEE(data))
+}
+
+//读取writeChecksumBody写出的消息体并校验,返回校验通过的[]byte
+func readChecksumData(decode func(interface{}) error) ([]byte, error) {
+	var data []byte
+	if err := decode(&data); err != nil {
+		return nil, err
+	}
+	var sum uint32
+	if err := decode(&sum); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, ErrChecksumMismatch
+	}
+	return data, nil
+}
+
+//读取并校验消息体,body为nil时读出并丢弃
+func readChecksumBody(t, connType Type, body interface{}, decode func(interface{}) error) error {
+	data, err := readChecksumData(decode)
+	if err != nil || body == nil {
+		return err
+	}
+	if t == "" {
+		t = connType
+	}
+	return unmarshalBody(t, data, body)
+}
@@ -1,6 +1,10 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"io"
+	"time"
+)
 
 //封装请求和回复中除了返回值和参数之外的信息
 type Header struct {
@@ -10,6 +14,16 @@ type Header struct {
 	Seq uint64
 	//错误信息
 	Error string
+	//请求参数的类型名(不含包名),用于按参数类型分发
+	ArgType string
+	//是否为服务端向客户端发起的调用(及其响应),用于在同一连接上区分两个方向
+	Reverse bool
+	//附加的元数据,如请求id
+	Metadata map[string]string
+	//本条消息体的协议,为空时与连接的协议相同
+	BodyCodec Type
+	//请求方希望响应消息体使用的协议,为空时与连接的协议相同
+	ReplyCodec Type
 }
 
 //抽象对消息体进行编解码的接口Codec,为了实现不同的实例
@@ -23,6 +37,62 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+//编码消息体失败时Write返回的错误,此时没有数据写出,连接仍可以继续使用
+var ErrEncodeBody = errors.New("rpc codec: encode body error")
+
+//消息体可以使用与消息头不同协议的Codec,如紧凑的gob消息头加便于调试的json消息体
+type BodyCodecSetter interface {
+	//设置消息头没有指定BodyCodec时消息体使用的协议
+	SetBodyCodec(t Type)
+}
+
+//消息体按连接的协议编码失败时可以改用其他协议重试的Codec,如gob无法编码没有导出字段的类型
+//重试时消息头的BodyCodec设为该协议,对端按消息头解码,不需要额外设置
+type FallbackSetter interface {
+	//设置重试使用的协议,为空时不重试
+	SetFallbackBodyCodec(t Type)
+}
+
+//是否支持作为消息体的协议
+func SupportsBodyCodec(t Type) bool {
+	return t == GobType || t == JsonType
+}
+
+//可以设置写超时的Codec,写阻塞超过deadline时Write返回超时错误
+type WriteDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+//带写缓冲的Codec,Flush把缓冲中的数据写到连接
+type Flusher interface {
+	Flush() error
+}
+
+//可以读取未解码的消息体的Codec,在ReadHeader之后代替ReadBody调用
+type RawBodyReader interface {
+	ReadRawBody() ([]byte, error)
+}
+
+//记录编码缓冲区峰值的Codec,可用于判断缓冲区大小与消息大小是否匹配
+type HighWaterMarker interface {
+	//返回上次调用之后写出前缓冲区的最大字节数,并重新开始记录
+	TakeHighWater() int
+}
+
+//可以设置写超时的连接,net.Conn实现了该接口
+type writeDeadlineConn interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+//设置连接的写超时,连接不支持时返回错误
+func setWriteDeadline(conn io.ReadWriteCloser, t time.Time) error {
+	c, ok := conn.(writeDeadlineConn)
+	if !ok {
+		return errors.New("rpc codec: conn does not support write deadline")
+	}
+	return c.SetWriteDeadline(t)
+}
+
 //抽象Codec的构造函数
 type NewCodecFunc func(conn io.ReadWriteCloser) Codec
 
@@ -33,6 +103,8 @@ const (
 	GobType Type = "application/gob"
 	//Json协议解析
 	JsonType Type = "application/json"
+	//Cbor协议解析
+	CborType Type = "application/cbor"
 )
 
 //一个Type->NewCodecFunc,根据Type类型获取相应构造函数
@@ -42,4 +114,8 @@ func init() {
 	NewCodeFuncMap = make(map[Type]NewCodecFunc)
 	//将Gob的构造函数添加进去
 	NewCodeFuncMap[GobType] = NewGobCodecFunc
+	//将Json的构造函数添加进去
+	NewCodeFuncMap[JsonType] = NewJsonCodecFunc
+	//将Cbor的构造函数添加进去
+	NewCodeFuncMap[CborType] = NewCborCodecFunc
 }
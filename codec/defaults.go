@@ -0,0 +1,25 @@
+package codec
+
+import (
+	"encoding/gob"
+	"sync"
+	"time"
+)
+
+var registerDefaultsOnce sync.Once
+
+//向gob注册常用的标准库类型,使interface类型的字段可以直接存放这些值而不用各自注册
+//gob已经内置注册了基本类型及其slice,这里补充其余常见类型;需要显式调用,避免在init中产生副作用
+func RegisterDefaults() {
+	registerDefaultsOnce.Do(func() {
+		gob.Register(time.Time{})
+		gob.Register(time.Duration(0))
+		gob.Register([]time.Time{})
+		gob.Register([]interface{}{})
+		gob.Register(map[string]interface{}{})
+		gob.Register(map[string]string{})
+		gob.Register(map[string]int{})
+		gob.Register(map[string]int64{})
+		gob.Register(map[string]float64{})
+	})
+}
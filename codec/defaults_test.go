@@ -0,0 +1,31 @@
+package codec
+
+import (
+	"testing"
+	"time"
+)
+
+type Envelope struct {
+	Value interface{}
+}
+
+func TestRegisterDefaults(t *testing.T) {
+	RegisterDefaults()
+	now := time.Now().Round(0)
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn)
+	if err := c.Write(&Header{Seq: 1}, Envelope{Value: now}); err != nil {
+		t.Fatal("write error:", err)
+	}
+	var h Header
+	var reply Envelope
+	if err := c.ReadHeader(&h); err != nil {
+		t.Fatal("read header error:", err)
+	}
+	if err := c.ReadBody(&reply); err != nil {
+		t.Fatal("read body error:", err)
+	}
+	if got, ok := reply.Value.(time.Time); !ok || !got.Equal(now) {
+		t.Fatalf("expect %v, got %#v", now, reply.Value)
+	}
+}
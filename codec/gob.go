@@ -1,68 +1,318 @@
 package codec
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
 )
 
 //Gob协议的编码解码结构
 type GobCodec struct {
 	//链接实例
 	conn io.ReadWriteCloser
-	//防阻塞,带缓冲的Writer
-	buf *bufio.Writer
+	//编码缓冲区,消息头和消息体都编码成功后再一次写出到连接
+	buf *bytes.Buffer
+	//编码器通过它写入buf,消息体超过maxWriteBody后不再写入
+	out *bodyLimitWriter
+	//按帧读取连接,用于限制消息头和消息体的大小
+	frames *gobFrameReader
+	//统计阻塞在连接上的时间,限制解码消息体的耗时
+	clock *decodeClock
+	//统计写出时阻塞在连接上的时间,用于计算编码耗时
+	encClock *encodeClock
+	//消息头的大小上限
+	maxHeaderBytes int
+	//读取和写出的消息体的大小上限,0表示不限制
+	maxReadBody  int
+	maxWriteBody int
 	//解码器
 	dec *gob.Decoder
 	//编码器
 	enc *gob.Encoder
+	//最近读到的消息头指定的消息体协议
+	bodyType Type
+	//消息头没有指定时消息体默认使用的协议,为空时与连接的协议相同
+	defaultBody Type
+	//是否在消息体后附加校验和
+	checksum bool
+	//写出前buf的最大字节数,读取时重置
+	highWater int64
+	//读写缓冲区的大小
+	bufferSize int
+	//gob编码消息体失败时改用的协议,为空时不重试
+	fallback Type
 }
 
 //构造函数
 func NewGobCodecFunc(conn io.ReadWriteCloser) Codec {
-	//根据连接创建Writer
-	buf := bufio.NewWriter(conn)
+	buf := new(bytes.Buffer)
+	out := &bodyLimitWriter{w: buf, keep: gobTypeDefinitions}
+	clock := newDecodeClock(conn)
+	frames := newGobFrameReader(clock)
 	return &GobCodec{
-		conn: conn,
-		buf:  buf,
-		dec:  gob.NewDecoder(conn),
-		enc:  gob.NewEncoder(buf),
+		conn:           conn,
+		buf:            buf,
+		out:            out,
+		frames:         frames,
+		clock:          clock,
+		encClock:       newEncodeClock(conn),
+		maxHeaderBytes: DefaultMaxHeaderBytes,
+		bufferSize:     DefaultBufferSize,
+		dec:            gob.NewDecoder(frames),
+		enc:            gob.NewEncoder(out),
 	}
 }
 
 //实现Codec接口中的ReadHeader方法
 func (c *GobCodec) ReadHeader(h *Header) error {
-	return c.dec.Decode(h)
+	//只在读消息头期间限制帧的大小,消息体不受影响
+	if c.maxHeaderBytes > 0 {
+		c.frames.limitTo(uint64(c.maxHeaderBytes), ErrHeaderTooLarge, false)
+	}
+	err := c.dec.Decode(h)
+	c.frames.limitTo(0, nil, false)
+	if err != nil {
+		return err
+	}
+	//ReadBody紧跟在ReadHeader之后调用,记录下消息体的协议
+	c.bodyType = c.bodyCodecOf(h)
+	return nil
 }
 
 func (c *GobCodec) ReadBody(body interface{}) error {
-	return c.dec.Decode(body)
+	c.clock.begin()
+	return c.clock.end(c.readBody(body))
+}
+
+func (c *GobCodec) readBody(body interface{}) error {
+	if c.maxReadBody > 0 {
+		//超限的帧被跳过,之后的消息仍可以正常读取
+		c.frames.limitTo(uint64(c.maxReadBody), ErrBodyTooLarge, true)
+		defer c.frames.limitTo(0, nil, false)
+	}
+	if c.checksum {
+		err := readChecksumBody(c.bodyType, GobType, body, c.dec.Decode)
+		if errors.Is(err, ErrBodyTooLarge) {
+			//消息体被跳过,还需要读掉紧随其后的校验和
+			var sum uint32
+			_ = c.dec.Decode(&sum)
+		}
+		return err
+	}
+	return readBody(c.bodyType, body, c.dec.Decode)
+}
+
+//实现RawBodyReader
+//gob的消息依赖解码器之前收到的类型定义,没有按请求指定消息体协议时,返回连接上收到过的类型定义加上该消息体
+//返回的数据可以用gob.NewDecoder单独解码,对端按RawBytes发送时解码到RawBytes
+func (c *GobCodec) ReadRawBody() ([]byte, error) {
+	if c.maxReadBody > 0 {
+		c.frames.limitTo(uint64(c.maxReadBody), ErrBodyTooLarge, true)
+		defer c.frames.limitTo(0, nil, false)
+	}
+	if c.checksum {
+		return readChecksumData(c.dec.Decode)
+	}
+	return readRawBody(c.bodyType, c.dec.Decode, c.readRawMessage)
+}
+
+//读出一个值的原始gob消息,前面加上之前收到的类型定义,使其可以单独解码
+func (c *GobCodec) readRawMessage() ([]byte, error) {
+	if c.frames.defsOverflow {
+		_ = c.dec.DecodeValue(reflect.Value{})
+		return nil, errors.New("rpc codec: too many gob type definitions to read raw body")
+	}
+	raw := bytes.NewBuffer(append([]byte(nil), c.frames.defs...))
+	c.frames.capture = raw
+	//解码器需要读取其中的类型定义,值本身丢弃
+	err := c.dec.DecodeValue(reflect.Value{})
+	c.frames.capture = nil
+	if err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
 }
 
 //
 func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
+	c.encClock.begin()
+	defer c.encClock.end()
 	defer func() {
-		//刷出缓存区
-		_ = c.buf.Flush()
-		//如果有err,那么关闭连接
-		if err != nil {
+		//连接出错时关闭连接,消息体编码失败不影响连接
+		if err != nil && !errors.Is(err, ErrEncodeBody) {
 			_ = c.Close()
 		}
 	}()
+	c.buf.Reset()
+	c.out.reset(0)
 	//对Header进行加密
 	if err := c.enc.Encode(h); err != nil {
 		log.Println("rpc codec: gob error encoding header:", err)
 		return err
 	}
+	headerEnd := c.buf.Len()
+	//消息体超过上限的部分不写入buf,只保留其中的类型定义
+	c.out.reset(c.maxWriteBody)
 	//对Body加密
-	if err := c.enc.Encode(body); err != nil {
+	err = c.writeBody(h, body)
+	if err != nil && c.fallback != "" && c.bodyCodecOf(h) != c.fallback {
+		//消息体改用fallback协议重新编码,并通过消息头告知对端
+		headerEnd, err = c.writeFallback(h, body, headerEnd, err)
+	}
+	oversized := err == nil && c.out.exceeded()
+	if oversized {
+		err = c.out.err()
+	}
+	if err != nil {
 		log.Println("rpc codec: gob error encoding body:", err)
-		return err
+		//丢弃消息头,但编码器已认为其中的类型定义发送过了,需要保留下来
+		b := c.buf.Bytes()
+		headerStart := lastGobMessage(b[:headerEnd])
+		bodyPart := b[headerEnd:]
+		if oversized {
+			//超限前写入的部分可能包含消息体本身,只保留其中的类型定义
+			bodyPart = gobTypeDefinitions(bodyPart)
+		}
+		rest := append(b[:headerStart], bodyPart...)
+		if len(rest) > 0 {
+			if _, werr := c.encClock.Write(rest); werr != nil {
+				return werr
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrEncodeBody, err)
+	}
+	c.recordHighWater(c.buf.Len())
+	_, err = c.encClock.Write(c.buf.Bytes())
+	return err
+}
+
+//丢弃已编码的消息头和消息体(保留其中的类型定义),按fallback协议重新编码,返回新消息头的结束位置
+func (c *GobCodec) writeFallback(h *Header, body interface{}, headerEnd int, gobErr error) (int, error) {
+	b := c.buf.Bytes()
+	headerStart := lastGobMessage(b[:headerEnd])
+	rest := append(b[:headerStart], gobTypeDefinitions(b[headerEnd:])...)
+	c.buf.Truncate(len(rest))
+	fh := *h
+	fh.BodyCodec = c.fallback
+	c.out.reset(0)
+	if err := c.enc.Encode(&fh); err != nil {
+		return c.buf.Len(), err
 	}
+	headerEnd = c.buf.Len()
+	c.out.reset(c.maxWriteBody)
+	if err := c.writeBody(&fh, body); err != nil {
+		return headerEnd, fmt.Errorf("%v, fallback %s: %v", gobErr, c.fallback, err)
+	}
+	return headerEnd, nil
+}
+
+func (c *GobCodec) recordHighWater(n int) {
+	for {
+		old := atomic.LoadInt64(&c.highWater)
+		if int64(n) <= old || atomic.CompareAndSwapInt64(&c.highWater, old, int64(n)) {
+			return
+		}
+	}
+}
+
+//实现HighWaterMarker,Write和读取可以在不同的协程中
+func (c *GobCodec) TakeHighWater() int {
+	return int(atomic.SwapInt64(&c.highWater, 0))
+}
+
+//实现HeaderLimiter
+func (c *GobCodec) SetMaxHeaderBytes(n int) {
+	c.maxHeaderBytes = n
+}
+
+//实现BodyLimiter
+func (c *GobCodec) SetMaxReadBodyBytes(n int) {
+	c.maxReadBody = n
+}
+
+//实现BodyLimiter
+func (c *GobCodec) SetMaxWriteBodyBytes(n int) {
+	c.maxWriteBody = n
+}
+
+//实现DecodeBudgeter
+func (c *GobCodec) SetDecodeBudget(d time.Duration) {
+	c.clock.budget = d
+}
+
+//实现Timer
+func (c *GobCodec) LastEncodeTime() time.Duration {
+	return c.encClock.last
+}
+
+//实现Timer
+func (c *GobCodec) LastDecodeTime() time.Duration {
+	return c.clock.last
+}
+
+func (c *GobCodec) writeBody(h *Header, body interface{}) error {
+	if c.checksum {
+		return writeChecksumBody(c.bodyCodecOf(h), GobType, body, c.enc.Encode)
+	}
+	return writeBody(c.bodyCodecOf(h), body, c.enc.Encode)
+}
+
+//实现BufferSizer,读缓冲区按n重新分配,编码缓冲区按n预先扩容,读缓冲区中已有数据时不修改
+func (c *GobCodec) SetBufferSize(n int) {
+	if n <= c.bufferSize {
+		return
+	}
+	n = clampBufferSize(n)
+	if !c.frames.resize(n) {
+		return
+	}
+	c.bufferSize = n
+	c.buf.Grow(n)
+}
+
+//实现BufferSizer
+func (c *GobCodec) BufferSize() int {
+	return c.bufferSize
+}
+
+//实现FallbackSetter
+func (c *GobCodec) SetFallbackBodyCodec(t Type) {
+	c.fallback = t
+}
+
+//实现ChecksumSetter
+func (c *GobCodec) SetChecksum(enabled bool) {
+	c.checksum = enabled
+}
+
+//实现BodyCodecSetter
+func (c *GobCodec) SetBodyCodec(t Type) {
+	c.defaultBody = t
+}
+
+func (c *GobCodec) bodyCodecOf(h *Header) Type {
+	if h.BodyCodec != "" {
+		return h.BodyCodec
+	}
+	return c.defaultBody
+}
+
+//实现Flusher,Write已经把整条消息一次写到连接,没有缓冲的数据
+func (c *GobCodec) Flush() error {
 	return nil
 }
 
+//实现WriteDeadliner
+func (c *GobCodec) SetWriteDeadline(t time.Time) error {
+	return setWriteDeadline(c.conn, t)
+}
+
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
 }
@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+//gob编码时总是失败的类型
+type failingBody struct{}
+
+func (failingBody) GobEncode() ([]byte, error) {
+	return nil, errors.New("failing body")
+}
+
+func TestGobWriteBodyError(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn)
+	//第一条消息体编码失败时消息头的类型定义也需要保留
+	if err := c.Write(&Header{Seq: 1}, failingBody{}); !errors.Is(err, ErrEncodeBody) {
+		t.Fatalf("expect ErrEncodeBody, got %v", err)
+	}
+	if err := c.Write(&Header{Seq: 2}, 2); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if err := c.Write(&Header{Seq: 3}, failingBody{}); !errors.Is(err, ErrEncodeBody) {
+		t.Fatalf("expect ErrEncodeBody, got %v", err)
+	}
+	if err := c.Write(&Header{Seq: 4}, 4); err != nil {
+		t.Fatal("write error:", err)
+	}
+	for _, seq := range []uint64{2, 4} {
+		var h Header
+		var body int
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatal("read header error:", err)
+		}
+		if err := c.ReadBody(&body); err != nil || h.Seq != seq || uint64(body) != seq {
+			t.Fatalf("expect seq %d, got header %+v body %d (err=%v)", seq, h, body, err)
+		}
+	}
+	var h Header
+	if err := c.ReadHeader(&h); err != io.EOF {
+		t.Fatalf("expect no dangling data, got header %+v (err=%v)", h, err)
+	}
+}
+
+func TestGobHighWater(t *testing.T) {
+	c := NewGobCodecFunc(new(bufferConn)).(*GobCodec)
+	last := 0
+	for _, size := range []int{16, 256, 4096} {
+		if err := c.Write(&Header{Seq: 1}, make([]byte, size)); err != nil {
+			t.Fatal("write error:", err)
+		}
+		hw := c.TakeHighWater()
+		if hw <= size || hw <= last {
+			t.Fatalf("high water %d should grow past payload %d (last %d)", hw, size, last)
+		}
+		last = hw
+	}
+	if hw := c.TakeHighWater(); hw != 0 {
+		t.Fatal("expect high water reset after read, got", hw)
+	}
+	//只保留两次读取之间的最大值
+	_ = c.Write(&Header{Seq: 2}, make([]byte, 1024))
+	_ = c.Write(&Header{Seq: 3}, make([]byte, 8))
+	if hw := c.TakeHighWater(); hw <= 1024 {
+		t.Fatal("expect peak of larger write, got", hw)
+	}
+}
+
+func TestGobBufferSize(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn).(*GobCodec)
+	if c.BufferSize() != DefaultBufferSize || c.frames.r.Size() != DefaultBufferSize {
+		t.Fatal("expect default buffer size:", c.BufferSize(), c.frames.r.Size())
+	}
+	c.SetBufferSize(64 << 10)
+	if c.BufferSize() != 64<<10 || c.frames.r.Size() != 64<<10 || c.buf.Cap() < 64<<10 {
+		t.Fatal("expect larger buffers:", c.BufferSize(), c.frames.r.Size(), c.buf.Cap())
+	}
+	//过大的值被截断,过小的值不会缩小缓冲区
+	c.SetBufferSize(1 << 30)
+	if c.BufferSize() != MaxBufferSize {
+		t.Fatal("expect buffer size to be clamped:", c.BufferSize())
+	}
+	c.SetBufferSize(1)
+	if c.BufferSize() != MaxBufferSize {
+		t.Fatal("expect buffer size to stay:", c.BufferSize())
+	}
+	if err := c.Write(&Header{Seq: 1}, 1); err != nil {
+		t.Fatal("write error:", err)
+	}
+	var h Header
+	var body int
+	if err := c.ReadHeader(&h); err != nil || c.ReadBody(&body) != nil || body != 1 {
+		t.Fatal("read error:", err, body)
+	}
+
+	//读缓冲区中已有数据时不能重新分配,记录的大小也不变
+	c = NewGobCodecFunc(conn).(*GobCodec)
+	for i := 1; i <= 2; i++ {
+		if err := c.Write(&Header{Seq: uint64(i)}, i); err != nil {
+			t.Fatal("write error:", err)
+		}
+	}
+	if err := c.ReadHeader(&h); err != nil || c.ReadBody(&body) != nil {
+		t.Fatal("read error:", err)
+	}
+	c.SetBufferSize(64 << 10)
+	if c.BufferSize() != DefaultBufferSize || c.frames.r.Size() != DefaultBufferSize {
+		t.Fatal("expect buffer size unchanged:", c.BufferSize(), c.frames.r.Size())
+	}
+}
+
+func TestGobFallbackBodyCodec(t *testing.T) {
+	c := NewGobCodecFunc(new(bufferConn)).(*GobCodec)
+	c.SetFallbackBodyCodec(JsonType)
+	body := map[string]interface{}{"ch": make(chan int)}
+	if err := c.Write(&Header{Seq: 1}, body); !errors.Is(err, ErrEncodeBody) {
+		t.Fatalf("expect ErrEncodeBody when json also fails, got %v", err)
+	}
+	if err := c.Write(&Header{Seq: 2}, failingBody{}); err != nil {
+		t.Fatal("expect json fallback:", err)
+	}
+	if err := c.Write(&Header{Seq: 3}, 3); err != nil {
+		t.Fatal("write error:", err)
+	}
+	var h Header
+	var raw map[string]interface{}
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 2 || h.BodyCodec != JsonType || c.ReadBody(&raw) != nil {
+		t.Fatal("expect fallback message marked as json:", err, h)
+	}
+	var body3 int
+	h = Header{}
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 3 || h.BodyCodec != "" || c.ReadBody(&body3) != nil || body3 != 3 {
+		t.Fatal("expect gob message after fallback:", err, h, body3)
+	}
+}
@@ -0,0 +1,243 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+//Json协议的编码解码结构
+type JsonCodec struct {
+	//链接实例
+	conn io.ReadWriteCloser
+	//防阻塞,带缓冲的Writer
+	buf *bufio.Writer
+	//编码器通过它写入buf,消息体超过maxWriteBody后不再写入
+	out *bodyLimitWriter
+	//读取和写出的消息体的大小上限,0表示不限制
+	maxReadBody  int
+	maxWriteBody int
+	//统计阻塞在连接上的时间,限制解码消息体的耗时
+	clock *decodeClock
+	//解码器通过它从clock读取,限制读取一个消息体时读出的字节数
+	in *bodyLimitReader
+	//写缓冲区通过它写出到连接,统计阻塞在连接上的时间,用于计算编码耗时
+	encClock *encodeClock
+	//解码器
+	dec *json.Decoder
+	//编码器
+	enc *json.Encoder
+	//最近读到的消息头指定的消息体协议
+	bodyType Type
+	//消息头没有指定时消息体默认使用的协议,为空时与连接的协议相同
+	defaultBody Type
+	//是否在消息体后附加校验和
+	checksum bool
+	//写缓冲区的大小
+	bufferSize int
+}
+
+//构造函数
+func NewJsonCodecFunc(conn io.ReadWriteCloser) Codec {
+	//根据连接创建Writer
+	encClock := newEncodeClock(conn)
+	buf := bufio.NewWriterSize(encClock, DefaultBufferSize)
+	out := &bodyLimitWriter{w: buf}
+	clock := newDecodeClock(conn)
+	in := &bodyLimitReader{r: clock}
+	return &JsonCodec{
+		conn:       conn,
+		buf:        buf,
+		out:        out,
+		clock:      clock,
+		in:         in,
+		encClock:   encClock,
+		dec:        json.NewDecoder(in),
+		enc:        json.NewEncoder(out),
+		bufferSize: DefaultBufferSize,
+	}
+}
+
+//实现BufferSizer,json.Decoder的读缓冲区会按消息自动扩大,这里只重新分配写缓冲区
+func (c *JsonCodec) SetBufferSize(n int) {
+	if n <= c.bufferSize || c.buf.Buffered() > 0 {
+		return
+	}
+	c.bufferSize = clampBufferSize(n)
+	c.buf = bufio.NewWriterSize(c.encClock, c.bufferSize)
+	c.out.w = c.buf
+}
+
+//实现BufferSizer
+func (c *JsonCodec) BufferSize() int {
+	return c.bufferSize
+}
+
+//实现Codec接口中的ReadHeader方法
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	if err := c.dec.Decode(h); err != nil {
+		return err
+	}
+	//ReadBody紧跟在ReadHeader之后调用,记录下消息体的协议
+	c.bodyType = c.bodyCodecOf(h)
+	return nil
+}
+
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	c.clock.begin()
+	return c.clock.end(c.readBody(body))
+}
+
+func (c *JsonCodec) readBody(body interface{}) error {
+	//需要丢弃的消息体同样按上限读取,不会被整个读入内存
+	return c.in.limitBody(c.maxReadBody, func() error {
+		return c.decodeBody(body)
+	})
+}
+
+func (c *JsonCodec) decodeBody(body interface{}) error {
+	decode := c.dec.Decode
+	if c.maxReadBody > 0 {
+		decode = limitedDecode(c.maxReadBody, c.decodeRaw, json.Unmarshal)
+	}
+	if c.checksum {
+		return readChecksumBody(c.bodyType, JsonType, body, decode)
+	}
+	//json不能解码到nil,需要丢弃时解码到RawMessage
+	if body == nil {
+		_, err := c.decodeRaw()
+		return err
+	}
+	return readBody(c.bodyType, body, decode)
+}
+
+func (c *JsonCodec) decodeRaw() ([]byte, error) {
+	var raw json.RawMessage
+	err := c.dec.Decode(&raw)
+	return raw, err
+}
+
+//实现RawBodyReader,没有按请求指定消息体协议时返回原始的Json
+func (c *JsonCodec) ReadRawBody() ([]byte, error) {
+	var raw []byte
+	err := c.in.limitBody(c.maxReadBody, func() (err error) {
+		raw, err = c.readRawBody()
+		return err
+	})
+	return raw, err
+}
+
+func (c *JsonCodec) readRawBody() ([]byte, error) {
+	if c.checksum {
+		return readChecksumData(c.dec.Decode)
+	}
+	return readRawBody(c.bodyType, c.dec.Decode, c.decodeRaw)
+}
+
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	c.encClock.begin()
+	defer c.encClock.end()
+	defer func() {
+		//消息体编码失败时整条消息已从缓冲区丢弃,连接仍可使用
+		if errors.Is(err, ErrEncodeBody) {
+			return
+		}
+		//刷出缓存区
+		_ = c.buf.Flush()
+		//如果有err,那么关闭连接
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	c.out.reset(0)
+	//对Header进行编码
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+	headerLen := c.out.accepted
+	//消息体超过上限的部分不写入缓冲区
+	c.out.reset(c.maxWriteBody)
+	//对Body编码
+	err = c.writeBody(h, body)
+	if err == nil && c.out.exceeded() {
+		err = c.out.err()
+	}
+	if err != nil {
+		log.Println("rpc codec: json error encoding body:", err)
+		//缓冲区还没有刷出过时丢弃其中的消息头,否则对端已收到部分消息,只能关闭连接
+		if c.buf.Buffered() != headerLen+c.out.accepted {
+			return err
+		}
+		c.buf.Reset(c.encClock)
+		return fmt.Errorf("%w: %v", ErrEncodeBody, err)
+	}
+	return nil
+}
+
+func (c *JsonCodec) writeBody(h *Header, body interface{}) error {
+	if c.checksum {
+		return writeChecksumBody(c.bodyCodecOf(h), JsonType, body, c.enc.Encode)
+	}
+	return writeBody(c.bodyCodecOf(h), body, c.enc.Encode)
+}
+
+//实现BodyLimiter
+func (c *JsonCodec) SetMaxReadBodyBytes(n int) {
+	c.maxReadBody = n
+}
+
+//实现BodyLimiter
+func (c *JsonCodec) SetMaxWriteBodyBytes(n int) {
+	c.maxWriteBody = n
+}
+
+//实现DecodeBudgeter
+func (c *JsonCodec) SetDecodeBudget(d time.Duration) {
+	c.clock.budget = d
+}
+
+//实现Timer
+func (c *JsonCodec) LastEncodeTime() time.Duration {
+	return c.encClock.last
+}
+
+//实现Timer
+func (c *JsonCodec) LastDecodeTime() time.Duration {
+	return c.clock.last
+}
+
+//实现ChecksumSetter
+func (c *JsonCodec) SetChecksum(enabled bool) {
+	c.checksum = enabled
+}
+
+//实现BodyCodecSetter
+func (c *JsonCodec) SetBodyCodec(t Type) {
+	c.defaultBody = t
+}
+
+func (c *JsonCodec) bodyCodecOf(h *Header) Type {
+	if h.BodyCodec != "" {
+		return h.BodyCodec
+	}
+	return c.defaultBody
+}
+
+//实现Flusher,Write成功时已经刷出缓冲区,这里通常没有缓冲的数据
+func (c *JsonCodec) Flush() error {
+	return c.buf.Flush()
+}
+
+//实现WriteDeadliner
+func (c *JsonCodec) SetWriteDeadline(t time.Time) error {
+	return setWriteDeadline(c.conn, t)
+}
+
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
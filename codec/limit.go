@@ -0,0 +1,339 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//消息头编码后的默认大小上限
+const DefaultMaxHeaderBytes = 64 << 10
+
+//消息头超过大小上限时返回的错误
+var ErrHeaderTooLarge = errors.New("rpc codec: header too large")
+
+//可以限制消息头大小的Codec
+type HeaderLimiter interface {
+	//设置消息头编码后的大小上限,n<=0表示不限制
+	SetMaxHeaderBytes(n int)
+}
+
+//消息体超过大小上限时返回的错误,超限的消息体被整体跳过,连接仍然可用
+//json和cbor在读取过程中超过上限时解码被中断,连接上的数据已不完整,之后的读取都返回该错误
+var ErrBodyTooLarge = errors.New("rpc codec: body too large")
+
+//可以限制消息体大小的Codec
+type BodyLimiter interface {
+	//设置读取的消息体编码后的大小上限,n<=0表示不限制,需要丢弃的消息体同样受限制
+	SetMaxReadBodyBytes(n int)
+	//设置写出的消息体编码后的大小上限,超过时Write返回包装了ErrBodyTooLarge的ErrEncodeBody,n<=0表示不限制
+	SetMaxWriteBodyBytes(n int)
+}
+
+//编码器和发送缓冲区之间的Writer,消息体超过上限后不再写入缓冲区,避免超限的消息体整个复制进去
+type bodyLimitWriter struct {
+	w io.Writer
+	//写入的字节数上限,0表示不限制
+	limit int
+	//本次计数以来编码器写出的字节数,包括没有写入w的部分
+	written int
+	//本次计数以来实际写入w的字节数
+	accepted int
+	//超过上限后仍要写入w的部分,gob需要保留其中的类型定义,为nil时全部丢弃
+	keep func(p []byte) []byte
+}
+
+//重新开始计数并设置上限,n为0表示不限制
+func (w *bodyLimitWriter) reset(n int) {
+	w.limit, w.written, w.accepted = n, 0, 0
+}
+
+//是否已超过上限
+func (w *bodyLimitWriter) exceeded() bool {
+	return w.limit > 0 && w.written > w.limit
+}
+
+func (w *bodyLimitWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	if !w.exceeded() {
+		w.accepted += len(p)
+		return w.w.Write(p)
+	}
+	if w.keep != nil {
+		if kept := w.keep(p); len(kept) > 0 {
+			if _, err := w.w.Write(kept); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+//超过上限时Write返回的错误
+func (w *bodyLimitWriter) err() error {
+	return fmt.Errorf("%w: %d bytes exceeds limit %d", ErrBodyTooLarge, w.written, w.limit)
+}
+
+//先读出一个值的原始数据,检查大小后再解码
+//json和cbor的消息没有长度前缀,无法像gob一样在读取前拦截,读取时由bodyLimitReader限制从连接读出的字节数
+//读取期间没有超过bodyLimitReader的上限但值本身超限时(部分数据在读消息头时已被解码器缓存),该值已被完整读出,连接仍可使用
+func limitedDecode(limit int, decodeRaw func() ([]byte, error), unmarshal func([]byte, interface{}) error) func(interface{}) error {
+	return func(v interface{}) error {
+		raw, err := decodeRaw()
+		if err != nil {
+			return err
+		}
+		if len(raw) > limit {
+			return fmt.Errorf("%w: %d bytes exceeds limit %d", ErrBodyTooLarge, len(raw), limit)
+		}
+		return unmarshal(raw, v)
+	}
+}
+
+//连接和json,cbor解码器之间的Reader,读取一个消息体期间从连接读出的字节数超过上限时中断解码
+//解码器不必把超限的消息体整个读入内存,但它没有长度前缀无法跳过,中断后连接上的数据已不完整,之后的读取都返回该错误
+type bodyLimitReader struct {
+	r io.Reader
+	//本次计数的上限,0表示不限制
+	limit int
+	//本次计数以来读出的字节数
+	read int
+	//超过上限后的错误
+	err error
+}
+
+//重新开始计数并设置上限,n为0表示不限制
+func (r *bodyLimitReader) reset(n int) {
+	r.limit, r.read = n, 0
+}
+
+func (r *bodyLimitReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.limit > 0 {
+		if r.read >= r.limit {
+			r.err = fmt.Errorf("%w: more than %d bytes read, decoding aborted", ErrBodyTooLarge, r.limit)
+			return 0, r.err
+		}
+		//不读出超过上限的数据,缓冲区不会因超限的消息体而扩大
+		if rest := r.limit - r.read; len(p) > rest {
+			p = p[:rest]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+//按上限n读取一个消息体,n<=0时不限制
+//消息体末尾可能还需要多读一个分隔符才能确定值的结束,如json的数字,因此多允许一个字节
+func (r *bodyLimitReader) limitBody(n int, read func() error) error {
+	if n <= 0 {
+		return read()
+	}
+	r.reset(n + 1)
+	defer r.reset(0)
+	return read()
+}
+
+//按gob的消息帧读取数据,在分配内存之前检查每一帧声明的长度
+//gob的每条消息以长度前缀开头,解码器会先按该长度分配缓冲区,因此需要在这里提前拦截
+type gobFrameReader struct {
+	r *bufio.Reader
+	//被读取的连接
+	src io.Reader
+	//当前帧剩余未读的字节数(包括长度前缀)
+	remaining uint64
+	//单帧的长度上限,0表示不限制
+	limit uint64
+	//超过上限时返回的错误
+	limitErr error
+	//超过上限时是否跳过整帧,跳过后连接上的数据仍然是对齐的
+	skipOversized bool
+	//连接上收到过的类型定义消息,用于把单个消息体还原成可以独立解码的gob数据
+	defs []byte
+	//类型定义超过maxRecordedTypeDefs时不再记录
+	defsOverflow bool
+	//当前帧是否为类型定义
+	recording bool
+	//不为nil时读出的数据同时写入capture
+	capture *bytes.Buffer
+}
+
+//每个连接记录的类型定义的字节数上限
+const maxRecordedTypeDefs = 64 << 10
+
+//设置单帧的长度上限,n为0表示不限制
+func (f *gobFrameReader) limitTo(n uint64, err error, skip bool) {
+	f.limit, f.limitErr, f.skipOversized = n, err, skip
+}
+
+func newGobFrameReader(r io.Reader) *gobFrameReader {
+	return &gobFrameReader{r: bufio.NewReaderSize(r, DefaultBufferSize), src: r}
+}
+
+//按n重新分配读缓冲区,只能在读取之前调用,已有缓冲的数据时不修改并返回false
+func (f *gobFrameReader) resize(n int) bool {
+	if f.r.Buffered() > 0 {
+		return false
+	}
+	f.r = bufio.NewReaderSize(f.src, n)
+	return true
+}
+
+//每次读取不跨越帧的边界,保证限制只作用于读消息头期间的帧
+func (f *gobFrameReader) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		if err := f.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= uint64(n)
+	if f.recording && !f.defsOverflow {
+		if len(f.defs)+n > maxRecordedTypeDefs {
+			f.defs, f.defsOverflow = nil, true
+		} else {
+			f.defs = append(f.defs, p[:n]...)
+		}
+	}
+	if f.capture != nil {
+		f.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+//实现io.ByteReader,避免gob.Decoder再包一层带缓冲的Reader而提前读入下一帧
+func (f *gobFrameReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+//解析下一帧的长度前缀,前缀本身不消费,留给gob解码器读取
+func (f *gobFrameReader) nextFrame() error {
+	b, err := f.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	n, err := gobPrefixLen(b[0])
+	if err != nil {
+		return err
+	}
+	b, err = f.r.Peek(n)
+	if err != nil {
+		return err
+	}
+	size := gobMessageLen(b)
+	if err := f.setFrame(uint64(n), size); err != nil {
+		return err
+	}
+	//类型id在消息开头,最多9个字节,为负数时是类型定义
+	idLen := uint64(9)
+	if size < idLen {
+		idLen = size
+	}
+	b, err = f.r.Peek(n + int(idLen))
+	if err != nil {
+		return err
+	}
+	id, ok := gobInt(b[n:])
+	f.recording = ok && id < 0
+	return nil
+}
+
+func (f *gobFrameReader) setFrame(prefix, size uint64) error {
+	if f.limit > 0 && size > f.limit {
+		if f.skipOversized {
+			if _, err := f.r.Discard(int(prefix + size)); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("%w: %d bytes exceeds limit %d", f.limitErr, size, f.limit)
+	}
+	f.remaining = prefix + size
+	return nil
+}
+
+//根据长度前缀的首字节得到前缀的字节数
+func gobPrefixLen(b byte) (int, error) {
+	//小于0x80时前缀就是长度本身,否则为后续大端字节数的相反数
+	if b < 0x80 {
+		return 1, nil
+	}
+	n := int(-int8(b))
+	if n > 8 {
+		return 0, errors.New("rpc codec: invalid gob message length")
+	}
+	return 1 + n, nil
+}
+
+//解析完整的长度前缀,得到消息的字节数
+func gobMessageLen(prefix []byte) uint64 {
+	if len(prefix) == 1 {
+		return uint64(prefix[0])
+	}
+	var size uint64
+	for _, c := range prefix[1:] {
+		size = size<<8 | uint64(c)
+	}
+	return size
+}
+
+//返回b中最后一条gob消息的起始位置,b由若干完整的消息组成
+func lastGobMessage(b []byte) int {
+	last := 0
+	for i := 0; i < len(b); {
+		last = i
+		n, err := gobPrefixLen(b[i])
+		if err != nil || i+n > len(b) {
+			break
+		}
+		i += n + int(gobMessageLen(b[i:i+n]))
+	}
+	return last
+}
+
+//只保留b中的类型定义消息,b由若干完整的gob消息组成,类型定义消息的类型id为负数
+func gobTypeDefinitions(b []byte) []byte {
+	var defs []byte
+	for i := 0; i < len(b); {
+		n, err := gobPrefixLen(b[i])
+		if err != nil || i+n > len(b) {
+			break
+		}
+		end := i + n + int(gobMessageLen(b[i:i+n]))
+		if end > len(b) {
+			break
+		}
+		if id, ok := gobInt(b[i+n : end]); ok && id < 0 {
+			defs = append(defs, b[i:end]...)
+		}
+		i = end
+	}
+	return defs
+}
+
+//解析gob编码的有符号整数,最低位为符号位
+func gobInt(b []byte) (int64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	n, err := gobPrefixLen(b[0])
+	if err != nil || n > len(b) {
+		return 0, false
+	}
+	u := gobMessageLen(b[:n])
+	if u&1 != 0 {
+		return ^int64(u >> 1), true
+	}
+	return int64(u >> 1), true
+}
@@ -0,0 +1,208 @@
+package codec
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxHeaderBytes(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodecFunc(conn)
+	if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, 1); err != nil {
+		t.Fatal("write error:", err)
+	}
+	//消息体不受消息头大小的限制
+	big := strings.Repeat("x", 8<<20)
+	if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, big); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if err := c.Write(&Header{ServiceMethod: big, Seq: 3}, 1); err != nil {
+		t.Fatal("write error:", err)
+	}
+
+	var h Header
+	var body int
+	if err := c.ReadHeader(&h); err != nil || c.ReadBody(&body) != nil {
+		t.Fatal("read error:", err)
+	}
+	var bigBody string
+	if err := c.ReadHeader(&h); err != nil || c.ReadBody(&bigBody) != nil || bigBody != big {
+		t.Fatal("read big body error:", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := c.ReadHeader(&h)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrHeaderTooLarge) {
+		t.Fatalf("expect ErrHeaderTooLarge, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("expect no large allocation, got %d bytes", allocated)
+	}
+}
+
+//每次读取都阻塞一段时间的连接
+type slowReader struct {
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return len(p), nil
+}
+
+func TestDecodeClock(t *testing.T) {
+	clock := newDecodeClock(slowReader{delay: 30 * time.Millisecond})
+	clock.budget = 10 * time.Millisecond
+	//阻塞在连接上的时间不计入预算
+	clock.begin()
+	if _, err := clock.Read(make([]byte, 8)); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if err := clock.end(nil); err != nil {
+		t.Fatal("expect blocked time excluded, got:", err)
+	}
+	//读完之后超出预算
+	clock.begin()
+	time.Sleep(20 * time.Millisecond)
+	if err := clock.end(nil); err != ErrDecodeBudget {
+		t.Fatal("expect ErrDecodeBudget, got:", err)
+	}
+	if _, err := clock.Read(make([]byte, 8)); err != nil {
+		t.Fatal("expect reads outside ReadBody to succeed, got:", err)
+	}
+	//读取过程中超出预算时中断,之后的读取都失败
+	clock.begin()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := clock.Read(make([]byte, 8)); err != ErrDecodeBudget {
+		t.Fatal("expect ErrDecodeBudget, got:", err)
+	}
+	_ = clock.end(nil)
+	if _, err := clock.Read(make([]byte, 8)); err != ErrDecodeBudget {
+		t.Fatal("expect decoder to stay aborted, got:", err)
+	}
+}
+
+//每次读写都阻塞delay的连接,每次最多读出4个字节
+type slowConn struct {
+	bufferConn
+	delay time.Duration
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	if len(p) > 4 {
+		p = p[:4]
+	}
+	return c.bufferConn.Read(p)
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.bufferConn.Write(p)
+}
+
+//各协议统计的编解码耗时不包括阻塞在连接上读写的时间
+func TestCodecTimer(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	for _, typ := range []Type{GobType, JsonType, CborType} {
+		conn := &slowConn{delay: delay}
+		c := NewCodeFuncMap[typ](conn)
+		timer := c.(Timer)
+		start := time.Now()
+		if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, strings.Repeat("x", 32)); err != nil {
+			t.Fatalf("%s: write error: %v", typ, err)
+		}
+		if wall := time.Since(start); wall < delay || timer.LastEncodeTime() <= 0 || timer.LastEncodeTime() >= wall/2 {
+			t.Fatalf("%s: expect encode time %s to exclude write blocking of %s", typ, timer.LastEncodeTime(), wall)
+		}
+		var h Header
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatalf("%s: read header error: %v", typ, err)
+		}
+		var body string
+		start = time.Now()
+		if err := c.ReadBody(&body); err != nil {
+			t.Fatalf("%s: read body error: %v", typ, err)
+		}
+		if wall := time.Since(start); wall < delay || timer.LastDecodeTime() <= 0 || timer.LastDecodeTime() >= wall/2 {
+			t.Fatalf("%s: expect decode time %s to exclude read blocking of %s", typ, timer.LastDecodeTime(), wall)
+		}
+		if body != strings.Repeat("x", 32) {
+			t.Fatalf("%s: unexpected body %q", typ, body)
+		}
+	}
+}
+
+//各协议在编码时拦截超限的消息体,连接仍可使用
+//读取时gob跳过超限的消息体,json和cbor中断解码,都不会把超限的消息体整个读入内存
+func TestBodyLimits(t *testing.T) {
+	big := strings.Repeat("x", 1<<20)
+	for _, typ := range []Type{GobType, JsonType, CborType} {
+		conn := new(bufferConn)
+		c := NewCodeFuncMap[typ](conn)
+		c.(BodyLimiter).SetMaxWriteBodyBytes(1024)
+		err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, big)
+		if !errors.Is(err, ErrEncodeBody) || !strings.Contains(err.Error(), ErrBodyTooLarge.Error()) {
+			t.Fatalf("%s: expect oversized body rejected, got %v", typ, err)
+		}
+		//超限的消息体没有进入发送缓冲区,也没有写到连接
+		if conn.Len() > 1024 {
+			t.Fatalf("%s: expect oversized body not written, got %d bytes", typ, conn.Len())
+		}
+		if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, "small"); err != nil {
+			t.Fatalf("%s: write error: %v", typ, err)
+		}
+		var h Header
+		var body string
+		if err := c.ReadHeader(&h); err != nil || h.Seq != 2 || c.ReadBody(&body) != nil || body != "small" {
+			t.Fatalf("%s: read error after oversized write: %v %d %q", typ, err, h.Seq, body)
+		}
+
+		//需要丢弃的消息体同样受限制
+		for _, discard := range []bool{false, true} {
+			conn = new(bufferConn)
+			c = NewCodeFuncMap[typ](conn)
+			for seq, b := range []string{big, "small"} {
+				if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: uint64(seq)}, b); err != nil {
+					t.Fatalf("%s: write error: %v", typ, err)
+				}
+			}
+			c.(BodyLimiter).SetMaxReadBodyBytes(1024)
+			h, body = Header{}, ""
+			if err := c.ReadHeader(&h); err != nil {
+				t.Fatalf("%s: read header error: %v", typ, err)
+			}
+			var target interface{} = &body
+			if discard {
+				target = nil
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err = c.ReadBody(target)
+			runtime.ReadMemStats(&after)
+			if !errors.Is(err, ErrBodyTooLarge) {
+				t.Fatalf("%s: expect ErrBodyTooLarge, got %v", typ, err)
+			}
+			//超限的消息体没有被整个读入内存
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 256<<10 {
+				t.Fatalf("%s: expect no large allocation, got %d bytes", typ, allocated)
+			}
+			h = Header{}
+			err = c.ReadHeader(&h)
+			if typ == GobType {
+				//gob按长度前缀跳过超限的消息体,连接仍可使用
+				if err != nil || h.Seq != 1 || c.ReadBody(&body) != nil || body != "small" {
+					t.Fatalf("%s: read error after oversized body: %v %d %q", typ, err, h.Seq, body)
+				}
+			} else if !errors.Is(err, ErrBodyTooLarge) {
+				//json和cbor无法跳过,解码被中断后连接不能再读取
+				t.Fatalf("%s: expect reads to stay aborted, got %v", typ, err)
+			}
+		}
+	}
+}
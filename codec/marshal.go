@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"reflect"
+	"sync"
+)
+
+//与编解码协议无关的类型序列化接口,用于保证同一类型在不同协议下的传输格式一致
+type Marshaler interface {
+	MarshalRPC(v interface{}) ([]byte, error)
+	UnmarshalRPC(data []byte, v interface{}) error
+}
+
+//reflect.Type -> Marshaler,指针类型按其指向的类型保存
+var marshalers sync.Map
+
+//为某个类型注册Marshaler,消息体为该类型(或其指针)时,各协议都会先用它转换成[]byte再编码
+//通信双方需要为同一类型注册相同的Marshaler
+func RegisterTypeMarshaler(t reflect.Type, m Marshaler) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	marshalers.Store(t, m)
+}
+
+//获取消息体对应类型的Marshaler,没有注册时返回nil
+func lookupMarshaler(body interface{}) Marshaler {
+	if body == nil {
+		return nil
+	}
+	t := reflect.TypeOf(body)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if m, ok := marshalers.Load(t); ok {
+		return m.(Marshaler)
+	}
+	return nil
+}
+
+//编码消息体,注册了Marshaler的类型先转换成[]byte
+func encodeBody(body interface{}, encode func(interface{}) error) error {
+	m := lookupMarshaler(body)
+	if m == nil {
+		return encode(body)
+	}
+	data, err := m.MarshalRPC(body)
+	if err != nil {
+		return err
+	}
+	return encode(data)
+}
+
+//解码消息体,注册了Marshaler的类型先解码出[]byte再还原
+func decodeBody(body interface{}, decode func(interface{}) error) error {
+	m := lookupMarshaler(body)
+	if m == nil {
+		return decode(body)
+	}
+	var data []byte
+	if err := decode(&data); err != nil {
+		return err
+	}
+	return m.UnmarshalRPC(data, body)
+}
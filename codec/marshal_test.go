@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+//只有未导出字段的类型,gob和json原生都无法正确编码
+type Celsius struct {
+	degree float64
+}
+
+type celsiusMarshaler struct{}
+
+func (celsiusMarshaler) MarshalRPC(v interface{}) ([]byte, error) {
+	switch c := v.(type) {
+	case Celsius:
+		return []byte(strconv.FormatFloat(c.degree, 'f', -1, 64)), nil
+	case *Celsius:
+		return []byte(strconv.FormatFloat(c.degree, 'f', -1, 64)), nil
+	}
+	return nil, errors.New("not a Celsius")
+}
+
+func (celsiusMarshaler) UnmarshalRPC(data []byte, v interface{}) error {
+	degree, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return err
+	}
+	v.(*Celsius).degree = degree
+	return nil
+}
+
+//基于内存缓冲的连接
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func TestRegisterTypeMarshaler(t *testing.T) {
+	RegisterTypeMarshaler(reflect.TypeOf(Celsius{}), celsiusMarshaler{})
+	for _, typ := range []Type{GobType, JsonType} {
+		conn := new(bufferConn)
+		c := NewCodeFuncMap[typ](conn)
+		if err := c.Write(&Header{ServiceMethod: "Weather.Get", Seq: 1}, Celsius{degree: 36.6}); err != nil {
+			t.Fatalf("%s: write error: %v", typ, err)
+		}
+		var h Header
+		var reply Celsius
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatalf("%s: read header error: %v", typ, err)
+		}
+		if err := c.ReadBody(&reply); err != nil {
+			t.Fatalf("%s: read body error: %v", typ, err)
+		}
+		if h.Seq != 1 || reply.degree != 36.6 {
+			t.Fatalf("%s: unexpected round trip %+v %+v", typ, h, reply)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package codec
+
+//已经序列化好的不透明数据,作为参数或返回值时按原样发送,不经过反射编码
+type RawBytes []byte
+
+//实现gob.GobEncoder,gob只负责加上长度前缀
+func (r RawBytes) GobEncode() ([]byte, error) {
+	return r, nil
+}
+
+//实现gob.GobDecoder,gob会复用传入的data,需要拷贝一份
+func (r *RawBytes) GobDecode(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
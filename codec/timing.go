@@ -0,0 +1,48 @@
+package codec
+
+import (
+	"io"
+	"time"
+)
+
+//可以统计编解码耗时的Codec,耗时只包括编码和解码本身,不包括阻塞在连接上读写的时间
+//Write之后在持有发送锁时读取编码耗时,ReadBody之后在读取协程中读取解码耗时
+type Timer interface {
+	//最近一次Write编码消息头和消息体的耗时
+	LastEncodeTime() time.Duration
+	//最近一次ReadBody解码消息体的耗时
+	LastDecodeTime() time.Duration
+}
+
+//包裹Codec写出的连接,统计阻塞在连接上的时间,Write的耗时扣除这部分即为编码耗时
+type encodeClock struct {
+	w io.Writer
+	//累计阻塞在w上的时间
+	blocked time.Duration
+	//正在进行的Write开始的时间,以及当时的blocked
+	start        time.Time
+	startBlocked time.Duration
+	//最近一次Write的编码耗时
+	last time.Duration
+}
+
+func newEncodeClock(w io.Writer) *encodeClock {
+	return &encodeClock{w: w}
+}
+
+func (c *encodeClock) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.w.Write(p)
+	c.blocked += time.Since(start)
+	return n, err
+}
+
+//开始编码一条消息
+func (c *encodeClock) begin() {
+	c.start, c.startBlocked = time.Now(), c.blocked
+}
+
+//消息编码并写出结束,记录扣除阻塞时间后的耗时
+func (c *encodeClock) end() {
+	c.last = time.Since(c.start) - (c.blocked - c.startBlocked)
+}
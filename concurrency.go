@@ -0,0 +1,52 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//方法的并发数达到上限且Server.RejectOverConcurrency开启时返回的错误
+var ErrMethodBusy = errors.New("rpc server: method concurrency limit reached")
+
+//限制已注册方法同时处理的请求数,适合开销很大的方法,limit为0时取消限制
+//达到上限后新请求排队等待,开启RejectOverConcurrency时直接返回ErrMethodBusy
+func (server *Server) SetMethodConcurrency(serviceMethod string, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("rpc server: invalid method concurrency %d", limit)
+	}
+	_, mType, err := server.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	var sem chan struct{}
+	if limit > 0 {
+		sem = make(chan struct{}, limit)
+	}
+	//正在处理的请求持有旧的信号量,结束时归还到旧的信号量中
+	mType.sem.Store(sem)
+	return nil
+}
+
+//获取方法的执行名额,返回归还名额的函数
+func (server *Server) acquireMethod(ctx context.Context, m *methodType) (func(), error) {
+	sem, _ := m.sem.Load().(chan struct{})
+	if sem == nil {
+		return func() {}, nil
+	}
+	release := func() { <-sem }
+	if server.RejectOverConcurrency {
+		select {
+		case sem <- struct{}{}:
+			return release, nil
+		default:
+			return nil, ErrMethodBusy
+		}
+	}
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
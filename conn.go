@@ -0,0 +1,83 @@
+package gorpc
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//统计读写字节数的连接包装,同时转发超时设置
+type countingConn struct {
+	io.ReadWriteCloser
+	//已读取的字节数
+	read uint64
+	//已写出的字节数
+	written uint64
+	//读写字节数之和的上限,达到后读写都返回ErrConnBudgetExceeded,0表示不限制
+	budget uint64
+}
+
+//连接读写的字节数超过Server.MaxConnBytes
+var ErrConnBudgetExceeded = errors.New("rpc server: connection byte budget exceeded")
+
+func newCountingConn(conn io.ReadWriteCloser) *countingConn {
+	return &countingConn{ReadWriteCloser: conn}
+}
+
+//读写的字节数是否已用完预算
+func (c *countingConn) exhausted() bool {
+	return c.budget > 0 && c.BytesRead()+c.BytesWritten() >= c.budget
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	if c.exhausted() {
+		return 0, ErrConnBudgetExceeded
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddUint64(&c.read, uint64(n))
+	//写出时用完预算会关闭连接,阻塞中的读取因此返回的错误替换为预算错误
+	if err != nil && c.exhausted() {
+		err = ErrConnBudgetExceeded
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	if c.exhausted() {
+		return 0, ErrConnBudgetExceeded
+	}
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	//用完预算后关闭连接,否则阻塞在读取上的一方无法得知
+	if c.exhausted() {
+		_ = c.ReadWriteCloser.Close()
+	}
+	return n, err
+}
+
+//已读取的字节数
+func (c *countingConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.read)
+}
+
+//已写出的字节数
+func (c *countingConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+var errNoDeadline = errors.New("rpc: conn does not support deadline")
+
+func (c *countingConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := c.ReadWriteCloser.(readDeadlineConn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (c *countingConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(t time.Time) error }); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return errNoDeadline
+}
@@ -0,0 +1,112 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const (
+	//服务端连接信息
+	connInfoKey contextKey = iota
+	//请求id
+	requestIDKey
+	//方法设置的ETag
+	etagKey
+	//请求头中的元数据
+	metadataKey
+	//向调用方发送事件
+	eventSenderKey
+)
+
+//请求id在Header.Metadata中的key
+const RequestIDKey = "request-id"
+
+//生成一个随机的id
+func newRandomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+//在方法中获取当前请求的id
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok
+}
+
+//获取请求头中的请求id,没有时返回空串
+func requestIDOf(h *codec.Header) string {
+	return h.Metadata[RequestIDKey]
+}
+
+//服务端一个连接的基本信息,保存在连接级别的context中
+type connInfo struct {
+	//服务端为连接分配的id
+	id uint64
+	//对端地址,连接不是net.Conn时为空
+	remoteAddr string
+	//握手时协商出的Option
+	option *Option
+	//TLS连接握手后的状态,不是TLS连接时为nil
+	tls *tls.ConnectionState
+	//连接占用的名额,不限制连接数时为nil
+	slot *connSlot
+	//RegisterFactory注册的服务在该连接上的实例
+	instancesLock sync.Mutex
+	instances     map[*service]reflect.Value
+}
+
+//从conn中获取对端地址
+func remoteAddrOf(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
+
+//获取context中的连接信息,不存在时返回空的connInfo
+func connInfoFromContext(ctx context.Context) *connInfo {
+	if info, ok := ctx.Value(connInfoKey).(*connInfo); ok {
+		return info
+	}
+	return &connInfo{}
+}
+
+//在方法中获取连接协商出的Option,ctx不是服务端传入的context时返回false
+func OptionFromContext(ctx context.Context) (*Option, bool) {
+	info := connInfoFromContext(ctx)
+	return info.option, info.option != nil
+}
+
+//去重的范围:握手时客户端声明的ClientID和会话,没有ClientID时返回空串
+func dedupClientOf(ctx context.Context) string {
+	if opt, ok := OptionFromContext(ctx); ok && opt.ClientID != "" {
+		return opt.ClientID + "/" + opt.Session
+	}
+	return ""
+}
+
+//在方法中获取客户端地址,连接不是net.Conn时返回false
+func PeerAddrFromContext(ctx context.Context) (string, bool) {
+	info := connInfoFromContext(ctx)
+	return info.remoteAddr, info.remoteAddr != ""
+}
+
+//在方法中获取当前连接的id,可用于Server.CallClient等按连接操作的接口
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	info := connInfoFromContext(ctx)
+	return info.id, info.id != 0
+}
@@ -0,0 +1,102 @@
+package gorpc
+
+import (
+	"github.com/TheR1sing3un/gorpc/codec"
+	"sync"
+	"time"
+)
+
+//客户端在去重窗口中的记录超过该时间没有新请求时被清理
+var DedupIdleTimeout = 10 * time.Minute
+
+//按(客户端会话, 方法名, seq)记录最近处理过的请求,实现至多一次的语义
+type dedupStore struct {
+	lock sync.Mutex
+	//客户端会话 -> 该会话最近的请求
+	clients map[string]*dedupWindow
+	//上一次清理空闲客户端的时间
+	lastPrune time.Time
+}
+
+//一个客户端会话最近处理过的请求
+type dedupWindow struct {
+	entries map[dedupKey]*dedupEntry
+	//按到达顺序排列的请求,超过窗口大小时淘汰最早的
+	order    []dedupKey
+	lastSeen time.Time
+}
+
+//同一个会话内的请求,方法名不同的请求即使seq相同也不是重复的请求
+type dedupKey struct {
+	serviceMethod string
+	seq           uint64
+}
+
+//一次请求的处理结果,done关闭后其余字段只读
+type dedupEntry struct {
+	done     chan struct{}
+	err      string
+	metadata map[string]string
+	body     interface{}
+}
+
+//登记一个请求,clientID为空或window<=0时不去重,返回nil
+//(serviceMethod, seq)已在窗口中时返回之前的记录和true,调用方等待done后使用其结果
+func (d *dedupStore) begin(clientID string, serviceMethod string, seq uint64, window int) (*dedupEntry, bool) {
+	if clientID == "" || window <= 0 {
+		return nil, false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if d.clients == nil {
+		d.clients = make(map[string]*dedupWindow)
+	}
+	if now.Sub(d.lastPrune) > DedupIdleTimeout {
+		for id, w := range d.clients {
+			if now.Sub(w.lastSeen) > DedupIdleTimeout {
+				delete(d.clients, id)
+			}
+		}
+		d.lastPrune = now
+	}
+	w := d.clients[clientID]
+	if w == nil {
+		w = &dedupWindow{entries: make(map[dedupKey]*dedupEntry)}
+		d.clients[clientID] = w
+	}
+	w.lastSeen = now
+	key := dedupKey{serviceMethod: serviceMethod, seq: seq}
+	if entry, ok := w.entries[key]; ok {
+		return entry, true
+	}
+	entry := &dedupEntry{done: make(chan struct{})}
+	w.entries[key] = entry
+	w.order = append(w.order, key)
+	for len(w.order) > window {
+		delete(w.entries, w.order[0])
+		w.order = w.order[1:]
+	}
+	return entry, false
+}
+
+//记录要发送的响应,请求id之外的响应头元数据会在重放时一起返回
+func (e *dedupEntry) finish(h *codec.Header, body interface{}) {
+	e.err = h.Error
+	e.metadata = make(map[string]string, len(h.Metadata))
+	for k, v := range h.Metadata {
+		if k != RequestIDKey {
+			e.metadata[k] = v
+		}
+	}
+	e.body = body
+	close(e.done)
+}
+
+//把记录的结果写入重复请求的响应头
+func (e *dedupEntry) apply(h *codec.Header) {
+	h.Error = e.err
+	for k, v := range e.metadata {
+		h.Metadata[k] = v
+	}
+}
@@ -0,0 +1,46 @@
+package gorpc
+
+import (
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"reflect"
+)
+
+//服务端内置的服务名,开启Server.EnableDescribe后提供,不需要注册
+const BuiltinServiceName = "_rpc_"
+
+//内置服务,方法通过 _rpc_.<Method> 调用
+type builtinService struct {
+	server *Server
+}
+
+//返回serviceMethod的参数和返回值的类型描述,客户端可以在运行时检查与服务端是否兼容
+//按请求相同的查找顺序(见SetDispatchPipeline)找到方法,被拦截或交给UnknownMethodHandler的方法没有类型描述
+func (b *builtinService) Describe(serviceMethod string, reply *MethodSchema) error {
+	h := &codec.Header{ServiceMethod: serviceMethod}
+	_, mType, intercept, unknown, err := b.server.dispatch(h)
+	if err != nil {
+		return err
+	}
+	if intercept != nil || unknown {
+		return errors.New("rpc server: " + serviceMethod + " is not a registered method")
+	}
+	*reply = mType.schema()
+	return nil
+}
+
+//第一次使用时创建内置服务,服务名不是导出的名字,因此不经过newService
+func (server *Server) builtinService() *service {
+	server.builtinOnce.Do(func() {
+		b := &builtinService{server: server}
+		s := &service{
+			name:     BuiltinServiceName,
+			instance: reflect.ValueOf(b),
+			typ:      reflect.TypeOf(b),
+		}
+		_ = s.registerMethods(methodRules{})
+		s.commit(nil)
+		server.builtin = s
+	})
+	return server.builtin
+}
@@ -0,0 +1,109 @@
+package gorpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+)
+
+//服务端为请求查找方法的阶段,按SetDispatchPipeline设置的顺序依次执行
+//默认顺序为rewrite,intercept,typed,service,unknown
+//Interceptors包裹的是查找到的方法的调用,需要先解码参数,因此不属于查找阶段
+type DispatchStage int
+
+const (
+	//按MethodRewriter改写服务名和方法名,只影响之后的阶段
+	StageRewrite DispatchStage = iota
+	//按Intercept注册的前缀匹配,匹配时把原始消息体交给对应的handler,不再执行之后的阶段
+	StageIntercept
+	//查找RegisterTyped按参数类型注册的函数,服务名和方法名匹配时不再执行之后的阶段
+	StageTyped
+	//查找Register注册的服务
+	StageService
+	//交给UnknownMethodHandler处理,放在StageService之前时注册的服务不再生效
+	StageUnknown
+)
+
+//默认的查找顺序
+var defaultDispatchPipeline = []DispatchStage{StageRewrite, StageIntercept, StageTyped, StageService, StageUnknown}
+
+func (s DispatchStage) String() string {
+	switch s {
+	case StageRewrite:
+		return "rewrite"
+	case StageIntercept:
+		return "intercept"
+	case StageTyped:
+		return "typed"
+	case StageService:
+		return "service"
+	case StageUnknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("DispatchStage(%d)", int(s))
+}
+
+//设置查找方法的阶段和顺序,没有列出的阶段不再执行,不传参数时恢复默认的rewrite,intercept,typed,service,unknown
+func (server *Server) SetDispatchPipeline(stages ...DispatchStage) error {
+	if len(stages) == 0 {
+		stages = defaultDispatchPipeline
+	}
+	seen := make(map[DispatchStage]bool, len(stages))
+	for _, stage := range stages {
+		if stage < StageRewrite || stage > StageUnknown {
+			return fmt.Errorf("rpc server: invalid dispatch stage %v", stage)
+		}
+		if seen[stage] {
+			return fmt.Errorf("rpc server: duplicate dispatch stage %v", stage)
+		}
+		seen[stage] = true
+	}
+	server.dispatchPipeline.Store(append([]DispatchStage(nil), stages...))
+	return nil
+}
+
+//返回当前的查找顺序
+func (server *Server) DispatchPipeline() []DispatchStage {
+	if stages, ok := server.dispatchPipeline.Load().([]DispatchStage); ok {
+		return append([]DispatchStage(nil), stages...)
+	}
+	return append([]DispatchStage(nil), defaultDispatchPipeline...)
+}
+
+//按查找顺序为请求找到方法,intercept不为nil时交给Intercept注册的handler,unknown为true时交给UnknownMethodHandler处理
+func (server *Server) dispatch(h *codec.Header) (svc *service, mType *methodType, intercept InterceptHandler, unknown bool, err error) {
+	stages, ok := server.dispatchPipeline.Load().([]DispatchStage)
+	if !ok {
+		stages = defaultDispatchPipeline
+	}
+	err = errors.New("rpc server: can't find method: " + h.ServiceMethod)
+	for _, stage := range stages {
+		switch stage {
+		case StageRewrite:
+			if server.MethodRewriter != nil {
+				h.ServiceMethod = server.MethodRewriter(h.ServiceMethod)
+			}
+		case StageIntercept:
+			if intercept = server.findIntercept(h.ServiceMethod); intercept != nil {
+				return nil, nil, intercept, false, nil
+			}
+		case StageTyped:
+			//没有按类型注册时保留之前阶段的错误
+			if tsvc, tmType, typed, terr := server.findTyped(h); typed {
+				return tsvc, tmType, nil, false, terr
+			}
+		case StageService:
+			var serr error
+			if svc, mType, serr = server.findService(h.ServiceMethod); serr == nil {
+				return svc, mType, nil, false, nil
+			}
+			err = serr
+		case StageUnknown:
+			if server.UnknownMethodHandler != nil {
+				return nil, nil, nil, true, nil
+			}
+		}
+	}
+	//err总是非nil,调用方不会拿到nil的mType
+	return nil, nil, nil, false, err
+}
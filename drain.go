@@ -0,0 +1,76 @@
+package gorpc
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+//服务端的优雅关闭:关闭Accept正在使用的监听器使Accept返回,之后调用的Accept也立即返回,Drain之后服务端不能再接收连接
+//再按CloseConn的方式关闭所有已建立的连接,等已在处理的请求都响应后返回;只想暂时停止接收新连接时使用Pause
+//ctx结束时直接关闭剩余的连接并返回ctx.Err(),还在握手中的连接不受影响
+func (server *Server) Drain(ctx context.Context) error {
+	server.gate.close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	server.conns.Range(func(key, _ interface{}) bool {
+		wg.Add(1)
+		go func(connID uint64) {
+			defer wg.Done()
+			//CloseConn在ctx结束时关闭连接并返回,不会遗留等待的goroutine
+			if err := server.CloseConn(ctx, connID); err != nil && ctx.Err() != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}(key.(uint64))
+		return true
+	})
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+//收到sigs中的信号时调用Drain,等待时间为DrainTimeout,sigs为空时处理SIGINT和SIGTERM
+//Drain的结果写入返回的chan,只处理第一个收到的信号;ctx结束前没有收到信号时不再处理信号并关闭chan
+//收到信号之后ctx不影响Drain,可以多次调用以使用不同的ctx,每次调用都会在收到信号时Drain
+func (server *Server) HandleSignals(ctx context.Context, sigs ...os.Signal) <-chan error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, sigs...)
+	return server.drainOnSignal(ctx, received, func() { signal.Stop(received) })
+}
+
+//从received收到信号时Drain,收到信号或ctx结束时调用stop停止接收信号
+func (server *Server) drainOnSignal(ctx context.Context, received <-chan os.Signal, stop func()) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-received:
+			stop()
+		case <-ctx.Done():
+			stop()
+			close(done)
+			return
+		}
+		server.trace.printf("received signal %s, draining", sig)
+		drainCtx := context.Background()
+		if server.DrainTimeout > 0 {
+			var cancel context.CancelFunc
+			drainCtx, cancel = context.WithTimeout(drainCtx, server.DrainTimeout)
+			defer cancel()
+		}
+		done <- server.Drain(drainCtx)
+	}()
+	return done
+}
@@ -0,0 +1,102 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+)
+
+//响应的消息体为错误链时在响应头Metadata中的标记
+const ErrorChainKey = "error-chain"
+
+//name -> 哨兵错误,以及反向的映射,通信双方按名字识别同一个哨兵错误
+var (
+	sentinelLock   sync.RWMutex
+	sentinelByName = make(map[string]error)
+	sentinelNames  = make(map[error]string)
+)
+
+func init() {
+	RegisterSentinelError("io.EOF", io.EOF)
+	RegisterSentinelError("io.ErrUnexpectedEOF", io.ErrUnexpectedEOF)
+	RegisterSentinelError("os.ErrNotExist", os.ErrNotExist)
+	RegisterSentinelError("os.ErrExist", os.ErrExist)
+	RegisterSentinelError("os.ErrPermission", os.ErrPermission)
+	RegisterSentinelError("context.Canceled", context.Canceled)
+	RegisterSentinelError("context.DeadlineExceeded", context.DeadlineExceeded)
+}
+
+//注册可以跨连接识别的哨兵错误,服务端和客户端需要用相同的name注册
+func RegisterSentinelError(name string, err error) {
+	sentinelLock.Lock()
+	defer sentinelLock.Unlock()
+	sentinelByName[name] = err
+	sentinelNames[err] = name
+}
+
+//错误链中的一层
+type errorLink struct {
+	//该层的错误信息
+	Message string
+	//该层是已注册的哨兵错误时为其名字
+	Sentinel string
+}
+
+//序列化后的错误链,从最外层到最内层
+type errorChain struct {
+	Links []errorLink
+}
+
+//沿Unwrap展开错误链
+func newErrorChain(err error) errorChain {
+	var chain errorChain
+	sentinelLock.RLock()
+	defer sentinelLock.RUnlock()
+	for ; err != nil; err = errors.Unwrap(err) {
+		link := errorLink{Message: err.Error()}
+		//不可比较的错误类型不能作为map的key
+		if reflect.TypeOf(err).Comparable() {
+			link.Sentinel = sentinelNames[err]
+		}
+		chain.Links = append(chain.Links, link)
+	}
+	return chain
+}
+
+//还原出支持errors.Is的错误链,服务端的错误类型本身不会被还原
+func (c errorChain) build() error {
+	var next error
+	sentinelLock.RLock()
+	defer sentinelLock.RUnlock()
+	for i := len(c.Links) - 1; i >= 0; i-- {
+		link := c.Links[i]
+		next = &remoteError{
+			msg:      link.Message,
+			sentinel: sentinelByName[link.Sentinel],
+			next:     next,
+		}
+	}
+	return next
+}
+
+//客户端还原出的错误链中的一层
+type remoteError struct {
+	msg      string
+	sentinel error
+	next     error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.next
+}
+
+func (e *remoteError) Is(target error) bool {
+	return e.sentinel != nil && e.sentinel == target
+}
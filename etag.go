@@ -0,0 +1,59 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	//客户端缓存的响应的ETag在请求头Metadata中的key
+	IfNoneMatchKey = "if-none-match"
+	//方法返回的ETag在响应头Metadata中的key
+	ETagKey = "etag"
+	//响应未变化时在响应头Metadata中的标记,此时消息体为空
+	NotModifiedKey = "not-modified"
+)
+
+//响应与客户端缓存的ETag一致,reply没有被修改
+var ErrNotModified = errors.New("rpc client: not modified")
+
+//请求处理期间保存方法设置的ETag
+type etagHolder struct {
+	etag string
+}
+
+//在方法中设置响应的ETag,需要在方法返回前调用
+//与请求中的If-None-Match相同时,服务端不发送reply,客户端保留缓存的结果
+func SetETag(ctx context.Context, etag string) {
+	if holder, ok := ctx.Value(etagKey).(*etagHolder); ok {
+		holder.etag = etag
+	}
+}
+
+//根据方法设置的ETag处理响应头,返回是否可以省略消息体
+func applyETag(ctx context.Context, metadata map[string]string) bool {
+	ifNoneMatch := metadata[IfNoneMatchKey]
+	delete(metadata, IfNoneMatchKey)
+	holder, ok := ctx.Value(etagKey).(*etagHolder)
+	if !ok || holder.etag == "" {
+		return false
+	}
+	metadata[ETagKey] = holder.etag
+	if holder.etag != ifNoneMatch {
+		return false
+	}
+	metadata[NotModifiedKey] = "true"
+	return true
+}
+
+//带ETag的调用,etag为上一次调用返回的ETag,为空表示没有缓存
+//服务端数据未变化时返回ErrNotModified且不修改reply,调用方继续使用缓存;返回值为最新的ETag
+func (client *Client) CallETag(serviceMethod string, etag string, args, reply interface{}) (string, error) {
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	if etag != "" {
+		call.metadata = map[string]string{IfNoneMatchKey: etag}
+	}
+	client.start(call)
+	call = <-call.Done
+	return call.replyMetadata[ETagKey], call.Error
+}
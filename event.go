@@ -0,0 +1,96 @@
+package gorpc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//调用生命周期中的阶段
+type CallPhase int
+
+const (
+	//已分配序列号,等待发送
+	CallRegistered CallPhase = iota
+	//请求已完整写出
+	CallSent
+	//收到了该调用的第一个响应头
+	CallFirstByte
+	//调用成功结束
+	CallCompleted
+	//调用以错误结束
+	CallErrored
+)
+
+var callPhaseNames = map[CallPhase]string{
+	CallRegistered: "registered",
+	CallSent:       "sent",
+	CallFirstByte:  "first-byte",
+	CallCompleted:  "completed",
+	CallErrored:    "errored",
+}
+
+func (p CallPhase) String() string {
+	if name, ok := callPhaseNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+//调用生命周期的事件,通过Client.OnCallEvent获取
+type CallEvent struct {
+	//调用的序列号,注册前失败时为0
+	Seq uint64
+	//服务名和方法名
+	ServiceMethod string
+	//所处的阶段
+	Phase CallPhase
+	//事件发生的时间
+	Time time.Time
+	//CallErrored时调用的错误
+	Error error
+}
+
+//发出调用事件,OnCallEvent为nil时忽略
+func (client *Client) emitCallEvent(call *Call, phase CallPhase) {
+	if client.OnCallEvent == nil {
+		return
+	}
+	evt := CallEvent{Seq: call.Seq, ServiceMethod: call.ServiceMethod, Phase: phase, Time: time.Now()}
+	if phase == CallErrored {
+		evt.Error = call.Error
+	}
+	client.OnCallEvent(evt)
+}
+
+//结束调用,先按是否出错发出CallCompleted或CallErrored事件
+func (client *Client) finishCall(call *Call) {
+	if call.Error != nil {
+		client.emitCallEvent(call, CallErrored)
+	} else {
+		client.emitCallEvent(call, CallCompleted)
+	}
+	call.done()
+}
+
+//收到seq的第一个响应头时发出CallFirstByte事件,只由接收协程调用
+func (client *Client) markFirstByte(seq uint64) {
+	if client.OnCallEvent == nil {
+		return
+	}
+	client.lock.Lock()
+	call := client.pending[seq]
+	client.lock.Unlock()
+	if call != nil && !call.firstByte {
+		call.firstByte = true
+		//响应可能在发送协程发出CallSent前到达,先补发以保证事件的顺序
+		client.markSent(call)
+		client.emitCallEvent(call, CallFirstByte)
+	}
+}
+
+//请求写出后发出CallSent事件,发送协程和接收协程中先调用的一方发出
+func (client *Client) markSent(call *Call) {
+	if atomic.CompareAndSwapUint32(&call.sentEvent, 0, 1) {
+		client.emitCallEvent(call, CallSent)
+	}
+}
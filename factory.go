@@ -0,0 +1,47 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"reflect"
+)
+
+//以name为服务名注册factory创建的实例,用于需要注入依赖或保存连接状态的服务
+//每个连接第一次调用该服务时调用factory创建该连接独占的实例,之后该连接上的请求共用它,连接关闭后实例随之释放
+//factory每次必须返回相同类型的值,注册时会先调用一次factory来获取方法,该实例不会处理请求
+func (server *Server) RegisterFactory(name string, factory func() interface{}) error {
+	if !ast.IsExported(name) {
+		return fmt.Errorf("rpc: %q is not a valid service name", name)
+	}
+	prototype := factory()
+	if prototype == nil {
+		return fmt.Errorf("rpc: factory of %s returned nil", name)
+	}
+	s, err := newFilteredService(prototype, name, server.methodRules(nil))
+	if err != nil {
+		return err
+	}
+	s.factory = factory
+	return server.addService(s)
+}
+
+//获取ctx所在连接的实例,第一次获取时由factory创建
+func (s *service) scopedInstance(ctx context.Context) (reflect.Value, error) {
+	info := connInfoFromContext(ctx)
+	info.instancesLock.Lock()
+	defer info.instancesLock.Unlock()
+	if instance, ok := info.instances[s]; ok {
+		return instance, nil
+	}
+	created := s.factory()
+	if reflect.TypeOf(created) != s.typ {
+		return reflect.Value{}, fmt.Errorf("rpc server: factory of %s returned %T, want %s", s.name, created, s.typ)
+	}
+	instance := reflect.ValueOf(created)
+	if info.instances == nil {
+		info.instances = make(map[*service]reflect.Value)
+	}
+	info.instances[s] = instance
+	return instance, nil
+}
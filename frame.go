@@ -0,0 +1,289 @@
+package gorpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+//分帧发送的消息在Metadata中的标记,值为frameMore时后面还有同一seq的帧,frameLast为最后一帧
+//消息体先单独编码成[]byte再切成不超过MaxFrameBytes的帧,每帧单独从sendQueue获得发送权后排到队尾
+//因此一个很大的消息不会阻塞同一连接上其他的请求和响应,多个分帧的消息轮流发送
+const (
+	FrameKey  = "frame"
+	frameMore = "more"
+	frameLast = "last"
+)
+
+//分帧消息的完整消息体使用的协议,取第一个不为空的协议
+func frameCodecOf(types ...codec.Type) codec.Type {
+	for _, t := range types {
+		if t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+//把body编码后按maxBytes切成帧,未开启、协议不支持或编码后不超过maxBytes时返回nil
+//不超过maxBytes的消息交给普通的发送流程会再编码一次,换来对方没有开启分帧时小消息仍能正常收发
+func splitFrames(t codec.Type, body interface{}, maxBytes int) [][]byte {
+	if maxBytes <= 0 || !codec.SupportsBodyCodec(t) {
+		return nil
+	}
+	data, err := codec.Marshal(t, body)
+	//编码失败时交给普通的发送流程报告错误
+	if err != nil || len(data) <= maxBytes {
+		return nil
+	}
+	frames := make([][]byte, 0, (len(data)+maxBytes-1)/maxBytes)
+	for len(data) > maxBytes {
+		frames = append(frames, data[:maxBytes])
+		data = data[maxBytes:]
+	}
+	return append(frames, data)
+}
+
+func framesSize(frames [][]byte) int {
+	size := 0
+	for _, frame := range frames {
+		size += len(frame)
+	}
+	return size
+}
+
+//发送响应,开启MaxFrameBytes且reply编码后超过上限时分帧发送
+func (server *Server) sendReply(opt *Option, c codec.Codec, h *codec.Header, body interface{}, sendLock *sendQueue) time.Duration {
+	//去重记录中可能带有上次发送时的帧标记
+	delete(h.Metadata, FrameKey)
+	if h.Error != "" || body == interface{}(invalidRequest) || opt == nil {
+		return server.sendResponse(c, h, body, sendLock)
+	}
+	frames := splitFrames(frameCodecOf(h.ReplyCodec, opt.BodyCodec, opt.CodecType), body, server.MaxFrameBytes)
+	if frames == nil {
+		return server.sendResponse(c, h, body, sendLock)
+	}
+	//每帧都不超过MaxReplyBytes,需要按完整的消息体检查
+	if size := framesSize(frames); server.MaxReplyBytes > 0 && size > server.MaxReplyBytes {
+		h.Error = fmt.Sprintf("%v: framed reply %d bytes exceeds limit %d", codec.ErrBodyTooLarge, size, server.MaxReplyBytes)
+		return server.sendResponse(c, h, invalidRequest, sendLock)
+	}
+	var encodeTime time.Duration
+	last := len(frames) - 1
+	h.BodyCodec = h.ReplyCodec
+	h.Metadata[FrameKey] = frameMore
+	for _, frame := range frames[:last] {
+		sendLock.Lock()
+		err := c.Write(h, frame)
+		encodeTime += encodeTimeOf(c)
+		sendLock.Unlock()
+		if err != nil {
+			if server.trace.enabled() {
+				server.trace.printf("send seq=%d method=%s request-id=%s frame write error=%v", h.Seq, h.ServiceMethod, requestIDOf(h), err)
+			}
+			return encodeTime
+		}
+	}
+	h.Metadata[FrameKey] = frameLast
+	return encodeTime + server.sendResponse(c, h, frames[last], sendLock)
+}
+
+//每个连接上同时在拼接的分帧请求数上限,超过时关闭连接
+const maxPendingFramedRequests = 64
+
+//同时在拼接的分帧请求过多时返回的错误
+var errTooManyFramedRequests = errors.New("rpc server: too many framed requests in progress")
+
+//服务端没有开启MaxFrameBytes时分帧的请求返回的错误
+var errFramingDisabled = errors.New("rpc server: framed requests are disabled, set Server.MaxFrameBytes")
+
+//没有设置MaxRequestBytes时分帧请求拼接后的大小上限,避免不断追加的帧占满内存
+const DefaultMaxFramedRequestBytes = 64 << 20
+
+//一个还没有收齐的分帧请求
+type pendingFrames struct {
+	data []byte
+	//拼接后超过大小上限时丢弃已收到的数据,之后的帧读出后丢弃,收齐时请求返回该错误
+	err error
+}
+
+//服务端按seq缓存还没有收齐的请求帧
+type requestFrames map[uint64]*pendingFrames
+
+//读取一个请求帧,返回false表示还没有收齐;收齐时返回的Codec从拼接后的消息体中读取参数
+//enabled为false时丢弃各帧,收齐时该请求返回errFramingDisabled,连接仍可使用
+//maxBytes为拼接后消息体的大小上限,超过时该请求返回codec.ErrBodyTooLarge,连接仍可使用
+//budget为解码拼接后消息体的耗时上限,0表示不限制
+func (frames requestFrames) receive(opt *Option, c codec.Codec, h *codec.Header, enabled bool, maxBytes int, budget time.Duration) (codec.Codec, bool, error) {
+	var data []byte
+	target := interface{}(&data)
+	if !enabled {
+		target = nil
+	}
+	if err := c.ReadBody(target); err != nil {
+		return nil, false, err
+	}
+	pending := frames[h.Seq]
+	if pending == nil {
+		if len(frames) >= maxPendingFramedRequests {
+			return nil, false, errTooManyFramedRequests
+		}
+		pending = new(pendingFrames)
+		frames[h.Seq] = pending
+	}
+	if !enabled {
+		pending.err = errFramingDisabled
+	}
+	if pending.err == nil {
+		if size := len(pending.data) + len(data); size > maxBytes {
+			pending.data = nil
+			pending.err = fmt.Errorf("%w: framed request exceeds limit %d", codec.ErrBodyTooLarge, maxBytes)
+		} else {
+			pending.data = append(pending.data, data...)
+		}
+	}
+	if h.Metadata[FrameKey] == frameMore {
+		return nil, false, nil
+	}
+	delete(frames, h.Seq)
+	delete(h.Metadata, FrameKey)
+	var connCodec, defaultBody codec.Type
+	if opt != nil {
+		connCodec, defaultBody = opt.CodecType, opt.BodyCodec
+	}
+	return &assembledCodec{Codec: c, t: frameCodecOf(h.BodyCodec, defaultBody, connCodec), data: pending.data, err: pending.err, budget: budget}, true, nil
+}
+
+//从拼接好的分帧消息体中读取参数的Codec,其余方法使用连接的Codec
+type assembledCodec struct {
+	codec.Codec
+	t    codec.Type
+	data []byte
+	//拼接时发生的错误,读取消息体时返回
+	err error
+	//解码耗时上限,数据已在内存中,耗时不包括等待连接
+	budget time.Duration
+	//ReadBody解码的耗时
+	decodeTime time.Duration
+}
+
+func (c *assembledCodec) ReadBody(body interface{}) error {
+	if c.err != nil || body == nil {
+		return c.err
+	}
+	start := time.Now()
+	err := codec.Unmarshal(c.t, c.data, body)
+	c.decodeTime = time.Since(start)
+	if err == nil && c.budget > 0 && c.decodeTime > c.budget {
+		return codec.ErrDecodeBudget
+	}
+	return err
+}
+
+//实现codec.Timer,编码使用连接的Codec
+func (c *assembledCodec) LastEncodeTime() time.Duration {
+	return encodeTimeOf(c.Codec)
+}
+
+//实现codec.Timer
+func (c *assembledCodec) LastDecodeTime() time.Duration {
+	return c.decodeTime
+}
+
+//实现codec.RawBodyReader
+func (c *assembledCodec) ReadRawBody() ([]byte, error) {
+	return c.data, c.err
+}
+
+//请求的参数编码后超过Option.MaxFrameBytes时分帧发送,返回false表示不需要分帧
+func (client *Client) sendFrames(call *Call) bool {
+	opt := client.option
+	frames := splitFrames(frameCodecOf(call.bodyCodecOf(opt), opt.CodecType), call.Args, opt.MaxFrameBytes)
+	if frames == nil {
+		return false
+	}
+	client.sendLock.Lock()
+	seq, err := client.registerCall(call)
+	client.sendLock.Unlock()
+	if err != nil {
+		call.Error = err
+		client.finishCall(call)
+		return true
+	}
+	client.emitCallEvent(call, CallRegistered)
+	h := &codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           seq,
+		ArgType:       argTypeName(reflect.TypeOf(call.Args)),
+		BodyCodec:     call.bodyCodecOf(opt),
+		ReplyCodec:    opt.ReplyCodec,
+		Metadata:      map[string]string{RequestIDKey: client.requestIDPrefix + "-" + strconv.FormatUint(seq, 10)},
+	}
+	for k, v := range call.metadata {
+		h.Metadata[k] = v
+	}
+	last := len(frames) - 1
+	for i, frame := range frames {
+		h.Metadata[FrameKey] = frameMore
+		if i == last {
+			h.Metadata[FrameKey] = frameLast
+		}
+		client.sendLock.Lock()
+		written := client.conn.BytesWritten()
+		err := client.c.Write(h, frame)
+		call.bytesSent += client.conn.BytesWritten() - written
+		call.encodeTime += encodeTimeOf(client.c)
+		client.sendLock.Unlock()
+		if err != nil {
+			if client.trace.enabled() {
+				client.trace.printf("send seq=%d method=%s frame error=%v", seq, call.ServiceMethod, err)
+			}
+			if call := client.removeCall(seq); call != nil {
+				call.Error = err
+				client.finishCall(call)
+			}
+			return true
+		}
+	}
+	if client.trace.enabled() {
+		client.trace.printf("send seq=%d method=%s frames=%d bytes=%d", seq, call.ServiceMethod, len(frames), call.bytesSent)
+	}
+	client.markSent(call)
+	return true
+}
+
+//接收一个响应帧,调用不存在时丢弃
+func (client *Client) receiveFrame(seq uint64) error {
+	client.lock.Lock()
+	call := client.pending[seq]
+	client.lock.Unlock()
+	var data []byte
+	if err := client.c.ReadBody(&data); err != nil {
+		return err
+	}
+	if call != nil {
+		call.frames = append(call.frames, data...)
+	}
+	return nil
+}
+
+//读取最后一个响应帧,把拼接后的消息体解码到reply
+func (client *Client) receiveLastFrame(call *Call) (err error) {
+	var data []byte
+	if err = client.c.ReadBody(&data); err != nil {
+		return err
+	}
+	data = append(call.frames, data...)
+	call.frames = nil
+	opt := client.option
+	start := time.Now()
+	uerr := codec.Unmarshal(frameCodecOf(opt.ReplyCodec, opt.BodyCodec, opt.CodecType), data, call.Reply)
+	call.decodeTime = time.Since(start)
+	if uerr != nil {
+		call.Error = errors.New("reading body " + uerr.Error())
+	}
+	return nil
+}
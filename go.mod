@@ -1,3 +1,10 @@
 module github.com/TheR1sing3un/gorpc
 
-go 1.17
+go 1.18
+
+require (
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/gorilla/websocket v1.5.0
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
@@ -0,0 +1,50 @@
+package gorpc
+
+import (
+	"encoding/gob"
+	"log"
+	"reflect"
+	"sync"
+)
+
+//已经遍历过的类型,避免重复注册和递归类型的死循环
+var gobVisited sync.Map
+
+//遍历参数和返回值的类型,把其中出现的具名结构体注册到gob,这些值之后放进interface字段时不用再手动注册
+//只能找到静态声明的类型:interface字段里实际存放的类型在注册时无从得知,仍需要调用方自己gob.Register
+func registerGobTypes(t reflect.Type) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		registerGobTypes(t.Elem())
+		return
+	case reflect.Map:
+		registerGobTypes(t.Key())
+		registerGobTypes(t.Elem())
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if _, loaded := gobVisited.LoadOrStore(t, true); loaded {
+		return
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		registerGobType(t)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		//gob忽略未导出的字段
+		if field := t.Field(i); field.IsExported() {
+			registerGobTypes(field.Type)
+		}
+	}
+}
+
+//尽力注册,gob中已有同名的其他类型时gob.Register会panic,此时跳过
+func registerGobType(t reflect.Type) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc server: skip gob register %s: %v", t, r)
+		}
+	}()
+	gob.Register(reflect.Zero(t).Interface())
+}
@@ -0,0 +1,131 @@
+package gorpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//压缩握手解压后与压缩前的字节数之比的默认上限
+const DefaultMaxDecompressionRatio = 100
+
+//解压后的数据超过压缩比上限时的错误,防止很小的压缩数据解压出大量数据耗尽内存
+var ErrDecompressionRatio = errors.New("rpc: decompressed size exceeds ratio limit")
+
+//解压不超过该字节数时不检查压缩比,Option很小时压缩比本身没有意义
+const minRatioCheckBytes = 64 << 10
+
+//压缩握手的前缀字节,Json编码的Option不会以该字节开头,服务端据此区分压缩与未压缩的握手
+const compressedOptionPrefix byte = 0x01
+
+//发送Option,CompressHandshake为true时先写前缀字节,再写gzip压缩后的Json
+func writeOption(w io.Writer, opt *Option) error {
+	if !opt.CompressHandshake {
+		return json.NewEncoder(w).Encode(opt)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(compressedOptionPrefix)
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(opt); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	//一次写出,避免握手拆成多个小包
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+//读取Option,自动识别是否压缩,rest为握手之后的数据
+//maxRatio为压缩握手解压后的压缩比上限,小于等于0表示不限制
+func readOption(r io.Reader, maxRatio int) (opt Option, rest io.Reader, err error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	if err != nil {
+		return opt, nil, err
+	}
+	if b[0] == compressedOptionPrefix {
+		_, _ = br.ReadByte()
+		compressed := &byteCounter{r: br}
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			return opt, nil, err
+		}
+		//只读取一个gzip成员,之后的数据属于Codec
+		zr.Multistream(false)
+		decompressed := &ratioReader{r: zr, compressed: compressed, maxRatio: int64(maxRatio)}
+		if err := json.NewDecoder(decompressed).Decode(&opt); err != nil {
+			return opt, nil, err
+		}
+		//读完gzip的尾部并校验
+		if _, err := io.Copy(io.Discard, decompressed); err != nil {
+			return opt, nil, err
+		}
+		return opt, br, nil
+	}
+	//使用Json格式解析conn,并赋值给opt
+	dec := json.NewDecoder(br)
+	if err := dec.Decode(&opt); err != nil {
+		return opt, nil, err
+	}
+	//json解码器可能多读了option之后的数据,需要将其拼回连接前面再交给Codec
+	rest = io.MultiReader(dec.Buffered(), br)
+	//json.Encoder会在option后追加一个换行符,需要跳过
+	nl := make([]byte, 1)
+	if _, err := io.ReadFull(rest, nl); err != nil {
+		return opt, nil, err
+	}
+	if nl[0] != '\n' {
+		rest = io.MultiReader(bytes.NewReader(nl), rest)
+	}
+	return opt, rest, nil
+}
+
+//统计从bufio.Reader读取的字节数,实现io.ByteReader使gzip不再多包一层缓冲而读过压缩数据的末尾
+type byteCounter struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+//解压数据的Reader,解压出的字节数超过压缩字节数的maxRatio倍时返回ErrDecompressionRatio
+type ratioReader struct {
+	r          io.Reader
+	compressed *byteCounter
+	maxRatio   int64
+	//已解压出的字节数
+	n int64
+	//超过上限后一直返回该错误,调用方忽略错误继续读取时也不会再解压
+	err error
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.maxRatio > 0 && r.n > minRatioCheckBytes && r.n > r.maxRatio*r.compressed.n {
+		r.err = fmt.Errorf("%w: %d bytes from %d compressed bytes", ErrDecompressionRatio, r.n, r.compressed.n)
+		return n, r.err
+	}
+	return n, err
+}
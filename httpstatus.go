@@ -0,0 +1,78 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+)
+
+//可以映射为HTTP状态码的通用错误,方法用fmt.Errorf("...: %w", ErrNotFound)等方式返回
+//它们注册为哨兵错误,服务端开启EncodeErrorChains后客户端可以用errors.Is识别
+var (
+	ErrInvalidArgument  = errors.New("rpc: invalid argument")
+	ErrUnauthenticated  = errors.New("rpc: unauthenticated")
+	ErrPermissionDenied = errors.New("rpc: permission denied")
+	ErrNotFound         = errors.New("rpc: not found")
+	ErrAlreadyExists    = errors.New("rpc: already exists")
+	ErrUnavailable      = errors.New("rpc: unavailable")
+)
+
+//错误 -> HTTP状态码,按注册顺序匹配
+var (
+	httpStatusLock sync.RWMutex
+	httpStatuses   []errorStatus
+)
+
+type errorStatus struct {
+	err    error
+	status int
+}
+
+func init() {
+	for _, s := range []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"gorpc.ErrInvalidArgument", ErrInvalidArgument, http.StatusBadRequest},
+		{"gorpc.ErrUnauthenticated", ErrUnauthenticated, http.StatusUnauthorized},
+		{"gorpc.ErrPermissionDenied", ErrPermissionDenied, http.StatusForbidden},
+		{"gorpc.ErrNotFound", ErrNotFound, http.StatusNotFound},
+		{"gorpc.ErrAlreadyExists", ErrAlreadyExists, http.StatusConflict},
+		{"gorpc.ErrUnavailable", ErrUnavailable, http.StatusServiceUnavailable},
+	} {
+		RegisterSentinelError(s.name, s.err)
+		RegisterHTTPStatus(s.err, s.status)
+	}
+	RegisterHTTPStatus(os.ErrNotExist, http.StatusNotFound)
+	RegisterHTTPStatus(os.ErrPermission, http.StatusForbidden)
+	RegisterHTTPStatus(context.DeadlineExceeded, http.StatusGatewayTimeout)
+	RegisterHTTPStatus(ErrCallTimeout, http.StatusGatewayTimeout)
+	RegisterHTTPStatus(ErrShutdown, http.StatusServiceUnavailable)
+	RegisterHTTPStatus(ErrMethodBusy, http.StatusTooManyRequests)
+}
+
+//把err映射为status,err需要是可以用errors.Is识别的哨兵错误,跨连接时还需要用RegisterSentinelError注册
+func RegisterHTTPStatus(err error, status int) {
+	httpStatusLock.Lock()
+	defer httpStatusLock.Unlock()
+	httpStatuses = append(httpStatuses, errorStatus{err: err, status: status})
+}
+
+//把调用返回的错误转换成HTTP状态码,便于在rpc之上实现HTTP网关
+//nil返回200,没有注册的错误返回500
+func ErrorToHTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	httpStatusLock.RLock()
+	defer httpStatusLock.RUnlock()
+	for _, s := range httpStatuses {
+		if errors.Is(err, s.err) {
+			return s.status
+		}
+	}
+	return http.StatusInternalServerError
+}
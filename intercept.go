@@ -0,0 +1,84 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//按前缀拦截请求的处理函数,body是未解码的请求消息体,返回的[]byte是已编码的响应消息体
+type InterceptHandler func(ctx context.Context, h *codec.Header, body []byte) ([]byte, error)
+
+//一个拦截前缀
+type interceptRoute struct {
+	prefix  string
+	handler InterceptHandler
+}
+
+//Intercept注册的前缀,按前缀长度从长到短排列
+type interceptRoutes struct {
+	lock   sync.RWMutex
+	routes []interceptRoute
+}
+
+//拦截服务名和方法名以prefix开头的请求交给handler处理,用于网关和透明代理,默认在MethodRewriter改写之后,查找注册的服务之前,参见StageIntercept
+//body按请求的消息体协议编码(Header.BodyCodec,没有时为连接的协议),gob的消息体带有连接上收到过的类型定义,可以单独解码
+//handler返回的[]byte应当按响应的消息体协议(Header.ReplyCodec,没有时同上)编码,原样发给客户端,只支持gob和json
+//多个前缀匹配时最长的优先,同一前缀再次调用时替换之前的handler,handler为nil时取消该前缀的拦截
+func (server *Server) Intercept(prefix string, handler InterceptHandler) {
+	r := &server.intercepts
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	routes := make([]interceptRoute, 0, len(r.routes)+1)
+	for _, route := range r.routes {
+		if route.prefix != prefix {
+			routes = append(routes, route)
+		}
+	}
+	if handler != nil {
+		routes = append(routes, interceptRoute{prefix: prefix, handler: handler})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	r.routes = routes
+}
+
+//查找拦截serviceMethod的handler,没有时返回nil
+func (server *Server) findIntercept(serviceMethod string) InterceptHandler {
+	r := &server.intercepts
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, route := range r.routes {
+		if strings.HasPrefix(serviceMethod, route.prefix) {
+			return route.handler
+		}
+	}
+	return nil
+}
+
+//调用拦截的handler,返回的消息体作为唯一的最后一帧发送,客户端按响应的消息体协议直接解码
+func (server *Server) handleIntercept(ctx context.Context, c codec.Codec, req *request, sendLock *sendQueue) {
+	reply, err := req.intercept(ctx, req.h, req.raw)
+	if err == nil {
+		var connCodec, defaultBody codec.Type
+		if opt, ok := OptionFromContext(ctx); ok {
+			connCodec, defaultBody = opt.CodecType, opt.BodyCodec
+		}
+		if t := frameCodecOf(req.h.ReplyCodec, defaultBody, connCodec); !codec.SupportsBodyCodec(t) {
+			err = fmt.Errorf("rpc server: intercepted reply of %s can't be sent as %q body", req.h.ServiceMethod, t)
+		}
+	}
+	var body interface{} = reply
+	if err != nil {
+		req.h.Error = err.Error()
+		body = invalidRequest
+	} else {
+		req.h.Metadata[FrameKey] = frameLast
+	}
+	encodeTime := server.sendResponse(c, req.h, body, sendLock)
+	server.reportStats(req, encodeTime)
+}
@@ -0,0 +1,40 @@
+package gorpc
+
+import "context"
+
+//拦截器能看到的请求信息
+type RequestInfo struct {
+	//请求的服务方法名
+	ServiceMethod string
+	//请求头中的元数据
+	Metadata map[string]string
+	//解码后的请求参数
+	Args interface{}
+}
+
+//包裹方法调用的拦截器,通过next继续调用,传给next的ctx会一直传到方法中
+//可以用context.WithValue在ctx中放入鉴权后的用户等请求级别的值,接收context.Context的方法可以读取
+type Interceptor func(ctx context.Context, info *RequestInfo, next func(ctx context.Context) error) error
+
+//依次经过Interceptors后调用方法
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	call := func(ctx context.Context) error {
+		return req.service.call(ctx, req.mType, req.argv, req.replyv)
+	}
+	if len(server.Interceptors) == 0 {
+		return call(ctx)
+	}
+	info := &RequestInfo{
+		ServiceMethod: req.h.ServiceMethod,
+		Metadata:      req.h.Metadata,
+		Args:          req.argv.Interface(),
+	}
+	//从最后一个拦截器开始向前包裹,第一个拦截器最先执行
+	for i := len(server.Interceptors) - 1; i >= 0; i-- {
+		interceptor, next := server.Interceptors[i], call
+		call = func(ctx context.Context) error {
+			return interceptor(ctx, info, next)
+		}
+	}
+	return call(ctx)
+}
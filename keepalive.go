@@ -0,0 +1,109 @@
+package gorpc
+
+import (
+	"github.com/TheR1sing3un/gorpc/codec"
+	"sync"
+	"time"
+)
+
+//标记保活消息的元数据key,值为keepalivePing或keepalivePong
+//保活消息的Seq固定为0,调用从不使用0作为序列号,因此不会与调用的响应混淆
+const KeepaliveKey = "keepalive"
+
+const (
+	keepalivePing = "ping"
+	keepalivePong = "pong"
+)
+
+//计算RTT移动平均时新样本的权重,与TCP的SRTT相同取1/8
+const rttWeight = 0.125
+
+//客户端测量的往返时延
+type rttStats struct {
+	lock sync.Mutex
+	//已发出且还未收到pong的ping的发送时间,为零值时表示没有等待中的ping
+	sent time.Time
+	//往返时延的移动平均,还没有样本时为0
+	avg time.Duration
+}
+
+//记录ping的发送时间,已有等待中的ping时返回false,保证同时只有一个ping
+func (r *rttStats) start(now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.sent.IsZero() {
+		return false
+	}
+	r.sent = now
+	return true
+}
+
+//取消发送失败的ping
+func (r *rttStats) cancel() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sent = time.Time{}
+}
+
+//收到pong时更新移动平均
+func (r *rttStats) finish(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sent.IsZero() {
+		return
+	}
+	sample := now.Sub(r.sent)
+	r.sent = time.Time{}
+	if r.avg == 0 {
+		r.avg = sample
+		return
+	}
+	r.avg += time.Duration(rttWeight * float64(sample-r.avg))
+}
+
+func (r *rttStats) value() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.avg
+}
+
+//返回保活ping测得的往返时延的移动平均,没有开启KeepaliveInterval或还没有测量到时返回0
+func (client *Client) RTT() time.Duration {
+	return client.rtt.value()
+}
+
+//按interval定时发送ping,直到客户端不可用
+func (client *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !client.IsAvailable() {
+			return
+		}
+		client.ping()
+	}
+}
+
+//发送一个ping,上一个ping还没有收到pong时跳过
+func (client *Client) ping() {
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	if !client.rtt.start(time.Now()) {
+		return
+	}
+	h := &codec.Header{Metadata: map[string]string{KeepaliveKey: keepalivePing}}
+	if err := client.c.Write(h, invalidRequest); err != nil {
+		client.trace.printf("send ping error=%v", err)
+		client.rtt.cancel()
+	}
+}
+
+//回应客户端的ping,原样带回请求头
+func (server *Server) pong(c codec.Codec, h *codec.Header, sendLock *sendQueue) error {
+	if err := c.ReadBody(nil); err != nil {
+		return err
+	}
+	h.Metadata = map[string]string{KeepaliveKey: keepalivePong}
+	server.sendResponse(c, h, invalidRequest, sendLock)
+	return nil
+}
@@ -0,0 +1,94 @@
+package gorpc
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//处理耗时直方图的桶上限(秒)
+var metricsBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//单个方法的统计,字段都用原子操作更新
+type methodMetrics struct {
+	total  uint64
+	errors uint64
+	//耗时之和(纳秒)
+	durationSum uint64
+	//每个桶内(不累计)的请求数,最后一个为超过所有桶上限的请求
+	buckets []uint64
+}
+
+//按方法名统计请求数,错误数和耗时
+type serverMetrics struct {
+	//serviceMethod -> *methodMetrics
+	methods sync.Map
+}
+
+func (m *serverMetrics) record(serviceMethod string, duration time.Duration, failed bool) {
+	v, ok := m.methods.Load(serviceMethod)
+	if !ok {
+		v, _ = m.methods.LoadOrStore(serviceMethod, &methodMetrics{buckets: make([]uint64, len(metricsBuckets)+1)})
+	}
+	mm := v.(*methodMetrics)
+	atomic.AddUint64(&mm.total, 1)
+	if failed {
+		atomic.AddUint64(&mm.errors, 1)
+	}
+	atomic.AddUint64(&mm.durationSum, uint64(duration))
+	i := sort.SearchFloat64s(metricsBuckets, duration.Seconds())
+	atomic.AddUint64(&mm.buckets[i], 1)
+}
+
+//按Prometheus文本格式输出
+func (m *serverMetrics) writeTo(b *strings.Builder) {
+	var names []string
+	m.methods.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	get := func(name string) *methodMetrics {
+		v, _ := m.methods.Load(name)
+		return v.(*methodMetrics)
+	}
+	b.WriteString("# HELP gorpc_requests_total Total number of handled requests.\n")
+	b.WriteString("# TYPE gorpc_requests_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(b, "gorpc_requests_total{method=%q} %d\n", name, atomic.LoadUint64(&get(name).total))
+	}
+	b.WriteString("# HELP gorpc_request_errors_total Total number of requests that returned an error.\n")
+	b.WriteString("# TYPE gorpc_request_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(b, "gorpc_request_errors_total{method=%q} %d\n", name, atomic.LoadUint64(&get(name).errors))
+	}
+	b.WriteString("# HELP gorpc_request_duration_seconds Request handling latency.\n")
+	b.WriteString("# TYPE gorpc_request_duration_seconds histogram\n")
+	for _, name := range names {
+		mm := get(name)
+		var cumulative uint64
+		for i, le := range metricsBuckets {
+			cumulative += atomic.LoadUint64(&mm.buckets[i])
+			fmt.Fprintf(b, "gorpc_request_duration_seconds_bucket{method=%q,le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&mm.buckets[len(metricsBuckets)])
+		fmt.Fprintf(b, "gorpc_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", name, cumulative)
+		fmt.Fprintf(b, "gorpc_request_duration_seconds_sum{method=%q} %g\n", name, time.Duration(atomic.LoadUint64(&mm.durationSum)).Seconds())
+		fmt.Fprintf(b, "gorpc_request_duration_seconds_count{method=%q} %d\n", name, cumulative)
+	}
+}
+
+//返回按Prometheus文本格式输出各方法请求数,错误数和耗时直方图的http.Handler,不依赖Prometheus的客户端库
+func (server *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		server.metrics.writeTo(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+	})
+}
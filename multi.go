@@ -0,0 +1,88 @@
+package gorpc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+//在同一个监听地址上按Option中的CodecType把连接分给不同的Server
+type MultiServer struct {
+	//CodecType -> Server
+	servers map[codec.Type]*Server
+	//没有匹配的CodecType时使用的Server,为nil时关闭连接
+	Default *Server
+	//等待客户端发送Option的超时时间,0表示不限制
+	HandshakeTimeout time.Duration
+}
+
+func NewMultiServer() *MultiServer {
+	return &MultiServer{servers: make(map[codec.Type]*Server)}
+}
+
+//CodecType为codecType的连接交给server处理,返回自身便于链式调用
+func (m *MultiServer) Handle(codecType codec.Type, server *Server) *MultiServer {
+	m.servers[codecType] = server
+	return m
+}
+
+func (m *MultiServer) Accept(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("rpc server: accept error:", err)
+			}
+			return
+		}
+		go m.ServeConn(conn)
+	}
+}
+
+//读取Option选出Server,再把已读取的数据拼回连接前面,由选出的Server从头完成握手
+func (m *MultiServer) ServeConn(conn io.ReadWriteCloser) {
+	deadlineConn, canDeadline := conn.(readDeadlineConn)
+	if canDeadline && m.HandshakeTimeout > 0 {
+		_ = deadlineConn.SetReadDeadline(time.Now().Add(m.HandshakeTimeout))
+	}
+	var peeked bytes.Buffer
+	opt, _, err := readOption(io.TeeReader(conn, &peeked), DefaultMaxDecompressionRatio)
+	if err != nil {
+		log.Println("rpc server: options error:", err)
+		_ = conn.Close()
+		return
+	}
+	if canDeadline && m.HandshakeTimeout > 0 {
+		_ = deadlineConn.SetReadDeadline(time.Time{})
+	}
+	server := m.servers[opt.CodecType]
+	if server == nil {
+		server = m.Default
+	}
+	if server == nil {
+		log.Printf("rpc server: no server for codec type %s", opt.CodecType)
+		_ = conn.Close()
+		return
+	}
+	rest := io.MultiReader(&peeked, conn)
+	//保留net.Conn的方法,使Server仍可以设置超时,获取对端地址
+	if c, ok := conn.(net.Conn); ok {
+		server.ServeConn(&replayConn{Reader: rest, Conn: c})
+		return
+	}
+	server.ServeConn(&handshakeConn{Reader: rest, ReadWriteCloser: conn})
+}
+
+//先读出已被读取的数据,再从原连接读取的net.Conn
+type replayConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
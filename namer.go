@@ -0,0 +1,42 @@
+package gorpc
+
+import (
+	"strings"
+	"unicode"
+)
+
+//注册时把结构体名和方法名映射为请求中使用的服务名和方法名,用于适配其他语言的客户端,如foo.sum
+//同一个结构体的所有方法需要映射到同一个服务名,客户端需要使用映射后的名字调用
+type MethodNamer func(structName, methodName string) (service, method string)
+
+//保持Go的名字不变,如Foo.Sum
+func IdentityMethodNamer(structName, methodName string) (string, string) {
+	return structName, methodName
+}
+
+//全部转为小写,如Foo.Sum -> foo.sum
+func LowercaseMethodNamer(structName, methodName string) (string, string) {
+	return strings.ToLower(structName), strings.ToLower(methodName)
+}
+
+//转为下划线分隔的小写,如HTTPServer.GetUserName -> http_server.get_user_name
+func SnakeCaseMethodNamer(structName, methodName string) (string, string) {
+	return snakeCase(structName), snakeCase(methodName)
+}
+
+//在单词的边界插入下划线,连续的大写字母(如HTTP)视为一个单词
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
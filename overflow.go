@@ -0,0 +1,143 @@
+package gorpc
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//连接数达到Server.MaxConnections时对新连接的处理策略
+type ConnectionOverflowPolicy int
+
+const (
+	//立即关闭新连接
+	OverflowReject ConnectionOverflowPolicy = iota
+	//新连接排队等待空出的名额,超过Server.OverflowQueueTimeout仍没有名额时关闭,超时为0时一直等待
+	OverflowQueue
+	//关闭最久没有读写且没有正在处理的请求的连接,为新连接腾出名额,没有空闲连接时关闭新连接
+	OverflowCloseOldestIdle
+)
+
+//一个已占用名额的连接
+type connSlot struct {
+	//原始连接,淘汰时关闭
+	conn io.Closer
+	//最近一次读到消息的时间,UnixNano
+	lastActive int64
+	//正在处理的请求数
+	inFlight int64
+}
+
+//记录一次活动,slot为nil时忽略
+func (s *connSlot) touch() {
+	if s != nil {
+		atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+	}
+}
+
+//调整正在处理的请求数,slot为nil时忽略
+func (s *connSlot) addInFlight(delta int64) {
+	if s != nil {
+		atomic.AddInt64(&s.inFlight, delta)
+	}
+}
+
+//限制服务端同时处理的连接数
+type connLimiter struct {
+	once sync.Once
+	//名额,容量为MaxConnections
+	sem chan struct{}
+	//保护slots
+	lock sync.Mutex
+	//占用名额的连接
+	slots map[*connSlot]struct{}
+	//OverflowQueue策略下正在等待名额的连接数
+	queued int64
+}
+
+func (server *Server) connLimiter() *connLimiter {
+	l := &server.limiter
+	l.once.Do(func() {
+		l.sem = make(chan struct{}, server.MaxConnections)
+		l.slots = make(map[*connSlot]struct{})
+	})
+	return l
+}
+
+//按OverflowPolicy为连接申请名额,返回false时应关闭连接
+func (server *Server) admitConn(conn io.Closer) (*connSlot, bool) {
+	l := server.connLimiter()
+	select {
+	case l.sem <- struct{}{}:
+		return l.add(conn), true
+	default:
+	}
+	switch server.OverflowPolicy {
+	case OverflowQueue:
+		var timeout <-chan time.Time
+		if server.OverflowQueueTimeout > 0 {
+			timer := time.NewTimer(server.OverflowQueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		atomic.AddInt64(&l.queued, 1)
+		defer atomic.AddInt64(&l.queued, -1)
+		select {
+		case l.sem <- struct{}{}:
+			return l.add(conn), true
+		case <-timeout:
+			return nil, false
+		}
+	case OverflowCloseOldestIdle:
+		if !l.closeOldestIdle() {
+			return nil, false
+		}
+		//被关闭的连接退出后释放名额
+		l.sem <- struct{}{}
+		return l.add(conn), true
+	default:
+		return nil, false
+	}
+}
+
+func (l *connLimiter) add(conn io.Closer) *connSlot {
+	slot := &connSlot{conn: conn}
+	slot.touch()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.slots[slot] = struct{}{}
+	return slot
+}
+
+//连接退出后释放名额
+func (l *connLimiter) release(slot *connSlot) {
+	l.lock.Lock()
+	delete(l.slots, slot)
+	l.lock.Unlock()
+	<-l.sem
+}
+
+//关闭最久没有活动的空闲连接,没有空闲连接时返回false
+func (l *connLimiter) closeOldestIdle() bool {
+	l.lock.Lock()
+	var oldest *connSlot
+	for slot := range l.slots {
+		if atomic.LoadInt64(&slot.inFlight) > 0 {
+			continue
+		}
+		if oldest == nil || atomic.LoadInt64(&slot.lastActive) < atomic.LoadInt64(&oldest.lastActive) {
+			oldest = slot
+		}
+	}
+	//移出后不会被再次选中,名额在连接退出时释放
+	if oldest != nil {
+		delete(l.slots, oldest)
+	}
+	l.lock.Unlock()
+	if oldest == nil {
+		return false
+	}
+	_ = oldest.conn.Close()
+	return true
+}
@@ -0,0 +1,122 @@
+package gorpc
+
+import (
+	"net"
+	"sync"
+)
+
+//控制Accept循环是否继续接收新连接
+type acceptGate struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	//Drain之后为true,不再接收新连接
+	closed bool
+	//正在Accept的监听器,Drain时关闭
+	listeners map[net.Listener]struct{}
+	//Accept启动的处理连接的goroutine
+	serving sync.WaitGroup
+}
+
+func (g *acceptGate) init() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.lock)
+	}
+}
+
+func (g *acceptGate) set(paused bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.init()
+	g.paused = paused
+	g.cond.Broadcast()
+}
+
+func (g *acceptGate) isPaused() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused
+}
+
+func (g *acceptGate) isClosed() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.closed
+}
+
+//暂停期间阻塞,已关闭时返回false
+func (g *acceptGate) wait() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.init()
+	for g.paused && !g.closed {
+		g.cond.Wait()
+	}
+	return !g.closed
+}
+
+//记录Accept正在使用的监听器,已关闭时返回false
+func (g *acceptGate) track(lis net.Listener) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	if g.listeners == nil {
+		g.listeners = make(map[net.Listener]struct{})
+	}
+	g.listeners[lis] = struct{}{}
+	return true
+}
+
+func (g *acceptGate) untrack(lis net.Listener) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.listeners, lis)
+}
+
+//不再接收新连接:关闭所有监听器使Accept返回,唤醒暂停中的Accept
+func (g *acceptGate) close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.init()
+	g.closed = true
+	for lis := range g.listeners {
+		_ = lis.Close()
+	}
+	g.cond.Broadcast()
+}
+
+//暂停接收新连接,已建立的连接不受影响,新连接在恢复之前排队等待
+func (server *Server) Pause() {
+	server.gate.set(true)
+}
+
+//恢复接收新连接
+func (server *Server) Resume() {
+	server.gate.set(false)
+}
+
+//服务端的运行状态
+type ServerStats struct {
+	//是否暂停接收新连接
+	Paused bool
+	//是否已调用Drain,不再接收新连接
+	Draining bool
+	//当前的连接数
+	Connections int
+	//正在处理的请求数
+	InFlight int
+}
+
+func (server *Server) Stats() ServerStats {
+	stats := ServerStats{Paused: server.gate.isPaused(), Draining: server.gate.isClosed()}
+	server.conns.Range(func(_, _ interface{}) bool {
+		stats.Connections++
+		return true
+	})
+	server.inFlightLock.Lock()
+	stats.InFlight = len(server.inFlight)
+	server.inFlightLock.Unlock()
+	return stats
+}
@@ -0,0 +1,186 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"reflect"
+	"sync"
+)
+
+//开启Ordered时在方法中通过CallClient回调自己所在的连接返回的错误
+var ErrCallClientOrdered = errors.New("rpc server: can't call back the same connection from a handler when Ordered is set")
+
+//服务端的一个连接,服务端通过它向客户端发起调用
+type serverConn struct {
+	//连接id
+	id uint64
+	//连接的codec
+	c codec.Codec
+	//与响应共用的发送锁
+	sendLock *sendQueue
+	//保护seq,pending和closed
+	lock sync.Mutex
+	//服务端发起的调用的序列号
+	seq uint64
+	//服务端发起的未完成调用
+	pending map[uint64]*Call
+	//连接是否已关闭
+	closed bool
+	//是否正在通过CloseConn关闭,之后到达的请求直接返回ErrConnClosing
+	draining bool
+	//正在处理的请求数,受lock保护
+	active int
+	//正在关闭且active降为0时关闭,受lock保护
+	drained chan struct{}
+	//按seq登记的等待客户端确认的流式响应,连接不再可读后为nil
+	windows map[uint64]*streamWindow
+}
+
+//登记连接
+func (server *Server) trackConn(ctx context.Context, c codec.Codec, sendLock *sendQueue) *serverConn {
+	sc := &serverConn{
+		id:       connInfoFromContext(ctx).id,
+		c:        c,
+		sendLock: sendLock,
+		seq:      1,
+		pending:  make(map[uint64]*Call),
+		windows:  make(map[uint64]*streamWindow),
+	}
+	server.conns.Store(sc.id, sc)
+	return sc
+}
+
+//取消登记连接,并结束该连接上服务端发起的未完成调用
+func (server *Server) untrackConn(sc *serverConn) {
+	server.conns.Delete(sc.id)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.closed = true
+	for seq, call := range sc.pending {
+		delete(sc.pending, seq)
+		call.Error = ErrShutdown
+		call.done()
+	}
+}
+
+//注册服务端发起的调用
+func (sc *serverConn) registerCall(call *Call) (uint64, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.closed {
+		return 0, ErrShutdown
+	}
+	call.Seq = sc.seq
+	sc.pending[call.Seq] = call
+	sc.seq++
+	return call.Seq, nil
+}
+
+func (sc *serverConn) removeCall(seq uint64) *Call {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	call := sc.pending[seq]
+	delete(sc.pending, seq)
+	return call
+}
+
+//读取客户端对服务端发起的调用的响应,返回的错误表示连接已不可用
+func (sc *serverConn) receiveReply(h *codec.Header) error {
+	call := sc.removeCall(h.Seq)
+	switch {
+	case call == nil:
+		return sc.c.ReadBody(nil)
+	case h.Error != "":
+		call.Error = errors.New(h.Error)
+		err := sc.c.ReadBody(nil)
+		call.done()
+		return err
+	default:
+		err := sc.c.ReadBody(call.Reply)
+		if err != nil {
+			call.Error = errors.New("reading body " + err.Error())
+		}
+		call.done()
+		return err
+	}
+}
+
+//通过某个连接调用客户端注册的方法(见Client.Register),等待客户端返回结果,ctx结束时放弃等待
+//connID可以在方法中通过ConnIDFromContext获得
+//开启Ordered时连接上的请求在读取循环中依次处理,方法中回调自己所在的连接会读不到响应,因此直接返回ErrCallClientOrdered
+func (server *Server) CallClient(ctx context.Context, connID uint64, serviceMethod string, args, reply interface{}) error {
+	v, ok := server.conns.Load(connID)
+	if !ok {
+		return fmt.Errorf("rpc server: connection %d not found", connID)
+	}
+	sc := v.(*serverConn)
+	if server.Ordered && connInfoFromContext(ctx).id == connID {
+		return ErrCallClientOrdered
+	}
+	if isNil(reply) {
+		return ErrNilReply
+	}
+	if isNil(args) {
+		args = emptyArgs
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	seq, err := sc.registerCall(call)
+	if err != nil {
+		return err
+	}
+	h := &codec.Header{
+		ServiceMethod: serviceMethod,
+		Seq:           seq,
+		ArgType:       argTypeName(reflect.TypeOf(args)),
+		Reverse:       true,
+	}
+	sc.sendLock.Lock()
+	err = sc.c.Write(h, args)
+	sc.sendLock.Unlock()
+	if err != nil {
+		sc.removeCall(seq)
+		return err
+	}
+	select {
+	case call = <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		sc.removeCall(seq)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrCallTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+//在客户端注册一个实例,使服务端可以通过Server.CallClient回调它的方法,方法签名要求与服务端相同
+func (client *Client) Register(instance interface{}) error {
+	return client.handlers.Register(instance)
+}
+
+//处理服务端发起的调用,响应沿用请求头(Reverse为true)发回服务端
+//方法的context在Close或连接断开时取消
+func (client *Client) serveReverse(h *codec.Header) {
+	req, err := client.handlers.readRequest(client.c, h)
+	if err != nil {
+		req.h.Error = err.Error()
+		go client.handlers.sendResponse(client.c, req.h, invalidRequest, &client.sendLock)
+		return
+	}
+	//与Close互斥,Close开始等待后不再登记新的回调
+	client.lock.Lock()
+	if client.closed {
+		client.lock.Unlock()
+		return
+	}
+	client.handlerWG.Add(1)
+	client.lock.Unlock()
+	go client.handlers.handleRequest(client.handlerCtx, client.c, req, &client.sendLock, &client.handlerWG)
+}
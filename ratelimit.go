@@ -0,0 +1,45 @@
+package gorpc
+
+import "time"
+
+//令牌桶,只在一个连接的读取协程中使用,不需要加锁
+type tokenBucket struct {
+	//每秒补充的令牌数
+	rate float64
+	//桶的容量
+	burst float64
+	//当前的令牌数
+	tokens float64
+	//上一次补充令牌的时间
+	last time.Time
+}
+
+//burst<=0时容量取每秒的令牌数(至少为1)
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+//取一个令牌,没有令牌时阻塞到补充出一个令牌为止
+func (b *tokenBucket) wait() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return
+	}
+	delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	time.Sleep(delay)
+	b.tokens = 0
+	b.last = now.Add(delay)
+}
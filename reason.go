@@ -0,0 +1,64 @@
+package gorpc
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+//连接关闭的原因
+type CloseReason int
+
+const (
+	//未知原因
+	UnknownReason CloseReason = iota
+	//客户端主动关闭
+	ClientClosed
+	//服务端主动关闭
+	ServerClosed
+	//报文解析失败
+	DecodeError
+	//读写超时
+	Timeout
+	//认证失败
+	AuthFailed
+	//MagicNumber不匹配
+	MagicMismatch
+	//读写的字节数超过预算
+	BudgetExceeded
+)
+
+var closeReasonNames = map[CloseReason]string{
+	UnknownReason:  "unknown",
+	ClientClosed:   "client closed",
+	ServerClosed:   "server closed",
+	DecodeError:    "decode error",
+	Timeout:        "timeout",
+	AuthFailed:     "auth failed",
+	MagicMismatch:  "magic mismatch",
+	BudgetExceeded: "budget exceeded",
+}
+
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+//根据读写连接时的错误推断关闭原因,peerClosed为对端关闭连接时应返回的原因
+func closeReasonOf(err error, peerClosed CloseReason) CloseReason {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return UnknownReason
+	case errors.Is(err, ErrConnBudgetExceeded):
+		return BudgetExceeded
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return peerClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return Timeout
+	default:
+		return DecodeError
+	}
+}
@@ -0,0 +1,83 @@
+package gorpc
+
+import (
+	"go/ast"
+	"reflect"
+)
+
+//一个方法的参数和返回值的类型描述
+type MethodSchema struct {
+	ArgType   TypeSchema
+	ReplyType TypeSchema
+}
+
+//类型描述
+type TypeSchema struct {
+	//类型名,如 gorpc.Args, *int
+	Name string
+	//类型种类,如 struct, ptr, int
+	Kind string
+	//指针,slice,数组和map的元素类型
+	Elem *TypeSchema `json:",omitempty"`
+	//map的key类型
+	Key *TypeSchema `json:",omitempty"`
+	//结构体的导出字段
+	Fields []FieldSchema `json:",omitempty"`
+}
+
+//结构体字段描述
+type FieldSchema struct {
+	Name string
+	//字段类型名
+	Type string
+	//字段类型种类
+	Kind string
+}
+
+//导出所有已注册方法的参数和返回值类型,key为 <service>.<method>,便于外部工具生成客户端代码
+//按参数类型注册的方法(RegisterTyped)不包含在内
+func (server *Server) ExportSchema() map[string]MethodSchema {
+	schemas := make(map[string]MethodSchema)
+	server.serviceMap.Range(func(_, v interface{}) bool {
+		svc := v.(*service)
+		for name, mType := range svc.method {
+			schemas[svc.name+"."+name] = mType.schema()
+		}
+		return true
+	})
+	return schemas
+}
+
+//方法的类型描述
+func (m *methodType) schema() MethodSchema {
+	return MethodSchema{
+		ArgType:   typeSchemaOf(m.ArgType),
+		ReplyType: typeSchemaOf(m.ReplyType),
+	}
+}
+
+//通过反射生成类型描述,结构体只展开一层字段,避免递归类型无限展开
+func typeSchemaOf(t reflect.Type) TypeSchema {
+	ts := TypeSchema{Name: t.String(), Kind: t.Kind().String()}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		elem := typeSchemaOf(t.Elem())
+		ts.Elem = &elem
+	case reflect.Map:
+		key, elem := typeSchemaOf(t.Key()), typeSchemaOf(t.Elem())
+		ts.Key, ts.Elem = &key, &elem
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !ast.IsExported(field.Name) {
+				continue
+			}
+			ts.Fields = append(ts.Fields, FieldSchema{
+				Name: field.Name,
+				Type: field.Type.String(),
+				Kind: field.Type.Kind().String(),
+			})
+		}
+	}
+	return ts
+}
@@ -0,0 +1,41 @@
+package gorpc
+
+import "sync"
+
+//连接上发送消息的队列,等待者按到达顺序依次获得发送权
+//sync.Mutex不把锁交给等待者,分帧发送的响应每帧释放后立即重新获取时,等待中的其他响应可能要等到所有帧发完
+//这里释放时直接交给最早的等待者,重新获取的一方排到队尾,不同seq的帧和其他消息轮流发送
+type sendQueue struct {
+	lock sync.Mutex
+	//是否有人持有发送权
+	busy bool
+	//等待发送权的chan,获得时被关闭
+	waiters []chan struct{}
+}
+
+func (q *sendQueue) Lock() {
+	q.lock.Lock()
+	if !q.busy {
+		q.busy = true
+		q.lock.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	q.waiters = append(q.waiters, ready)
+	q.lock.Unlock()
+	<-ready
+}
+
+//有等待者时把发送权交给最早的一个,busy保持为true
+func (q *sendQueue) Unlock() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.waiters) == 0 {
+		q.busy = false
+		return
+	}
+	next := q.waiters[0]
+	q.waiters[0] = nil
+	q.waiters = q.waiters[1:]
+	close(next)
+}
@@ -0,0 +1,47 @@
+package gorpc
+
+//保留的序列号区间[start, end)
+type seqRange struct {
+	start, end uint64
+}
+
+//从客户端的序列号空间中保留n个连续的序列号并返回第一个,客户端自己的调用不会再使用它们
+//用于在同一个Client上复用的子协议各自管理序列号,用完后通过ReleaseSeqRange归还
+func (client *Client) ReserveSeqRange(n uint64) (start uint64) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for client.seq == 0 || client.skipReserved() {
+		client.seq++
+	}
+	start = client.seq
+	if n == 0 {
+		return start
+	}
+	client.reserved = append(client.reserved, seqRange{start: start, end: start + n})
+	client.seq = start + n
+	return start
+}
+
+//归还ReserveSeqRange保留的以start开头的区间,之后客户端可以重新分配这些序列号,返回是否找到该区间
+func (client *Client) ReleaseSeqRange(start uint64) bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for i, r := range client.reserved {
+		if r.start == start {
+			client.reserved = append(client.reserved[:i], client.reserved[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//client.seq位于保留的区间内时跳到区间的最后一个序列号并返回true,由调用方再加一,调用时需持有lock
+func (client *Client) skipReserved() bool {
+	for _, r := range client.reserved {
+		if client.seq >= r.start && client.seq < r.end {
+			client.seq = r.end - 1
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,20 @@
 package gorpc
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/TheR1sing3un/gorpc/codec"
+	"go/ast"
 	"io"
 	"log"
 	"net"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const MagicNumber = 0x3bef5c
@@ -20,6 +25,39 @@ type Option struct {
 	MagicNumber int
 	//协议类型
 	CodecType codec.Type
+	//是否对TCP连接禁用Nagle算法,仅在客户端本地生效,不参与协商
+	//Go创建的*net.TCPConn默认已禁用Nagle,该选项只对被改回开启Nagle的连接(如自定义Dialer)有影响,false时不修改连接设置
+	NoDelay bool `json:"-"`
+	//客户端发送一个请求的超时时间,0表示不限制,仅在客户端本地生效
+	SendTimeout time.Duration `json:"-"`
+	//客户端的标识,服务端开启DedupWindow时按(ClientID, Session, 方法名, seq)去重
+	ClientID string `json:",omitempty"`
+	//客户端会话的标识,ClientID不为空时NewClient为每个客户端随机生成并随握手发送,设置的值会被忽略
+	//同一ClientID的新客户端的seq从头开始,按会话区分后不会得到之前客户端的结果
+	Session string `json:",omitempty"`
+	//消息体的协议,为空时与CodecType相同,握手时协商,是连接上双方消息体的默认协议,也随每个请求头发送
+	BodyCodec codec.Type `json:",omitempty"`
+	//是否在每个消息体后附加CRC32校验和,握手时协商,校验失败的调用返回codec.ErrChecksumMismatch
+	Checksum bool `json:",omitempty"`
+	//希望响应消息体使用的协议,为空时与CodecType相同,随每个请求头发送
+	ReplyCodec codec.Type `json:"-"`
+	//是否用gzip压缩握手的Option,适用于频繁重连的低速链路,服务端自动识别,仅在客户端本地生效
+	CompressHandshake bool `json:"-"`
+	//客户端发送保活ping的间隔,同时用于测量RTT,0表示不发送,仅在客户端本地生效
+	KeepaliveInterval time.Duration `json:"-"`
+	//不为nil时把连接读写的原始字节(包括握手)复制到该Writer,用于排查协议问题,仅在客户端本地生效
+	WireTap io.Writer `json:"-"`
+	//不为nil时从握手开始把客户端的协议事件写入该Writer,之后可以通过Client.TraceTo修改,仅在客户端本地生效
+	Trace io.Writer `json:"-"`
+	//请求参数编码后超过该字节数时分帧发送,不阻塞同一连接上的其他请求,0表示不分帧,仅在客户端本地生效
+	//服务端需要开启Server.MaxFrameBytes,否则分帧的请求返回错误
+	MaxFrameBytes int `json:"-"`
+	//codec读写缓冲区的大小,适合消息普遍较大的连接,握手时发给服务端,双方按该值分配缓冲区,0表示使用默认大小
+	//需要Codec实现codec.BufferSizer,服务端按不超过Server.MaxBufferSize和codec.MaxBufferSize的值分配
+	BufferSize int `json:",omitempty"`
+	//消息体按CodecType编码失败时改用的协议,如gob无法编码的类型改用json,握手时协商,双方的Codec都按该协议重试
+	//需要Codec实现codec.FallbackSetter,重试的消息通过消息头的BodyCodec告知对端
+	FallbackCodec codec.Type `json:",omitempty"`
 }
 
 //默认Option构造
@@ -32,30 +70,232 @@ var DefaultOption = &Option{
 type Server struct {
 	//保存service
 	serviceMap sync.Map
+	//内置服务,第一次使用时创建
+	builtinOnce sync.Once
+	builtin     *service
+	//是否对接收的TCP连接禁用Nagle算法,默认不修改连接设置
+	//Go的Listener接收的*net.TCPConn默认已禁用Nagle,该选项只对被改回开启Nagle的连接(如自定义Listener)有影响
+	NoDelay bool
+	//每个方法通过校验注册时的回调,可用于预先创建按方法区分的监控指标
+	OnRegisterMethod func(serviceName, methodName string, mt *methodType)
+	//连接完成握手后的回调,tlsState为TLS连接握手后的状态,不是TLS连接时为nil
+	OnConnect func(conn io.ReadWriteCloser, tlsState *tls.ConnectionState)
+	//连接关闭时的回调,reason为关闭原因
+	OnDisconnect func(conn io.ReadWriteCloser, reason CloseReason)
+	//等待客户端发送Option的超时时间,0表示不限制
+	HandshakeTimeout time.Duration
+	//每个请求处理完成后的统计回调
+	OnStats func(stats CallStats)
+	//是否在同一个连接上按到达顺序依次处理请求,开启后同一连接的请求不再并发处理
+	Ordered bool
+	//是否复用请求参数的对象,开启后方法返回后不能再持有参数(包括其中的指针,map和slice)
+	ReuseArgs bool
+	//是否复用返回值的对象,开启后方法不能在返回后继续持有reply,reply中的slice和map会保留上一次的容量
+	ReuseReplies bool
+	//每个连接上已读取但响应还未发送完的请求数上限,达到上限后暂停读取新请求,0表示不限制
+	MaxPendingResponses int
+	//注册时设置服务名和方法名,如LowercaseMethodNamer使客户端按foo.sum调用,需要在注册服务之前设置,为nil时使用Go的名字
+	MethodNamer MethodNamer
+	//分发前改写请求的服务名和方法名,可用于方法的版本和别名,不需要改写时返回原值
+	MethodRewriter func(serviceMethod string) string
+	//请求头编码后的大小上限,超过时关闭连接,0表示使用codec.DefaultMaxHeaderBytes,小于0表示不限制
+	MaxHeaderBytes int
+	//按客户端Option.BufferSize分配缓冲区时的上限,0表示使用codec.DefaultBufferSize,即不按客户端的声明扩大
+	MaxBufferSize int
+	//HandleSignals收到信号后等待连接关闭的时间,0表示一直等待
+	DrainTimeout time.Duration
+	//不为nil时把每个连接读写的原始字节(TLS连接为解密后的数据)复制到该Writer,用于排查协议问题,会降低性能
+	WireTap io.Writer
+	//保护WireTap的并发写入
+	tapLock sync.Mutex
+	//压缩握手解压后的压缩比上限,0表示使用DefaultMaxDecompressionRatio,小于0表示不限制
+	MaxDecompressionRatio int
+	//解码一个请求参数的耗时上限,不包括等待连接数据的时间,超过时不再调用方法而是返回ErrDecodeBudget,0表示不限制
+	//读取过程中超过时解码被中断并关闭连接,需要Codec实现codec.DecodeBudgeter,否则拒绝连接
+	MaxDecodeTime time.Duration
+	//请求消息体编码后的大小上限,超过时跳过该消息体并返回错误,连接仍可使用,0表示不限制,分帧的请求按拼接后的大小计算
+	//json和cbor的消息体没有长度前缀,读取过程中超过时解码被中断,返回错误后关闭连接
+	//需要Codec实现codec.BodyLimiter,否则拒绝连接
+	MaxRequestBytes int
+	//响应消息体编码后的大小上限,超过时不发送该响应而是返回错误,0表示不限制,分帧的响应按拼接前的大小计算
+	//需要Codec实现codec.BodyLimiter,否则拒绝连接
+	MaxReplyBytes int
+	//是否提供内置的_rpc_.Describe,客户端可以查询方法的参数和返回值类型,默认关闭,避免向客户端暴露服务端的类型信息
+	EnableDescribe bool
+	//按顺序包裹每次方法调用的拦截器,第一个最先执行
+	Interceptors []Interceptor
+	//找不到服务或方法时的处理函数,body为未解码的消息体,返回值作为响应,为nil时返回找不到方法的错误
+	//gob连接的body带有连接上收到过的类型定义,可以用gob.NewDecoder单独解码
+	UnknownMethodHandler func(ctx context.Context, h *codec.Header, body []byte) (interface{}, error)
+	//方法的并发数达到SetMethodConcurrency设置的上限时是否直接返回ErrMethodBusy,默认排队等待
+	RejectOverConcurrency bool
+	//响应编码后超过该字节数时分帧发送,很大的响应不会阻塞同一连接上的其他响应,0表示不分帧
+	//同时决定是否接收客户端分帧的请求,为0时分帧的请求返回错误,拼接后的大小受MaxRequestBytes限制,没有设置时为DefaultMaxFramedRequestBytes
+	MaxFrameBytes int
+	//Accept同时处理的连接数上限,0表示不限制
+	MaxConnections int
+	//连接数达到MaxConnections时对新连接的处理策略,默认立即关闭
+	OverflowPolicy ConnectionOverflowPolicy
+	//OverflowQueue策略下新连接等待名额的超时时间,0表示一直等待
+	OverflowQueueTimeout time.Duration
+	//连接名额
+	limiter connLimiter
+	//正在处理的请求数达到该值时Accept直接关闭新连接以减轻负载,请求数降下来后恢复,0表示不限制
+	ShedInFlight int
+	//OverflowQueue策略下等待名额的连接数达到该值时Accept直接关闭新连接,0表示不限制
+	ShedQueueDepth int
+	//每个连接读写的字节数之和的上限(包括握手),超过时关闭连接,关闭原因为BudgetExceeded,0表示不限制
+	MaxConnBytes uint64
+	//每个服务注册的方法数上限,超过时注册失败,0表示不限制
+	MaxMethodsPerService int
+	//每个连接每秒处理的请求数上限,超过时暂停读取该连接上的请求,0表示不限制
+	MaxConnQPS float64
+	//每个连接允许的突发请求数,0表示与MaxConnQPS相同
+	ConnBurst int
+	//每个客户端会话记录最近处理过的请求数,重复的(方法名, seq)直接返回之前的结果而不再执行,0表示不去重
+	//客户端通过Client.Retry重发请求,没有取得执行名额(如ErrMethodBusy)的请求不记录,重试时仍会执行
+	DedupWindow int
+	//去重记录
+	dedup dedupStore
+	//按方法统计的指标,通过MetricsHandler输出
+	metrics serverMetrics
+	//暂停和恢复接收新连接
+	gate acceptGate
+	//是否把方法返回的错误沿Unwrap展开后随响应发送,客户端可以对已注册的哨兵错误使用errors.Is
+	EncodeErrorChains bool
+	//方法运行超过该时间时记录日志并回调OnSlowHandler,调用本身不受影响,0表示不检查
+	SlowHandlerThreshold time.Duration
+	//方法运行超过SlowHandlerThreshold时的回调,elapsed为已运行的时间
+	OnSlowHandler func(serviceMethod string, elapsed time.Duration)
+	//是否在方法运行超过SlowHandlerThreshold时取消它的context,只有第一个参数为context.Context的方法能感知到
+	CancelSlowHandlers bool
+	//CategoryFast方法的超时时间,0表示使用DefaultFastMethodTimeout
+	FastMethodTimeout time.Duration
+	//CategorySlow方法的超时时间,0表示使用DefaultSlowMethodTimeout
+	SlowMethodTimeout time.Duration
+	//连接id的分配计数
+	connSeq uint64
+	//保护inFlight
+	inFlightLock sync.Mutex
+	//正在处理的请求
+	inFlight map[inFlightKey]*inFlightEntry
+	//serviceMethod -> *typedMethods,按参数类型分发的处理函数
+	typed sync.Map
+	//协议事件追踪
+	trace tracer
+	//连接id -> *serverConn,用于服务端向客户端发起调用
+	conns sync.Map
+	//SetDispatchPipeline设置的查找顺序,保存[]DispatchStage,为空时使用默认顺序
+	dispatchPipeline atomic.Value
+	//Intercept注册的前缀
+	intercepts interceptRoutes
+}
+
+//正在处理中的请求信息
+type InFlightRequest struct {
+	//请求所在连接的id
+	ConnID uint64
+	//请求的序列号
+	Seq uint64
+	//服务名和方法名
+	ServiceMethod string
+	//开始处理的时间
+	Start time.Time
+	//客户端地址
+	RemoteAddr string
+}
+
+//同一个连接上seq唯一,因此用连接id和seq来定位一个请求
+type inFlightKey struct {
+	connID uint64
+	seq    uint64
+}
+
+type inFlightEntry struct {
+	info   InFlightRequest
+	cancel context.CancelFunc
+}
+
+//单次请求的统计信息
+type CallStats struct {
+	//服务名和方法名
+	ServiceMethod string
+	//解码请求参数的耗时,由Codec统计,不包括阻塞在连接上等待数据的时间,Codec不支持codec.Timer时为0
+	DecodeTime time.Duration
+	//编码响应的耗时,分帧和流式响应为各条消息之和,不包括写出到连接的时间,Codec不支持codec.Timer时为0
+	EncodeTime time.Duration
+	//从读到请求头到响应发送完成的总耗时
+	Duration time.Duration
+	//错误信息,成功时为空
+	Error string
+	//上次统计之后连接的编码缓冲区在写出前的最大字节数,Codec不支持时为0
+	BufferHighWater int
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{trace: tracer{prefix: "rpc server"}}
 }
 
 //默认Server实例
 var DefaultServer = NewServer()
 
 //实现Accept方法
+//Drain时关闭lis并返回,Drain之后调用时立即返回
 func (server *Server) Accept(lis net.Listener) {
+	if !server.gate.track(lis) {
+		return
+	}
+	defer server.gate.untrack(lis)
 	//for循环不断处理Accept的连接,并且使用协程处理
 	for {
 		//从listener接收连接
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			//Drain或调用方关闭监听器是正常的退出
+			if !server.gate.isClosed() && !errors.Is(err, net.ErrClosed) {
+				log.Println("rpc server: accept error:", err)
+			}
+			return
+		}
+		//暂停期间已接收的连接也等到恢复后再处理,其余连接留在监听队列中,等待期间Drain时关闭该连接
+		if !server.gate.wait() {
+			_ = conn.Close()
 			return
 		}
-		//协程处理每个连接
-		go server.ServeConn(conn)
+		//过载时直接关闭,新连接不再占用握手和排队的资源
+		if reason, shed := server.overloaded(); shed {
+			log.Printf("rpc server: overloaded (%s), close %s", reason, conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		server.gate.serving.Add(1)
+		go server.serveAccepted(conn)
 	}
 }
 
+//处理Accept接收的连接
+func (server *Server) serveAccepted(conn net.Conn) {
+	defer server.gate.serving.Done()
+	if server.MaxConnections > 0 {
+		server.serveLimitedConn(conn)
+		return
+	}
+	//协程处理每个连接
+	server.ServeConn(conn)
+}
+
+//申请到连接名额后再处理连接
+func (server *Server) serveLimitedConn(conn net.Conn) {
+	slot, ok := server.admitConn(conn)
+	if !ok {
+		log.Printf("rpc server: too many connections, close %s", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	defer server.connLimiter().release(slot)
+	server.serveConn(conn, slot)
+}
+
 //默认Accept方法,使用默认实例
 func Accept(lis net.Listener) {
 	DefaultServer.Accept(lis)
@@ -63,15 +303,75 @@ func Accept(lis net.Listener) {
 
 //将某个实例的service注册到server
 func (server *Server) Register(instance interface{}) error {
-	s := newService(instance)
-	//将service加入到map
+	s, err := newFilteredService(instance, "", server.methodRules(nil))
+	if err != nil {
+		return err
+	}
+	return server.addService(s)
+}
+
+//注册方法时使用的规则,names为nil时注册全部合法的方法
+func (server *Server) methodRules(names map[string]bool) methodRules {
+	return methodRules{names: names, namer: server.MethodNamer, max: server.MaxMethodsPerService}
+}
+
+//将service加入到map,方法数上限在注册方法时已经检查过,加入成功后才注册gob类型和调用OnRegisterMethod
+func (server *Server) addService(s *service) error {
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		//若已经存在
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	s.commit(server.OnRegisterMethod)
 	return nil
 }
 
+//只注册iface声明的方法,iface为接口类型的指针,如(*Reader)(nil),instance需要实现该接口
+func (server *Server) RegisterAs(iface interface{}, instance interface{}) error {
+	t := reflect.TypeOf(iface)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("rpc server: RegisterAs needs a pointer to an interface, got %T", iface)
+	}
+	t = t.Elem()
+	if !reflect.TypeOf(instance).Implements(t) {
+		return fmt.Errorf("rpc server: %T does not implement %s", instance, t)
+	}
+	allowed := make(map[string]bool, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		allowed[t.Method(i).Name] = true
+	}
+	s, err := newFilteredService(instance, "", server.methodRules(allowed))
+	if err != nil {
+		return err
+	}
+	return server.addService(s)
+}
+
+//把instance的部分方法以name为服务名注册,同一个实例可以按不同的服务名分别注册不同的方法
+func (server *Server) RegisterPartition(name string, instance interface{}, methods []string) error {
+	if !ast.IsExported(name) {
+		return fmt.Errorf("rpc: %q is not a valid service name", name)
+	}
+	allowed := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		allowed[method] = true
+	}
+	s, err := newFilteredService(instance, name, server.methodRules(allowed))
+	if err != nil {
+		return err
+	}
+	//s.method的key可能已被MethodNamer改写,按Go的方法名检查
+	registered := make(map[string]bool, len(s.method))
+	for _, mt := range s.method {
+		registered[mt.method.Name] = true
+	}
+	for _, method := range methods {
+		if !registered[method] {
+			return fmt.Errorf("rpc: %T has no rpc method %s", instance, method)
+		}
+	}
+	return server.addService(s)
+}
+
 //注册进默认的server中
 func Register(instance interface{}) error {
 	return DefaultServer.Register(instance)
@@ -88,6 +388,9 @@ func (server *Server) findService(serverMethod string) (svc *service, mType *met
 	serviceName, methodName := serverMethod[:dot], serverMethod[dot+1:]
 	//先根据service名获取service
 	serviceInterface, ok := server.serviceMap.Load(serviceName)
+	if serviceName == BuiltinServiceName && server.EnableDescribe {
+		serviceInterface, ok = server.builtinService(), true
+	}
 	if !ok {
 		err = errors.New("rpc server: can't find service: " + serviceName)
 		return
@@ -102,60 +405,373 @@ func (server *Server) findService(serverMethod string) (svc *service, mType *met
 	return
 }
 
+//设置方法的reply为slice或map时预分配的容量,适合返回结果大小基本固定的方法,n为0时取消预分配
+func (server *Server) SetReplyCapacity(serviceMethod string, n int) error {
+	if n < 0 {
+		return fmt.Errorf("rpc server: invalid reply capacity %d", n)
+	}
+	_, mType, err := server.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	kind := mType.ReplyType.Elem().Kind()
+	if kind != reflect.Slice && kind != reflect.Map {
+		return fmt.Errorf("rpc server: reply of %s is %s, not slice or map", serviceMethod, kind)
+	}
+	atomic.StoreInt64(&mType.replyCap, int64(n))
+	return nil
+}
+
+//为方法设置创建arg的构造函数,代替每次请求的反射创建,适合调用频繁的方法,factory为nil时恢复反射创建
+//factory每次需返回新的指针: arg为指针类型时返回该类型,否则返回指向arg类型的指针
+func (server *Server) SetArgFactory(serviceMethod string, factory func() interface{}) error {
+	_, mType, err := server.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	if factory == nil {
+		mType.argFactory.Store((func() interface{})(nil))
+		return nil
+	}
+	want := mType.ArgType
+	if want.Kind() != reflect.Ptr {
+		want = reflect.PtrTo(want)
+	}
+	if got := reflect.TypeOf(factory()); got != want {
+		return fmt.Errorf("rpc server: arg factory of %s returns %v, want %v", serviceMethod, got, want)
+	}
+	mType.argFactory.Store(factory)
+	return nil
+}
+
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
-	//最后关闭连接
+	server.serveConn(conn, nil)
+}
+
+//slot为连接占用的名额,不限制连接数时为nil
+func (server *Server) serveConn(conn io.ReadWriteCloser, slot *connSlot) {
+	rawConn := conn
+	reason := UnknownReason
+	//最后关闭连接,并通知关闭原因
 	defer func() {
+		server.trace.printf("connection closed: %s", reason)
 		_ = conn.Close()
+		if server.OnDisconnect != nil {
+			server.OnDisconnect(rawConn, reason)
+		}
 	}()
-	var opt Option
-	//使用Json格式解析conn,并赋值给opt
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	if server.NoDelay {
+		setNoDelay(conn)
+	}
+	//设置握手的读超时,防止连接后不发送Option的客户端一直占用协程
+	deadlineConn, canDeadline := conn.(readDeadlineConn)
+	if canDeadline && server.HandshakeTimeout > 0 {
+		_ = deadlineConn.SetReadDeadline(time.Now().Add(server.HandshakeTimeout))
+	}
+	//TLS连接先完成握手,记录下是否复用了会话等信息
+	tlsState, err := tlsHandshake(conn)
+	if err != nil {
+		log.Println("rpc server: tls handshake error:", err)
+		reason = closeReasonOf(err, AuthFailed)
+		return
+	}
+	if server.WireTap != nil {
+		conn = newTapConn(conn, server.WireTap, &server.tapLock)
+	}
+	//统计连接读写的字节数,用完预算后读写都会失败
+	if server.MaxConnBytes > 0 {
+		counted := newCountingConn(conn)
+		counted.budget = server.MaxConnBytes
+		conn = counted
+	}
+	opt, rest, err := readOption(conn, server.maxDecompressionRatio())
+	if err != nil {
 		log.Println("rpc server: options error:", err)
+		reason = closeReasonOf(err, ClientClosed)
 		return
 	}
 	//验证MagicNumber(传来的是否和本机的相等)
 	if opt.MagicNumber != MagicNumber {
 		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+		reason = MagicMismatch
 		return
 	}
 	//根据opt中传来的CodecType来获取到构造方法
 	newCodecFunc := codec.NewCodeFuncMap[opt.CodecType]
 	if newCodecFunc == nil {
 		log.Printf("rpc server: invalid codec type %x", opt.CodecType)
+		reason = DecodeError
 		return
 	}
+	//握手完成,取消读超时
+	if canDeadline && server.HandshakeTimeout > 0 {
+		_ = deadlineConn.SetReadDeadline(time.Time{})
+	}
+	conn = &handshakeConn{
+		Reader:          rest,
+		ReadWriteCloser: conn,
+	}
+	if server.trace.enabled() {
+		server.trace.printf("handshake remote=%s codec=%s", remoteAddrOf(rawConn), opt.CodecType)
+	}
+	//为连接分配id,连接信息通过context传递给每个请求
+	ctx := context.WithValue(context.Background(), connInfoKey, &connInfo{
+		id:         atomic.AddUint64(&server.connSeq, 1),
+		remoteAddr: remoteAddrOf(rawConn),
+		option:     &opt,
+		tls:        tlsState,
+		slot:       slot,
+	})
 	//返回该构造方法使用该连接构造出来的Codec
-	server.serveCodec(newCodecFunc(conn))
+	cc := newCodecFunc(conn)
+	if opt.BodyCodec != "" {
+		setter, ok := cc.(codec.BodyCodecSetter)
+		if !ok || !codec.SupportsBodyCodec(opt.BodyCodec) {
+			log.Printf("rpc server: invalid body codec type %s", opt.BodyCodec)
+			reason = DecodeError
+			return
+		}
+		setter.SetBodyCodec(opt.BodyCodec)
+	}
+	if opt.Checksum {
+		setter, ok := cc.(codec.ChecksumSetter)
+		if !ok || !codec.SupportsChecksum(opt.CodecType) {
+			log.Printf("rpc server: codec type %s does not support checksum", opt.CodecType)
+			reason = DecodeError
+			return
+		}
+		setter.SetChecksum(true)
+	}
+	if opt.FallbackCodec != "" {
+		if !codec.SupportsBodyCodec(opt.FallbackCodec) {
+			log.Printf("rpc server: invalid fallback codec type %s", opt.FallbackCodec)
+			reason = DecodeError
+			return
+		}
+		if setter, ok := cc.(codec.FallbackSetter); ok {
+			setter.SetFallbackBodyCodec(opt.FallbackCodec)
+		}
+	}
+	if sizer, ok := cc.(codec.BufferSizer); ok && opt.BufferSize > 0 {
+		sizer.SetBufferSize(server.bufferSizeOf(&opt))
+	}
+	if limiter, ok := cc.(codec.HeaderLimiter); ok && server.MaxHeaderBytes != 0 {
+		limiter.SetMaxHeaderBytes(server.MaxHeaderBytes)
+	}
+	if server.MaxRequestBytes > 0 || server.MaxReplyBytes > 0 {
+		limiter, ok := cc.(codec.BodyLimiter)
+		if !ok {
+			log.Printf("rpc server: codec type %s does not support MaxRequestBytes and MaxReplyBytes", opt.CodecType)
+			reason = DecodeError
+			return
+		}
+		limiter.SetMaxReadBodyBytes(server.MaxRequestBytes)
+		limiter.SetMaxWriteBodyBytes(server.MaxReplyBytes)
+	}
+	if server.MaxDecodeTime > 0 {
+		budgeter, ok := cc.(codec.DecodeBudgeter)
+		if !ok {
+			log.Printf("rpc server: codec type %s does not support MaxDecodeTime", opt.CodecType)
+			reason = DecodeError
+			return
+		}
+		budgeter.SetDecodeBudget(server.MaxDecodeTime)
+	}
+	if server.OnConnect != nil {
+		server.OnConnect(rawConn, tlsState)
+	}
+	reason = server.serveCodec(ctx, cc)
+}
+
+//可以设置读超时的连接,net.Conn实现了该接口
+type readDeadlineConn interface {
+	SetReadDeadline(t time.Time) error
+}
+
+//可以设置TCP_NODELAY的连接,*net.TCPConn实现了该接口
+type noDelayConn interface {
+	SetNoDelay(noDelay bool) error
+}
+
+//若连接支持则禁用Nagle算法,小包可以立即发送
+func setNoDelay(conn interface{}) {
+	if c, ok := conn.(noDelayConn); ok {
+		if err := c.SetNoDelay(true); err != nil {
+			log.Println("rpc: set no delay error:", err)
+		}
+	}
+}
+
+//握手之后的连接,先读完握手时多读的缓存数据,再从原连接读取
+type handshakeConn struct {
+	io.Reader
+	io.ReadWriteCloser
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
 }
 
 var invalidRequest = struct{}{}
 
-//根据Codec来处理
-func (server *Server) serveCodec(codec codec.Codec) {
+//根据Codec来处理,ctx中携带连接信息,返回连接关闭的原因
+func (server *Server) serveCodec(ctx context.Context, codec codec.Codec) CloseReason {
+	var reason CloseReason
 	//发送消息的锁,确保并发下可以依次回复,避免多个回复报文交织在一起导致客户端无法解析
-	sendLock := new(sync.Mutex)
+	sendLock := new(sendQueue)
 	wg := new(sync.WaitGroup)
+	//待发送响应的名额,客户端读取过慢导致响应积压时,拿不到名额就不再读取新请求
+	var pending chan struct{}
+	if server.MaxPendingResponses > 0 {
+		pending = make(chan struct{}, server.MaxPendingResponses)
+	}
+	release := func() {
+		if pending != nil {
+			<-pending
+		}
+	}
+	//每个连接独立限速,避免单个客户端占满服务端
+	var limiter *tokenBucket
+	if server.MaxConnQPS > 0 {
+		limiter = newTokenBucket(server.MaxConnQPS, server.ConnBurst)
+	}
+	//还没有收齐的分帧请求
+	frames := make(requestFrames)
+	info := connInfoFromContext(ctx)
+	opt, slot := info.option, info.slot
+	//登记连接,使服务端可以通过该连接向客户端发起调用
+	sc := server.trackConn(ctx, codec, sendLock)
+	defer server.untrackConn(sc)
+	//连接上打开的双向流
+	streams := &serverStreams{m: make(map[uint64]*ServerStream)}
 	//循环等待请求发送过来
 	for {
-		req, err := server.readRequest(codec)
+		h, err := server.readRequestHeader(codec)
 		if err != nil {
-			if req == nil {
-				//读取请求错误而且返回为空
+			//读取请求头错误
+			reason = closeReasonOf(err, ClientClosed)
+			if sc.isDraining() {
+				reason = ServerClosed
+			}
+			break
+		}
+		slot.touch()
+		if h.Reverse {
+			//服务端发起的调用的响应不占名额,否则方法中的CallClient占满名额后就再也读不到响应
+			err = sc.receiveReply(h)
+			if err != nil {
+				reason = closeReasonOf(err, ClientClosed)
+				break
+			}
+			continue
+		}
+		if kind := h.Metadata[StreamKey]; kind == streamAck || kind == streamCancel {
+			//流式响应的确认同样不占名额,发送流的方法在等待它
+			err = sc.receiveStreamAck(h)
+			if err != nil {
+				reason = closeReasonOf(err, ClientClosed)
 				break
 			}
-			//读取请求错误但是返回不为空,将header放入错误信息
+			continue
+		}
+		if pending != nil {
+			pending <- struct{}{}
+		}
+		if h.Metadata[KeepaliveKey] == keepalivePing {
+			//保活消息不经过限速,也不算作请求
+			err = server.pong(codec, h, sendLock)
+			release()
+			if err != nil {
+				reason = closeReasonOf(err, ClientClosed)
+				break
+			}
+			continue
+		}
+		if _, bidi := h.Metadata[BidiKey]; bidi {
+			err = server.receiveBidi(ctx, codec, h, streams, sc, sendLock, wg)
+			release()
+			if err != nil {
+				reason = closeReasonOf(err, ClientClosed)
+				break
+			}
+			continue
+		}
+		//分帧的请求收齐后再读取
+		rc := codec
+		if _, framed := h.Metadata[FrameKey]; framed {
+			var complete bool
+			rc, complete, err = frames.receive(opt, codec, h, server.MaxFrameBytes > 0, server.maxFramedRequestBytes(), server.MaxDecodeTime)
+			if err != nil || !complete {
+				release()
+				if err != nil {
+					reason = closeReasonOf(err, ClientClosed)
+					break
+				}
+				continue
+			}
+		}
+		if limiter != nil {
+			limiter.wait()
+		}
+		req, err := server.readRequest(rc, h)
+		if err != nil {
+			//读取请求错误,将header放入错误信息
 			req.h.Error = err.Error()
 			//发送返回消息
-			server.sendResponse(codec, req.h, invalidRequest, sendLock)
+			encodeTime := server.sendResponse(codec, req.h, invalidRequest, sendLock)
+			server.reportStats(req, encodeTime)
+			release()
+			continue
+		}
+		//连接正在关闭,不再处理新的请求
+		if !sc.beginRequest() {
+			req.h.Error = ErrConnClosing.Error()
+			encodeTime := server.sendResponse(codec, req.h, invalidRequest, sendLock)
+			server.reportStats(req, encodeTime)
+			release()
 			continue
 		}
 		//读取了一个请求后,waitGroup+1,等该请求被处理完之后再Done进行-1
 		wg.Add(1)
-		go server.handleRequest(codec, req, sendLock, wg)
+		slot.addInFlight(1)
+		if server.Ordered {
+			server.handleRequest(ctx, codec, req, sendLock, wg)
+			slot.addInFlight(-1)
+			sc.endRequest()
+			release()
+		} else {
+			go func() {
+				server.handleRequest(ctx, codec, req, sendLock, wg)
+				slot.addInFlight(-1)
+				sc.endRequest()
+				release()
+			}()
+		}
 	}
+	//连接已不可读,阻塞在Recv的流方法和等待确认的流式响应需要先返回
+	streams.closeAll()
+	sc.closeWindows()
 	//解析出错时,错误的请求在这里wait等待其他请求处理完
 	wg.Wait()
 	_ = codec.Close()
+	return reason
+}
+
+//把消息体解码到argv,newArgv和pooledArgv返回的值总是可以取得指针
+//SetArgFactory的构造函数返回nil指针时没有可以解码的对象,读掉消息体并返回错误而不是panic
+func decodeArgv(c codec.Codec, argv reflect.Value) error {
+	if argv.Kind() == reflect.Ptr {
+		if argv.IsNil() {
+			_ = c.ReadBody(nil)
+			return fmt.Errorf("rpc server: arg factory returned nil %s", argv.Type())
+		}
+		return c.ReadBody(argv.Interface())
+	}
+	if !argv.IsValid() {
+		_ = c.ReadBody(nil)
+		return errors.New("rpc server: arg factory returned a nil pointer")
+	}
+	return c.ReadBody(argv.Addr().Interface())
 }
 
 //每个请求的封装
@@ -170,6 +786,46 @@ type request struct {
 	mType *methodType
 	//该请求的service(用于方法调用)
 	service *service
+	//未注册或被拦截的方法的原始消息体
+	raw []byte
+	//拦截该请求的handler,为nil且mType为nil时交给UnknownMethodHandler
+	intercept InterceptHandler
+	//读取该请求的Codec
+	c codec.Codec
+	//读到请求头的时间
+	start time.Time
+	//解码参数的耗时
+	decodeTime time.Duration
+}
+
+//解码请求参数的耗时超过Server.MaxDecodeTime
+var ErrDecodeBudget = codec.ErrDecodeBudget
+
+//客户端声明的缓冲区大小,不超过MaxBufferSize
+func (server *Server) bufferSizeOf(opt *Option) int {
+	max := server.MaxBufferSize
+	if max <= 0 {
+		max = codec.DefaultBufferSize
+	}
+	if opt.BufferSize > max {
+		return max
+	}
+	return opt.BufferSize
+}
+
+//分帧请求拼接后的大小上限
+func (server *Server) maxFramedRequestBytes() int {
+	if server.MaxRequestBytes > 0 {
+		return server.MaxRequestBytes
+	}
+	return DefaultMaxFramedRequestBytes
+}
+
+func (server *Server) maxDecompressionRatio() int {
+	if server.MaxDecompressionRatio == 0 {
+		return DefaultMaxDecompressionRatio
+	}
+	return server.MaxDecompressionRatio
 }
 
 //读取请求的Header
@@ -181,58 +837,272 @@ func (server *Server) readRequestHeader(c codec.Codec) (*codec.Header, error) {
 		}
 		return nil, err
 	}
+	if server.trace.enabled() {
+		server.trace.printf("recv header seq=%d method=%s request-id=%s", h.Seq, h.ServiceMethod, requestIDOf(&h))
+	}
 	return &h, nil
 }
 
-//读取请求
-func (server *Server) readRequest(c codec.Codec) (*request, error) {
-	h, err := server.readRequestHeader(c)
-	if err != nil {
-		return nil, err
+//根据读到的请求头读取请求,返回的request不为nil
+func (server *Server) readRequest(c codec.Codec, h *codec.Header) (*request, error) {
+	req := &request{h: h, c: c, start: time.Now()}
+	//客户端没有带请求id时由服务端生成,并随响应头返回
+	if requestIDOf(h) == "" {
+		if h.Metadata == nil {
+			h.Metadata = make(map[string]string)
+		}
+		h.Metadata[RequestIDKey] = newRandomID()
+	}
+	//按SetDispatchPipeline设置的顺序查找方法,默认按参数类型注册的方法优先
+	var unknown bool
+	var err error
+	req.service, req.mType, req.intercept, unknown, err = server.dispatch(h)
+	if unknown || req.intercept != nil {
+		//交给拦截的handler或UnknownMethodHandler处理,mType为nil
+		return req, server.readRawBody(c, req)
+	}
+	if err == nil && req.mType.ArgType == typeOfServerStream {
+		err = errors.New("rpc server: " + h.ServiceMethod + " is a stream method, use OpenStream")
+	}
+	if err == nil && req.mType.ArgType == typeOfArgStream {
+		err = errors.New("rpc server: " + h.ServiceMethod + " takes a stream arg, use CallArgStream")
 	}
-	req := &request{h: h}
-	req.service, req.mType, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		//找不到方法时也要读掉消息体,否则会被当作下一个请求头解析
+		_ = c.ReadBody(nil)
 		return req, err
 	}
-	req.argv = req.mType.newArgv()
-	req.replyv = req.mType.newReply()
-
-	//确保为指针,因为ReadBody需要指针类型的参数
-	argvPtr := req.argv.Interface()
-	if req.argv.Type().Kind() != reflect.Ptr {
-		argvPtr = req.argv.Addr().Interface()
+	if server.ReuseArgs {
+		req.argv = req.mType.pooledArgv()
+	} else {
+		req.argv = req.mType.newArgv()
 	}
-	if err = c.ReadBody(argvPtr); err != nil {
+	if server.ReuseReplies {
+		req.replyv = req.mType.pooledReply()
+	} else {
+		req.replyv = req.mType.newReply()
+	}
+
+	err = decodeArgv(c, req.argv)
+	req.decodeTime = decodeTimeOf(c)
+	if err != nil {
 		//从argv中解析出数据
-		log.Println("rpc server: read argv err:", err)
+		log.Printf("rpc server: read argv err: %v (request-id=%s)", err, requestIDOf(h))
 		return req, err
 	}
 	return req, nil
 }
 
-//返回响应
-func (server *Server) sendResponse(c codec.Codec, h *codec.Header, body interface{}, sendLock *sync.Mutex) {
+//返回响应,返回Codec统计的编码耗时
+func (server *Server) sendResponse(c codec.Codec, h *codec.Header, body interface{}, sendLock *sendQueue) time.Duration {
 	sendLock.Lock()
 	defer sendLock.Unlock()
+	//响应消息体按请求方要求的协议编码
+	h.BodyCodec = h.ReplyCodec
 	//加密写消息
-	if err := c.Write(h, body); err != nil {
-		log.Println("rpc server: write response error:", err)
+	err := c.Write(h, body)
+	encodeTime := encodeTimeOf(c)
+	if errors.Is(err, codec.ErrEncodeBody) {
+		//reply编码失败时连接仍然可用,改为返回错误响应,避免客户端一直等待
+		log.Printf("rpc server: encode reply error: %v (request-id=%s)", err, requestIDOf(h))
+		h.Error = err.Error()
+		//消息体已不是错误链
+		delete(h.Metadata, ErrorChainKey)
+		err = c.Write(h, invalidRequest)
+		encodeTime += encodeTimeOf(c)
+	}
+	if err != nil {
+		log.Printf("rpc server: write response error: %v (request-id=%s)", err, requestIDOf(h))
+		if server.trace.enabled() {
+			server.trace.printf("send seq=%d method=%s request-id=%s write error=%v", h.Seq, h.ServiceMethod, requestIDOf(h), err)
+		}
+	} else {
+		if server.trace.enabled() {
+			server.trace.printf("send seq=%d method=%s request-id=%s error=%q", h.Seq, h.ServiceMethod, requestIDOf(h), h.Error)
+		}
+	}
+	return encodeTime
+}
+
+//Codec统计的最近一次Write的编码耗时,Codec不支持时为0,需要在持有发送锁时调用
+func encodeTimeOf(c codec.Codec) time.Duration {
+	if timer, ok := c.(codec.Timer); ok {
+		return timer.LastEncodeTime()
+	}
+	return 0
+}
+
+//Codec统计的最近一次ReadBody的解码耗时,Codec不支持时为0,需要在读取协程中调用
+func decodeTimeOf(c codec.Codec) time.Duration {
+	if timer, ok := c.(codec.Timer); ok {
+		return timer.LastDecodeTime()
 	}
+	return 0
+}
+
+//回调请求的统计信息
+func (server *Server) reportStats(req *request, encodeTime time.Duration) {
+	duration := time.Since(req.start)
+	//只统计已注册的方法,避免客户端随意构造方法名导致指标无限增长
+	if req.mType != nil {
+		server.metrics.record(req.h.ServiceMethod, duration, req.h.Error != "")
+	}
+	if server.OnStats == nil {
+		return
+	}
+	stats := CallStats{
+		ServiceMethod: req.h.ServiceMethod,
+		DecodeTime:    req.decodeTime,
+		EncodeTime:    encodeTime,
+		Duration:      duration,
+		Error:         req.h.Error,
+	}
+	if marker, ok := req.c.(codec.HighWaterMarker); ok {
+		stats.BufferHighWater = marker.TakeHighWater()
+	}
+	server.OnStats(stats)
 }
 
 //处理请求
-func (server *Server) handleRequest(c codec.Codec, req *request, sendLock *sync.Mutex, wg *sync.WaitGroup) {
+func (server *Server) handleRequest(ctx context.Context, c codec.Codec, req *request, sendLock *sendQueue, wg *sync.WaitGroup) {
 	//day1 只做打印argv和返回hello
 	//处理完请求,Done使计数器-1
 	defer wg.Done()
-	err := req.service.call(req.mType, req.argv, req.replyv)
+	//每个请求有自己可取消的context,处理期间登记为正在处理
+	ctx = context.WithValue(ctx, requestIDKey, requestIDOf(req.h))
+	ctx = context.WithValue(ctx, etagKey, &etagHolder{})
+	ctx = context.WithValue(ctx, metadataKey, req.h.Metadata)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	//被拦截的方法交给拦截的handler,没有注册的方法交给UnknownMethodHandler
+	if req.mType == nil {
+		defer server.trackRequest(ctx, req, cancel)()
+		if req.intercept != nil {
+			server.handleIntercept(ctx, c, req, sendLock)
+		} else {
+			server.handleUnknown(ctx, c, req, sendLock)
+		}
+		return
+	}
+	//按方法的类别设置超时
+	if timeout := server.categoryTimeout(req.mType); timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	defer server.trackRequest(ctx, req, cancel)()
+	if server.ReuseArgs {
+		defer req.mType.releaseArgv(req.argv)
+	}
+	release, err := server.acquireMethod(ctx, req.mType)
+	//在去重窗口内的重复请求直接返回之前的结果,流式响应不去重
+	//没有取得执行名额时方法没有执行,不登记,重试时仍会执行
+	var entry *dedupEntry
+	if err == nil && !req.mType.isStreamReply() {
+		var dup bool
+		entry, dup = server.dedup.begin(dedupClientOf(ctx), req.h.ServiceMethod, req.h.Seq, server.DedupWindow)
+		if dup {
+			release()
+			<-entry.done
+			entry.apply(req.h)
+			encodeTime := server.sendReply(connInfoFromContext(ctx).option, c, req.h, entry.body, sendLock)
+			server.reportStats(req, encodeTime)
+			return
+		}
+	}
+	//响应发送完之后才能放回对象池,被去重记录引用的reply不能放回
+	if server.ReuseReplies && entry == nil {
+		defer req.mType.releaseReply(req.replyv)
+	}
+	respond := func(body interface{}) {
+		if entry != nil {
+			entry.finish(req.h, body)
+		}
+		encodeTime := server.sendReply(connInfoFromContext(ctx).option, c, req.h, body, sendLock)
+		server.reportStats(req, encodeTime)
+	}
+	if err == nil {
+		//方法返回前可以通过SendEvent向调用方发送事件
+		sender := &eventSender{c: c, h: req.h, sendLock: sendLock}
+		ctx = context.WithValue(ctx, eventSenderKey, sender)
+		stopWatch := server.watchSlowHandler(req.h.ServiceMethod, cancel)
+		err = server.invoke(ctx, req)
+		stopWatch()
+		sender.close()
+		release()
+	}
 	if err != nil {
 		req.h.Error = err.Error()
 		//返回错误响应
-		server.sendResponse(c, req.h, invalidRequest, sendLock)
+		var body interface{} = invalidRequest
+		if server.EncodeErrorChains {
+			req.h.Metadata[ErrorChainKey] = "true"
+			body = newErrorChain(err)
+		}
+		respond(body)
+		return
+	}
+	//reply为io.ReadCloser时分块发送
+	if req.mType.isStreamReply() {
+		r, _ := req.replyv.Elem().Interface().(io.ReadCloser)
+		encodeTime := server.sendStream(ctx, c, req.h, r, sendLock)
+		server.reportStats(req, encodeTime)
+		return
+	}
+	//ETag与客户端缓存一致时不发送reply
+	if applyETag(ctx, req.h.Metadata) {
+		respond(invalidRequest)
 		return
 	}
 	//发送响应
-	server.sendResponse(c, req.h, req.replyv.Interface(), sendLock)
+	respond(req.replyv.Interface())
+}
+
+//登记正在处理的请求,返回处理结束时取消登记的函数
+func (server *Server) trackRequest(ctx context.Context, req *request, cancel context.CancelFunc) func() {
+	info := connInfoFromContext(ctx)
+	key := inFlightKey{connID: info.id, seq: req.h.Seq}
+	server.inFlightLock.Lock()
+	defer server.inFlightLock.Unlock()
+	if server.inFlight == nil {
+		server.inFlight = make(map[inFlightKey]*inFlightEntry)
+	}
+	server.inFlight[key] = &inFlightEntry{
+		info: InFlightRequest{
+			ConnID:        info.id,
+			Seq:           req.h.Seq,
+			ServiceMethod: req.h.ServiceMethod,
+			Start:         req.start,
+			RemoteAddr:    info.remoteAddr,
+		},
+		cancel: cancel,
+	}
+	return func() {
+		server.inFlightLock.Lock()
+		defer server.inFlightLock.Unlock()
+		delete(server.inFlight, key)
+	}
+}
+
+//返回所有正在处理的请求
+func (server *Server) InFlight() []InFlightRequest {
+	server.inFlightLock.Lock()
+	defer server.inFlightLock.Unlock()
+	requests := make([]InFlightRequest, 0, len(server.inFlight))
+	for _, entry := range server.inFlight {
+		requests = append(requests, entry.info)
+	}
+	return requests
+}
+
+//取消某个连接上正在处理的请求的context,返回是否找到该请求
+//只有第一个参数为context.Context的方法能感知到取消
+func (server *Server) CancelRequest(connID, seq uint64) bool {
+	server.inFlightLock.Lock()
+	defer server.inFlightLock.Unlock()
+	entry, ok := server.inFlight[inFlightKey{connID: connID, seq: seq}]
+	if ok {
+		entry.cancel()
+	}
+	return ok
 }
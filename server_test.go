@@ -0,0 +1,3087 @@
+package gorpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"github.com/gorilla/websocket"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//启动一个将连接关闭原因写入chan的服务端
+func startReasonServer(t *testing.T) (string, chan CloseReason) {
+	t.Helper()
+	var foo Foo
+	reasons := make(chan CloseReason, 1)
+	server := NewServer()
+	server.OnDisconnect = func(conn io.ReadWriteCloser, reason CloseReason) {
+		reasons <- reason
+	}
+	return startTestServer(t, server, &foo), reasons
+}
+
+func waitReason(t *testing.T, reasons chan CloseReason, expect CloseReason) {
+	t.Helper()
+	select {
+	case reason := <-reasons:
+		if reason != expect {
+			t.Fatalf("expect close reason %s, got %s", expect, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect close reason %s, got nothing", expect)
+	}
+}
+
+func TestCloseReasonClientClosed(t *testing.T) {
+	addr, reasons := startReasonServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	_ = client.Close()
+	waitReason(t, reasons, ClientClosed)
+}
+
+func TestCloseReasonMagicMismatch(t *testing.T) {
+	addr, reasons := startReasonServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: 1, CodecType: DefaultOption.CodecType})
+	waitReason(t, reasons, MagicMismatch)
+}
+
+func TestCloseReasonDecodeError(t *testing.T) {
+	addr, reasons := startReasonServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(DefaultOption)
+	_, _ = conn.Write(bytes.Repeat([]byte{0xff}, 512))
+	waitReason(t, reasons, DecodeError)
+}
+
+func TestClientCloseReason(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		//读完option后直接关闭连接
+		_ = json.NewDecoder(serverConn).Decode(new(Option))
+		_ = serverConn.Close()
+	}()
+	client, err := NewClient(clientConn, DefaultOption)
+	if err != nil {
+		t.Fatal("new client error:", err)
+	}
+	for i := 0; client.IsAvailable() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reason := client.CloseReason(); reason != ServerClosed {
+		t.Fatalf("expect close reason %s, got %s", ServerClosed, reason)
+	}
+
+	var foo Foo
+	client, err = Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	_ = client.Close()
+	for i := 0; client.CloseReason() == UnknownReason && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reason := client.CloseReason(); reason != ClientClosed {
+		t.Fatalf("expect close reason %s, got %s", ClientClosed, reason)
+	}
+}
+
+//连接后不发送Option,服务端应在超时后断开
+func TestHandshakeTimeout(t *testing.T) {
+	var foo Foo
+	reasons := make(chan CloseReason, 1)
+	server := NewServer()
+	server.HandshakeTimeout = 100 * time.Millisecond
+	server.OnDisconnect = func(conn io.ReadWriteCloser, reason CloseReason) {
+		reasons <- reason
+	}
+	conn, err := net.Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expect connection closed by server, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("connection closed before handshake timeout:", elapsed)
+	}
+	waitReason(t, reasons, Timeout)
+}
+
+//编码很慢的类型,用于验证统计中编码耗时的占比
+type SlowEncoding struct {
+	Value int
+}
+
+func (s SlowEncoding) MarshalBinary() ([]byte, error) {
+	time.Sleep(50 * time.Millisecond)
+	return []byte{byte(s.Value)}, nil
+}
+
+func (s *SlowEncoding) UnmarshalBinary(data []byte) error {
+	s.Value = int(data[0])
+	return nil
+}
+
+type Slow struct{}
+
+func (s *Slow) Encode(args int, reply *SlowEncoding) error {
+	reply.Value = args
+	return nil
+}
+
+func (s *Slow) Take(args SlowEncoding, reply *int) error {
+	*reply = args.Value
+	return nil
+}
+
+func TestCallStatsEncodeTime(t *testing.T) {
+	var slow Slow
+	stats := make(chan CallStats, 1)
+	server := NewServer()
+	server.OnStats = func(s CallStats) {
+		stats <- s
+	}
+	client, err := Dial("tcp", startTestServer(t, server, &slow))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply SlowEncoding
+	if err := client.Call("Slow.Encode", 7, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if reply.Value != 7 {
+		t.Fatal("unexpected reply:", reply.Value)
+	}
+	s := <-stats
+	if s.ServiceMethod != "Slow.Encode" || s.Error != "" {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s.EncodeTime < 50*time.Millisecond || s.EncodeTime <= s.DecodeTime || s.Duration < s.EncodeTime {
+		t.Fatalf("expect encode time to dominate: %+v", s)
+	}
+	//客户端编码慢的参数,服务端解码得到的是普通的字节
+	var n int
+	result, err := client.CallDetailed(context.Background(), "Slow.Take", SlowEncoding{Value: 9}, &n)
+	if err != nil || n != 9 {
+		t.Fatal("call error:", err, n)
+	}
+	if result.EncodeTime < 50*time.Millisecond || result.EncodeTime <= result.DecodeTime || result.Latency < result.EncodeTime {
+		t.Fatalf("expect client encode time to dominate: %+v", result)
+	}
+	if s := <-stats; s.DecodeTime >= 50*time.Millisecond {
+		t.Fatalf("expect fast server decode: %+v", s)
+	}
+}
+
+//记录处理顺序,参数越小处理越慢
+type Order struct {
+	mu   sync.Mutex
+	seen []int
+}
+
+func (o *Order) Record(args int, reply *int) error {
+	time.Sleep(time.Duration(5-args) * 10 * time.Millisecond)
+	o.mu.Lock()
+	o.seen = append(o.seen, args)
+	o.mu.Unlock()
+	*reply = args
+	return nil
+}
+
+func TestOrderedServer(t *testing.T) {
+	var order Order
+	server := NewServer()
+	server.Ordered = true
+	client, err := Dial("tcp", startTestServer(t, server, &order))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	calls := make([]*Call, 5)
+	for i := range calls {
+		calls[i] = client.Go("Order.Record", i, new(int), nil)
+	}
+	for _, call := range calls {
+		if call = <-call.Done; call.Error != nil {
+			t.Fatal("call error:", call.Error)
+		}
+	}
+	for i, args := range order.seen {
+		if args != i {
+			t.Fatal("expect requests handled in order, got", order.seen)
+		}
+	}
+}
+
+//等待指定的毫秒数,或者context被取消
+func (s *Slow) Wait(ctx context.Context, args int, reply *int) error {
+	select {
+	case <-time.After(time.Duration(args) * time.Millisecond):
+		*reply = args
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestCancelInFlightRequest(t *testing.T) {
+	var slow Slow
+	server := NewServer()
+	client, err := Dial("tcp", startTestServer(t, server, &slow))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	start := time.Now()
+	call := client.Go("Slow.Wait", 5000, new(int), nil)
+	var inFlight []InFlightRequest
+	for i := 0; len(inFlight) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		inFlight = server.InFlight()
+	}
+	if len(inFlight) != 1 {
+		t.Fatal("expect one in-flight request, got", inFlight)
+	}
+	req := inFlight[0]
+	if req.ServiceMethod != "Slow.Wait" || req.Seq != call.Seq || req.RemoteAddr == "" || req.Start.IsZero() {
+		t.Fatalf("unexpected in-flight request: %+v", req)
+	}
+	if !server.CancelRequest(req.ConnID, req.Seq) {
+		t.Fatal("expect request to be found")
+	}
+	call = <-call.Done
+	if call.Error == nil || call.Error.Error() != context.Canceled.Error() {
+		t.Fatal("expect canceled error, got:", call.Error)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expect handler to return early after cancel")
+	}
+	if server.CancelRequest(req.ConnID, req.Seq) {
+		t.Fatal("expect finished request to be gone")
+	}
+}
+
+//开启参数复用后,连续的请求之间不能串数据(gob不发送零值字段)
+func TestReuseArgsNoFieldBleed(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.ReuseArgs = true
+	client, err := Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	num := 10
+	for i := 0; i < 20; i++ {
+		args, expect := NestedArgs{}, 0
+		if i%2 == 0 {
+			args, expect = NestedArgs{Num: &num, Labels: map[string]string{"a": "b"}, Values: []int{1, 2}}, 13
+		}
+		var reply int
+		if err := client.Call("Foo.Nested", args, &reply); err != nil {
+			t.Fatal("call error:", err)
+		}
+		if reply != expect {
+			t.Fatalf("call %d: expect %d, got %d", i, expect, reply)
+		}
+	}
+}
+
+type BigArgs struct {
+	Values [64]int
+	Name   string
+}
+
+type Big struct{}
+
+func (b *Big) Len(args BigArgs, reply *int) error {
+	*reply = len(args.Name) + len(args.Values)
+	return nil
+}
+
+func BenchmarkReuseArgs(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		reuse := reuse
+		name := "New"
+		if reuse {
+			name = "Reuse"
+		}
+		b.Run(name, func(b *testing.B) {
+			var big Big
+			server := NewServer()
+			server.ReuseArgs = reuse
+			_ = server.Register(&big)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal("network error:", err)
+			}
+			defer func() { _ = l.Close() }()
+			go server.Accept(l)
+			client, err := Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal("dial error:", err)
+			}
+			defer func() { _ = client.Close() }()
+			args := BigArgs{Name: "bench"}
+			args.Values[1] = 1
+			var reply int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.Call("Big.Len", args, &reply); err != nil {
+					b.Fatal("call error:", err)
+				}
+			}
+		})
+	}
+}
+
+type Negotiated struct{}
+
+//返回连接协商的协议类型
+func (n *Negotiated) Codec(ctx context.Context, args int, reply *string) error {
+	opt, ok := OptionFromContext(ctx)
+	if !ok {
+		return errors.New("no option in context")
+	}
+	if _, ok := PeerAddrFromContext(ctx); !ok {
+		return errors.New("no peer address in context")
+	}
+	*reply = string(opt.CodecType)
+	return nil
+}
+
+func TestOptionFromContext(t *testing.T) {
+	var negotiated Negotiated
+	addr := startTestServer(t, NewServer(), &negotiated)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := Dial("tcp", addr, &Option{CodecType: typ})
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		var reply string
+		if err := client.Call("Negotiated.Codec", 0, &reply); err != nil {
+			t.Fatal("call error:", err)
+		}
+		if reply != string(typ) {
+			t.Fatalf("expect codec %s, got %s", typ, reply)
+		}
+		_ = client.Close()
+	}
+}
+
+func (c *Counter) Count(args int, reply *int) error {
+	atomic.AddInt32(&c.hits, 1)
+	*reply = args
+	return nil
+}
+
+//客户端只发送不读取响应,服务端在积压到上限后应停止读取新请求
+func TestMaxPendingResponses(t *testing.T) {
+	var counter Counter
+	server := NewServer()
+	server.MaxPendingResponses = 2
+	_ = server.Register(&counter)
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	go server.ServeConn(serverConn)
+
+	sent := make(chan int, 10)
+	go func() {
+		_ = json.NewEncoder(clientConn).Encode(DefaultOption)
+		c := codec.NewGobCodecFunc(clientConn)
+		for i := 0; i < 10; i++ {
+			if err := c.Write(&codec.Header{ServiceMethod: "Counter.Count", Seq: uint64(i)}, i); err != nil {
+				return
+			}
+			sent <- i
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if hits := atomic.LoadInt32(&counter.hits); hits != 2 {
+		t.Fatal("expect server to stop handling at 2 pending responses, got", hits)
+	}
+	if len(sent) == 10 {
+		t.Fatal("expect server to stop reading requests")
+	}
+}
+
+type AddArgs struct{ A, B int }
+
+type MulArgs struct{ A, B int }
+
+func TestRegisterTyped(t *testing.T) {
+	server := NewServer()
+	if err := server.RegisterTyped("Calc.Op", reflect.TypeOf(AddArgs{}), func(args AddArgs, reply *int) error {
+		*reply = args.A + args.B
+		return nil
+	}); err != nil {
+		t.Fatal("register typed error:", err)
+	}
+	if err := server.RegisterTyped("Calc.Op", reflect.TypeOf(MulArgs{}), func(ctx context.Context, args MulArgs, reply *int) error {
+		*reply = args.A * args.B
+		return nil
+	}); err != nil {
+		t.Fatal("register typed error:", err)
+	}
+	if err := server.RegisterTyped("Calc.Op", reflect.TypeOf(AddArgs{}), func(args MulArgs, reply *int) error { return nil }); err == nil {
+		t.Fatal("expect mismatched arg type to be rejected")
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Calc.Op", AddArgs{A: 3, B: 4}, &reply); err != nil || reply != 7 {
+		t.Fatal("add error:", err, reply)
+	}
+	if err := client.Call("Calc.Op", &MulArgs{A: 3, B: 4}, &reply); err != nil || reply != 12 {
+		t.Fatal("mul error:", err, reply)
+	}
+	if err := client.Call("Calc.Op", Args{Num1: 3, Num2: 4}, &reply); err == nil || !strings.Contains(err.Error(), "no handler") {
+		t.Fatal("expect no handler error, got:", err)
+	}
+	if err := client.Call("Calc.Op", AddArgs{A: 1, B: 1}, &reply); err != nil || reply != 2 {
+		t.Fatal("call error after unmatched call:", err, reply)
+	}
+}
+
+//在方法中回调客户端
+type Publisher struct {
+	server *Server
+	connID uint64
+}
+
+func (p *Publisher) Subscribe(ctx context.Context, topic string, reply *string) error {
+	p.connID, _ = ConnIDFromContext(ctx)
+	return p.server.CallClient(ctx, p.connID, "Listener.OnEvent", "subscribed:"+topic, reply)
+}
+
+//客户端注册的回调实例
+type Listener struct {
+	events  chan string
+	release chan struct{}
+}
+
+func (l *Listener) OnEvent(event string, reply *string) error {
+	l.events <- event
+	*reply = "ack " + event
+	return nil
+}
+
+//阻塞到release关闭
+func (l *Listener) Stall(event string, reply *string) error {
+	<-l.release
+	return nil
+}
+
+//阻塞到ctx被取消
+func (l *Listener) Hold(ctx context.Context, event string, reply *string) error {
+	l.events <- event
+	<-ctx.Done()
+	l.events <- "canceled"
+	return ctx.Err()
+}
+
+func TestServerPush(t *testing.T) {
+	server := NewServer()
+	publisher := &Publisher{server: server}
+	client, err := Dial("tcp", startTestServer(t, server, publisher))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	listener := &Listener{events: make(chan string, 10)}
+	if err := client.Register(listener); err != nil {
+		t.Fatal("client register error:", err)
+	}
+	//在处理客户端请求的过程中回调客户端
+	var reply string
+	if err := client.Call("Publisher.Subscribe", "news", &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if reply != "ack subscribed:news" || <-listener.events != "subscribed:news" {
+		t.Fatal("unexpected reply:", reply)
+	}
+	//在请求之外主动推送
+	if err := server.CallClient(context.Background(), publisher.connID, "Listener.OnEvent", "breaking", &reply); err != nil {
+		t.Fatal("push error:", err)
+	}
+	if reply != "ack breaking" || <-listener.events != "breaking" {
+		t.Fatal("unexpected push reply:", reply)
+	}
+	if err := server.CallClient(context.Background(), publisher.connID, "Listener.Missing", "x", &reply); err == nil {
+		t.Fatal("expect error for missing client method")
+	}
+	_ = client.Close()
+	time.Sleep(50 * time.Millisecond)
+	if err := server.CallClient(context.Background(), publisher.connID, "Listener.OnEvent", "late", &reply); err == nil {
+		t.Fatal("expect error after connection closed")
+	}
+}
+
+//ctx结束时CallClient返回并删除未完成的调用,方法中回调不受MaxPendingResponses和Ordered影响而死锁
+func TestCallClientContext(t *testing.T) {
+	server := NewServer()
+	server.MaxPendingResponses = 1
+	publisher := &Publisher{server: server}
+	client, err := Dial("tcp", startTestServer(t, server, publisher))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	listener := &Listener{events: make(chan string, 10), release: make(chan struct{})}
+	defer close(listener.release)
+	if err := client.Register(listener); err != nil {
+		t.Fatal("client register error:", err)
+	}
+	var reply string
+	if err := client.Call("Publisher.Subscribe", "news", &reply); err != nil || reply != "ack subscribed:news" {
+		t.Fatal("call back with MaxPendingResponses error:", err, reply)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.CallClient(ctx, publisher.connID, "Listener.Stall", "x", &reply); err != ErrCallTimeout {
+		t.Fatal("expect ErrCallTimeout, got:", err)
+	}
+	v, _ := server.conns.Load(publisher.connID)
+	sc := v.(*serverConn)
+	sc.lock.Lock()
+	pending := len(sc.pending)
+	sc.lock.Unlock()
+	if pending != 0 {
+		t.Fatal("expect canceled call removed, pending:", pending)
+	}
+
+	ordered := NewServer()
+	ordered.Ordered = true
+	orderedPublisher := &Publisher{server: ordered}
+	oc, err := Dial("tcp", startTestServer(t, ordered, orderedPublisher))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = oc.Close() }()
+	if err := oc.Register(listener); err != nil {
+		t.Fatal("client register error:", err)
+	}
+	if err := oc.Call("Publisher.Subscribe", "news", &reply); err == nil || !strings.Contains(err.Error(), ErrCallClientOrdered.Error()) {
+		t.Fatal("expect ErrCallClientOrdered, got:", err)
+	}
+}
+
+//Close取消服务端回调的方法的context,并等待它们返回
+func TestClientCloseCancelsHandlers(t *testing.T) {
+	server := NewServer()
+	publisher := &Publisher{server: server}
+	client, err := Dial("tcp", startTestServer(t, server, publisher))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	listener := &Listener{events: make(chan string, 10)}
+	if err := client.Register(listener); err != nil {
+		t.Fatal("client register error:", err)
+	}
+	var reply string
+	if err := client.Call("Publisher.Subscribe", "news", &reply); err != nil || <-listener.events != "subscribed:news" {
+		t.Fatal("call error:", err, reply)
+	}
+	pushed := make(chan error, 1)
+	go func() {
+		var reply string
+		pushed <- server.CallClient(context.Background(), publisher.connID, "Listener.Hold", "x", &reply)
+	}()
+	if event := <-listener.events; event != "x" {
+		t.Fatal("unexpected event:", event)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+	//Close返回时回调已经返回
+	select {
+	case event := <-listener.events:
+		if event != "canceled" {
+			t.Fatal("unexpected event:", event)
+		}
+	default:
+		t.Fatal("expect handler canceled and returned before Close returns")
+	}
+	select {
+	case err := <-pushed:
+		if err == nil {
+			t.Fatal("expect CallClient error after client closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CallClient blocked after client closed")
+	}
+}
+
+type Lister struct{}
+
+//返回0..args-1
+func (l *Lister) List(args int, reply *[]int) error {
+	for i := 0; i < args; i++ {
+		*reply = append(*reply, i)
+	}
+	return nil
+}
+
+//返回 "0".."args-1" -> i
+func (l *Lister) Index(args int, reply *map[string]int) error {
+	for i := 0; i < args; i++ {
+		(*reply)[strconv.Itoa(i)] = i
+	}
+	return nil
+}
+
+//开启reply复用后各请求拿到的reply不能残留之前的数据
+func TestReuseRepliesNoBleed(t *testing.T) {
+	var lister Lister
+	server := NewServer()
+	server.ReuseReplies = true
+	server.Ordered = true
+	client, err := Dial("tcp", startTestServer(t, server, &lister))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	for _, n := range []int{5, 2, 7, 0, 3} {
+		var list []int
+		if err := client.Call("Lister.List", n, &list); err != nil || len(list) != n {
+			t.Fatalf("expect %d items, got %v (%v)", n, list, err)
+		}
+		var index map[string]int
+		if err := client.Call("Lister.Index", n, &index); err != nil || len(index) != n {
+			t.Fatalf("expect %d keys, got %v (%v)", n, index, err)
+		}
+	}
+}
+
+func BenchmarkReuseReplies(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		reuse := reuse
+		name := "New"
+		if reuse {
+			name = "Reuse"
+		}
+		b.Run(name, func(b *testing.B) {
+			var lister Lister
+			server := NewServer()
+			server.ReuseReplies = reuse
+			_ = server.Register(&lister)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal("network error:", err)
+			}
+			defer func() { _ = l.Close() }()
+			go server.Accept(l)
+			client, err := Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal("dial error:", err)
+			}
+			defer func() { _ = client.Close() }()
+			var reply []int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reply = reply[:0]
+				if err := client.Call("Lister.List", 1024, &reply); err != nil {
+					b.Fatal("call error:", err)
+				}
+			}
+		})
+	}
+}
+
+//返回当前请求的id
+func (n *Negotiated) RequestID(ctx context.Context, args int, reply *string) error {
+	*reply, _ = RequestIDFromContext(ctx)
+	return nil
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	var negotiated Negotiated
+	var serverTrace, clientTrace syncBuffer
+	server := NewServer()
+	server.TraceTo(&serverTrace)
+	client, err := Dial("tcp", startTestServer(t, server, &negotiated))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	client.TraceTo(&clientTrace)
+	var reply string
+	if err := client.Call("Negotiated.RequestID", 0, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if reply == "" {
+		t.Fatal("expect request id in handler context")
+	}
+	event := "request-id=" + reply
+	assertEventOrder(t, clientTrace.String(), "send seq=1 method=Negotiated.RequestID "+event, "recv header seq=1 method=Negotiated.RequestID "+event)
+	assertEventOrder(t, serverTrace.String(), "recv header seq=1 method=Negotiated.RequestID "+event, "send seq=1 method=Negotiated.RequestID "+event)
+}
+
+//客户端没有带请求id时服务端生成并返回
+func TestServerGeneratedRequestID(t *testing.T) {
+	var negotiated Negotiated
+	server := NewServer()
+	_ = server.Register(&negotiated)
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	go server.ServeConn(serverConn)
+	_ = json.NewEncoder(clientConn).Encode(DefaultOption)
+	c := codec.NewGobCodecFunc(clientConn)
+	go func() { _ = c.Write(&codec.Header{ServiceMethod: "Negotiated.RequestID", Seq: 1}, 0) }()
+	var h codec.Header
+	var reply string
+	if err := c.ReadHeader(&h); err != nil {
+		t.Fatal("read header error:", err)
+	}
+	if err := c.ReadBody(&reply); err != nil {
+		t.Fatal("read body error:", err)
+	}
+	if id := h.Metadata[RequestIDKey]; id == "" || id != reply {
+		t.Fatalf("expect generated request id echoed, got header %q, handler %q", id, reply)
+	}
+}
+
+func TestMethodRewriter(t *testing.T) {
+	server := NewServer()
+	server.MethodRewriter = func(serviceMethod string) string {
+		if serviceMethod == "Foo.SumV2" {
+			return "Foo.Sum"
+		}
+		return serviceMethod
+	}
+	var foo Foo
+	addr := startTestServer(t, server, &foo)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.SumV2", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if reply != 3 {
+		t.Fatalf("expect 3, got %d", reply)
+	}
+	if err := client.Call("Foo.Sum", Args{Num1: 2, Num2: 3}, &reply); err != nil || reply != 5 {
+		t.Fatalf("expect 5, got %d (err=%v)", reply, err)
+	}
+}
+
+func TestServerMaxHeaderBytes(t *testing.T) {
+	server := NewServer()
+	server.MaxHeaderBytes = 1024
+	var foo Foo
+	addr := startTestServer(t, server, &foo)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo."+strings.Repeat("x", 4096), Args{}, &reply); err == nil {
+		t.Fatal("expect error for oversized header")
+	}
+	other, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = other.Close() }()
+	if err := other.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	if err := server.Register(&foo); err != nil {
+		t.Fatal("register error:", err)
+	}
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(server.WebSocketHandler(func(w http.ResponseWriter, r *http.Request) (WebSocketConn, error) {
+		return upgrader.Upgrade(w, r, nil)
+	}))
+	defer ts.Close()
+
+	WebSocketDialer = func(url string) (WebSocketConn, error) {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return ws, nil
+	}
+	defer func() { WebSocketDialer = nil }()
+	client, err := DialWebSocket("ws" + strings.TrimPrefix(ts.URL, "http"))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 3; i++ {
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil || reply != i+1 {
+			t.Fatal("call error:", err, reply)
+		}
+	}
+}
+
+//按版本号返回数据的服务,版本号作为ETag
+type Catalog struct {
+	version int32
+}
+
+func (c *Catalog) Get(ctx context.Context, args int, reply *string) error {
+	version := strconv.Itoa(int(atomic.LoadInt32(&c.version)))
+	SetETag(ctx, version)
+	*reply = "catalog v" + version
+	return nil
+}
+
+func TestCallETag(t *testing.T) {
+	var catalog Catalog
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &catalog))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var cached string
+	etag, err := client.CallETag("Catalog.Get", "", 0, &cached)
+	if err != nil || etag != "0" || cached != "catalog v0" {
+		t.Fatalf("first call: etag=%q reply=%q err=%v", etag, cached, err)
+	}
+	reply := cached
+	etag, err = client.CallETag("Catalog.Get", etag, 0, &reply)
+	if !errors.Is(err, ErrNotModified) || etag != "0" || reply != cached {
+		t.Fatalf("expect not modified, got etag=%q reply=%q err=%v", etag, reply, err)
+	}
+	atomic.AddInt32(&catalog.version, 1)
+	etag, err = client.CallETag("Catalog.Get", etag, 0, &reply)
+	if err != nil || etag != "1" || reply != "catalog v1" {
+		t.Fatalf("after change: etag=%q reply=%q err=%v", etag, reply, err)
+	}
+}
+
+func TestMaxConnQPS(t *testing.T) {
+	server := NewServer()
+	server.MaxConnQPS = 100
+	server.ConnBurst = 5
+	var foo Foo
+	addr := startTestServer(t, server, &foo)
+	abusive, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = abusive.Close() }()
+	polite, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = polite.Close() }()
+
+	//50个请求中超出突发的45个需要按100qps等待令牌
+	start := time.Now()
+	calls := make([]*Call, 50)
+	for i := range calls {
+		calls[i] = abusive.Go("Foo.Sum", Args{Num1: i, Num2: 1}, new(int), make(chan *Call, 1))
+	}
+	politeStart := time.Now()
+	for i := 0; i < 3; i++ {
+		var reply int
+		if err := polite.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil {
+			t.Fatal("call error:", err)
+		}
+	}
+	if elapsed := time.Since(politeStart); elapsed > 100*time.Millisecond {
+		t.Fatalf("expect polite connection not throttled, took %s", elapsed)
+	}
+	for _, call := range calls {
+		if c := <-call.Done; c.Error != nil {
+			t.Fatal("call error:", c.Error)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("expect abusive connection throttled, took %s", elapsed)
+	}
+}
+
+func TestMultiServer(t *testing.T) {
+	var gobCount, jsonCount int32
+	gobServer, jsonServer := NewServer(), NewServer()
+	gobServer.OnStats = func(CallStats) { atomic.AddInt32(&gobCount, 1) }
+	jsonServer.OnStats = func(CallStats) { atomic.AddInt32(&jsonCount, 1) }
+	var foo Foo
+	for _, server := range []*Server{gobServer, jsonServer} {
+		if err := server.Register(&foo); err != nil {
+			t.Fatal("register error:", err)
+		}
+	}
+	multi := NewMultiServer().Handle(codec.GobType, gobServer).Handle(codec.JsonType, jsonServer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	defer func() { _ = l.Close() }()
+	go multi.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.GobType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codecType})
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		var reply int
+		err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_ = client.Close()
+		if err != nil || reply != 3 {
+			t.Fatal("call error:", err, reply)
+		}
+	}
+	//统计回调在响应发送之后执行,需要等待一下
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && atomic.LoadInt32(&gobCount)+atomic.LoadInt32(&jsonCount) < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if g, j := atomic.LoadInt32(&gobCount), atomic.LoadInt32(&jsonCount); g != 2 || j != 1 {
+		t.Fatalf("expect 2 gob and 1 json calls, got %d and %d", g, j)
+	}
+}
+
+//gob编码总是失败的reply
+type Unencodable struct{}
+
+func (Unencodable) GobEncode() ([]byte, error) {
+	return nil, errors.New("unencodable")
+}
+
+func (u *Unencodable) Get(args int, reply *Unencodable) error {
+	return nil
+}
+
+func TestReplyEncodeError(t *testing.T) {
+	var u Unencodable
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &u, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply Unencodable
+	if err := client.Call("Unencodable.Get", 0, &reply); err == nil || !strings.Contains(err.Error(), "unencodable") {
+		t.Fatalf("expect encode error, got %v", err)
+	}
+	var sum int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatal("call error after encode error:", err, sum)
+	}
+}
+
+//按毫秒数等待的方法,分别设置为快方法和慢方法
+type Sleeper struct{}
+
+func (s *Sleeper) Fast(ctx context.Context, args int, reply *int) error {
+	return sleepOrDone(ctx, args, reply)
+}
+
+func (s *Sleeper) Slow(ctx context.Context, args int, reply *int) error {
+	return sleepOrDone(ctx, args, reply)
+}
+
+func sleepOrDone(ctx context.Context, ms int, reply *int) error {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		*reply = ms
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestMethodCategory(t *testing.T) {
+	server := NewServer()
+	server.FastMethodTimeout = 50 * time.Millisecond
+	server.SlowMethodTimeout = time.Second
+	var sleeper Sleeper
+	addr := startTestServer(t, server, &sleeper)
+	if err := server.SetMethodCategory("Sleeper.Fast", CategoryFast); err != nil {
+		t.Fatal("set category error:", err)
+	}
+	if err := server.SetMethodCategory("Sleeper.Slow", CategorySlow); err != nil {
+		t.Fatal("set category error:", err)
+	}
+	if err := server.SetMethodCategory("Sleeper.Missing", CategorySlow); err == nil {
+		t.Fatal("expect error for missing method")
+	}
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	start := time.Now()
+	if err := client.Call("Sleeper.Fast", 200, &reply); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expect fast method timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("expect fast method to time out at the short deadline, took %s", elapsed)
+	}
+	if err := client.Call("Sleeper.Slow", 200, &reply); err != nil || reply != 200 {
+		t.Fatal("slow method error:", err, reply)
+	}
+}
+
+//重放同一个(ClientID, seq)时方法只执行一次
+func TestDedupWindow(t *testing.T) {
+	server := NewServer()
+	server.DedupWindow = 16
+	var counter Counter
+	addr := startTestServer(t, server, &counter)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ClientID: "client-1"})
+	cc := codec.NewGobCodecFunc(conn)
+	for _, seq := range []uint64{1, 1, 2, 1} {
+		if err := cc.Write(&codec.Header{ServiceMethod: "Counter.Count", Seq: seq}, int(seq)*10); err != nil {
+			t.Fatal("write error:", err)
+		}
+		var h codec.Header
+		var reply int
+		if err := cc.ReadHeader(&h); err != nil || cc.ReadBody(&reply) != nil {
+			t.Fatal("read error:", err)
+		}
+		if h.Seq != seq || h.Error != "" || reply != int(seq)*10 {
+			t.Fatalf("unexpected response %+v reply=%d", h, reply)
+		}
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 2 {
+		t.Fatalf("expect handler to run twice, got %d", hits)
+	}
+
+	//没有ClientID的连接不去重
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Counter.Count", 1, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if hits := atomic.LoadInt32(&counter.hits); hits != 3 {
+		t.Fatalf("expect 3 hits, got %d", hits)
+	}
+}
+
+//等待测试放行的方法,记录执行次数
+type OnceWork struct {
+	runs    int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *OnceWork) Do(args int, reply *int) error {
+	atomic.AddInt32(&w.runs, 1)
+	w.started <- struct{}{}
+	<-w.release
+	*reply = args * 2
+	return nil
+}
+
+func (w *OnceWork) Echo(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+//通过Client.Retry重试的调用至多执行一次,新的客户端和没有执行的调用不受去重影响
+func TestDedupRetry(t *testing.T) {
+	server := NewServer()
+	server.DedupWindow = 16
+	server.RejectOverConcurrency = true
+	work := &OnceWork{started: make(chan struct{}, 4), release: make(chan struct{})}
+	addr := startTestServer(t, server, work)
+	if err := server.SetMethodConcurrency("OnceWork.Do", 1); err != nil {
+		t.Fatal("set concurrency error:", err)
+	}
+	opt := &Option{ClientID: "client-1"}
+	client, err := Dial("tcp", addr, opt)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	//第一次调用在方法执行中放弃等待
+	var first int
+	call := client.Go("OnceWork.Do", 21, &first, nil)
+	<-work.started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.wait(ctx, call); err != context.Canceled {
+		t.Fatal("expect canceled, got:", err)
+	}
+	//名额被占用时返回ErrMethodBusy,方法没有执行,不记录到去重窗口
+	var busyReply int
+	busy := client.Go("OnceWork.Do", 5, &busyReply, nil)
+	if <-busy.Done; busy.Error == nil || busy.Error.Error() != ErrMethodBusy.Error() {
+		t.Fatal("expect ErrMethodBusy, got:", busy.Error)
+	}
+	//重试沿用原来的seq和reply,等待第一次执行的结果,不再执行
+	retry := client.Retry(call, nil)
+	close(work.release)
+	if <-retry.Done; retry.Error != nil || retry.Seq != call.Seq || first != 42 {
+		t.Fatal("retry error:", retry.Error, retry.Seq, first)
+	}
+	if runs := atomic.LoadInt32(&work.runs); runs != 1 {
+		t.Fatalf("expect handler to run once, got %d", runs)
+	}
+	retry = client.Retry(busy, nil)
+	if <-retry.Done; retry.Error != nil || busyReply != 10 {
+		t.Fatal("retry of busy call error:", retry.Error, busyReply)
+	}
+	if runs := atomic.LoadInt32(&work.runs); runs != 2 {
+		t.Fatalf("expect busy call to run on retry, got %d runs", runs)
+	}
+	//相同ClientID的新客户端从seq 1开始,不会得到之前客户端的结果
+	again, err := Dial("tcp", addr, opt)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = again.Close() }()
+	var reply int
+	if err := again.Call("OnceWork.Echo", 7, &reply); err != nil || reply != 7 {
+		t.Fatal("echo error:", err, reply)
+	}
+	if err := again.Call("OnceWork.Do", 1, &reply); err != nil || reply != 2 {
+		t.Fatal("call error on new client:", err, reply)
+	}
+	if runs := atomic.LoadInt32(&work.runs); runs != 3 {
+		t.Fatalf("expect new client's call to run, got %d runs", runs)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	var storage Storage
+	client, err := Dial("tcp", startTestServer(t, server, &foo, &storage))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	for i := 0; i < 3; i++ {
+		if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil {
+			t.Fatal("call error:", err)
+		}
+	}
+	_ = client.Call("Storage.Open", "a.txt", &reply)
+	_ = client.Call("Foo.Missing", Args{}, &reply)
+
+	//统计在响应发送之后记录,等待最后一个请求被统计
+	var body string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body = rec.Body.String()
+		if strings.Contains(body, `gorpc_request_errors_total{method="Storage.Open"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range []string{
+		`gorpc_requests_total{method="Foo.Sum"} 3`,
+		`gorpc_request_errors_total{method="Foo.Sum"} 0`,
+		`gorpc_request_duration_seconds_bucket{method="Foo.Sum",le="+Inf"} 3`,
+		`gorpc_request_duration_seconds_count{method="Foo.Sum"} 3`,
+		`gorpc_request_errors_total{method="Storage.Open"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expect %q in metrics:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "Foo.Missing") {
+		t.Fatalf("expect unknown method not recorded:\n%s", body)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	addr := startTestServer(t, server, &foo)
+	server.Pause()
+	if !server.Stats().Paused {
+		t.Fatal("expect paused in stats")
+	}
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expect call to wait while paused, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	server.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("call error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect call to finish after resume")
+	}
+	if stats := server.Stats(); stats.Paused || stats.Connections != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCompressedHandshake(t *testing.T) {
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &foo)
+	for _, opt := range []*Option{
+		{CompressHandshake: true},
+		{CompressHandshake: true, CodecType: codec.JsonType},
+		{},
+	} {
+		client, err := Dial("tcp", addr, opt)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+			t.Fatalf("call with %+v: %v %d", opt, err, reply)
+		}
+		_ = client.Close()
+	}
+}
+
+type userKey struct{}
+
+type Profile struct{}
+
+func (p *Profile) Whoami(ctx context.Context, args int, reply *string) error {
+	user, ok := ctx.Value(userKey{}).(string)
+	if !ok {
+		return errors.New("no user in context")
+	}
+	*reply = user
+	return nil
+}
+
+func TestInterceptorContextValues(t *testing.T) {
+	server := NewServer()
+	var order []string
+	var lock sync.Mutex
+	server.Interceptors = []Interceptor{
+		func(ctx context.Context, info *RequestInfo, next func(ctx context.Context) error) error {
+			lock.Lock()
+			order = append(order, "log")
+			lock.Unlock()
+			return next(ctx)
+		},
+		//按参数中的用户id鉴权,通过后把用户放入ctx
+		func(ctx context.Context, info *RequestInfo, next func(ctx context.Context) error) error {
+			lock.Lock()
+			order = append(order, "auth")
+			lock.Unlock()
+			if info.Metadata[RequestIDKey] == "" {
+				return errors.New("missing request id")
+			}
+			id := info.Args.(int)
+			if id == 0 {
+				return errors.New("unauthorized")
+			}
+			return next(context.WithValue(ctx, userKey{}, "user-"+strconv.Itoa(id)))
+		},
+	}
+	client, err := Dial("tcp", startTestServer(t, server, &Profile{}))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	if err := client.Call("Profile.Whoami", 7, &reply); err != nil || reply != "user-7" {
+		t.Fatal("call error:", err, reply)
+	}
+	if err := client.Call("Profile.Whoami", 0, &reply); err == nil || err.Error() != "unauthorized" {
+		t.Fatal("expect unauthorized, got", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(order, ",") != "log,auth,log,auth" {
+		t.Fatal("unexpected interceptor order:", order)
+	}
+}
+
+func TestUnknownMethodHandler(t *testing.T) {
+	server := NewServer()
+	server.UnknownMethodHandler = func(ctx context.Context, h *codec.Header, body []byte) (interface{}, error) {
+		if h.ServiceMethod == "Gateway.Reject" {
+			return nil, errors.New("rejected")
+		}
+		if opt, _ := OptionFromContext(ctx); opt.CodecType != codec.GobType {
+			return h.ServiceMethod + ":" + string(body), nil
+		}
+		//gob的消息体带有连接上收到过的类型定义,可以单独解码
+		dec := gob.NewDecoder(bytes.NewReader(body))
+		if h.ServiceMethod == "Gateway.Raw" {
+			var raw codec.RawBytes
+			err := dec.Decode(&raw)
+			return h.ServiceMethod + ":" + string(raw), err
+		}
+		var args Args
+		err := dec.Decode(&args)
+		return fmt.Sprintf("%s:%d+%d", h.ServiceMethod, args.Num1, args.Num2), err
+	}
+	var foo Foo
+	addr := startTestServer(t, server, &foo)
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	if err := client.Call("Gateway.Proxy", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if reply != `Gateway.Proxy:{"Num1":1,"Num2":2}` {
+		t.Fatal("unexpected reply:", reply)
+	}
+	if err := client.Call("Gateway.Reject", Args{}, &reply); err == nil || err.Error() != "rejected" {
+		t.Fatal("expect handler error, got", err)
+	}
+	//注册过的方法不受影响
+	var sum int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatal("call error:", err, sum)
+	}
+	//gob连接上普通的参数,第二次调用时类型定义已经发送过,不再随消息体发送
+	gobClient, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = gobClient.Close() }()
+	for i := 1; i <= 2; i++ {
+		if err := gobClient.Call("Gateway.Proxy", Args{Num1: i, Num2: 2}, &reply); err != nil || reply != fmt.Sprintf("Gateway.Proxy:%d+2", i) {
+			t.Fatal("gob call error:", err, reply)
+		}
+	}
+	if err := gobClient.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatal("call error:", err, sum)
+	}
+	//按RawBytes发送的消息体
+	if err := gobClient.Call("Gateway.Raw", codec.RawBytes("payload"), &reply); err != nil || reply != "Gateway.Raw:payload" {
+		t.Fatal("call error:", err, reply)
+	}
+}
+
+func TestInterceptProxy(t *testing.T) {
+	var foo Foo
+	upstream, err := Dial("tcp", startTestServer(t, NewServer(), &foo), &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	//网关把proxy.前缀的请求原样转发给上游,不解码参数和返回值
+	gateway := NewServer()
+	gateway.Intercept("proxy.", func(ctx context.Context, h *codec.Header, body []byte) ([]byte, error) {
+		var reply json.RawMessage
+		err := upstream.Call(strings.TrimPrefix(h.ServiceMethod, "proxy."), json.RawMessage(body), &reply)
+		return reply, err
+	})
+	gateway.Intercept("proxy.Foo.Sleep", func(ctx context.Context, h *codec.Header, body []byte) ([]byte, error) {
+		return nil, errors.New("blocked")
+	})
+	var local Foo
+	client, err := Dial("tcp", startTestServer(t, gateway, &local), &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var sum int
+	if err := client.Call("proxy.Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+		t.Fatal("proxy call error:", err, sum)
+	}
+	//上游的错误原样返回
+	if err := client.Call("proxy.Foo.Missing", Args{}, &sum); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Fatal("expect upstream error, got", err)
+	}
+	//最长的前缀优先
+	if err := client.Call("proxy.Foo.Sleep", 1, &sum); err == nil || err.Error() != "blocked" {
+		t.Fatal("expect blocked, got", err)
+	}
+	//没有匹配前缀的请求按注册的服务处理
+	if err := client.Call("Foo.Sum", Args{Num1: 2, Num2: 3}, &sum); err != nil || sum != 5 {
+		t.Fatal("call error:", err, sum)
+	}
+	//取消拦截后找不到方法
+	gateway.Intercept("proxy.", nil)
+	if err := client.Call("proxy.Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err == nil || !strings.Contains(err.Error(), "can't find service") {
+		t.Fatal("expect can't find service, got", err)
+	}
+}
+
+//记录每个方法同时执行的最大数量
+type Reports struct {
+	lock    sync.Mutex
+	running map[string]int
+	peak    map[string]int
+}
+
+func (r *Reports) enter(name string) {
+	r.lock.Lock()
+	r.running[name]++
+	if r.running[name] > r.peak[name] {
+		r.peak[name] = r.running[name]
+	}
+	r.lock.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	r.lock.Lock()
+	r.running[name]--
+	r.lock.Unlock()
+}
+
+func (r *Reports) Generate(args int, reply *int) error {
+	r.enter("Generate")
+	return nil
+}
+
+func (r *Reports) List(args int, reply *int) error {
+	r.enter("List")
+	return nil
+}
+
+func TestMethodConcurrency(t *testing.T) {
+	reports := &Reports{running: make(map[string]int), peak: make(map[string]int)}
+	server := NewServer()
+	if err := server.Register(reports); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if err := server.SetMethodConcurrency("Reports.Generate", 1); err != nil {
+		t.Fatal("set concurrency error:", err)
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for _, method := range []string{"Reports.Generate", "Reports.List"} {
+			wg.Add(1)
+			go func(method string) {
+				defer wg.Done()
+				var reply int
+				if err := client.Call(method, 0, &reply); err != nil {
+					t.Error("call error:", err)
+				}
+			}(method)
+		}
+	}
+	wg.Wait()
+	reports.lock.Lock()
+	if reports.peak["Generate"] != 1 || reports.peak["List"] < 2 {
+		t.Fatal("unexpected peak concurrency:", reports.peak)
+	}
+	reports.lock.Unlock()
+	//开启拒绝后超过上限的请求直接返回错误
+	rejecting := NewServer()
+	rejecting.RejectOverConcurrency = true
+	if err := rejecting.Register(reports); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if err := rejecting.SetMethodConcurrency("Reports.Generate", 1); err != nil {
+		t.Fatal("set concurrency error:", err)
+	}
+	rejectingClient, err := Dial("tcp", startTestServer(t, rejecting))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = rejectingClient.Close() }()
+	calls := []*Call{
+		rejectingClient.Go("Reports.Generate", 0, new(int), nil),
+		rejectingClient.Go("Reports.Generate", 0, new(int), nil),
+	}
+	busy := 0
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil && call.Error.Error() == ErrMethodBusy.Error() {
+			busy++
+		}
+	}
+	if busy != 1 {
+		t.Fatal("expect one busy call, got", busy)
+	}
+}
+
+//读写同一个缓冲区的连接
+type loopbackConn struct {
+	bytes.Buffer
+}
+
+func (c *loopbackConn) Close() error {
+	return nil
+}
+
+//构造函数返回nil指针时调用返回错误,连接仍可使用
+func TestArgFactoryNilPointer(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	client, err := Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := server.SetArgFactory("Foo.Sum", func() interface{} { return (*Args)(nil) }); err != nil {
+		t.Fatal("set arg factory error:", err)
+	}
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "arg factory returned a nil pointer") {
+		t.Fatal("expect nil factory result rejected, got:", err)
+	}
+	_ = server.SetArgFactory("Foo.Sum", nil)
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error after rejected arg:", err, reply)
+	}
+}
+
+//较大的写入先通知waiting,再等待测试从release放行,小的写入不受影响
+type gatedConn struct {
+	net.Conn
+	waiting chan struct{}
+	release chan struct{}
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	if len(p) >= 8<<10 {
+		select {
+		case c.waiting <- struct{}{}:
+		default:
+		}
+		<-c.release
+	}
+	return c.Conn.Write(p)
+}
+
+type Blob struct{}
+
+func (b *Blob) Big(args int, reply *[]byte) error {
+	*reply = bytes.Repeat([]byte{'x'}, args)
+	return nil
+}
+
+func (b *Blob) Tiny(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func (b *Blob) Size(args []byte, reply *int) error {
+	*reply = len(args)
+	return nil
+}
+
+//等待服务端唯一连接的发送队列中有n个等待者
+func waitSendWaiters(t *testing.T, server *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		waiters := 0
+		server.conns.Range(func(_, value interface{}) bool {
+			q := value.(*serverConn).sendLock
+			q.lock.Lock()
+			waiters += len(q.waiters)
+			q.lock.Unlock()
+			return true
+		})
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("send queue waiters never reached", n)
+}
+
+func TestFramedReplyDoesNotBlock(t *testing.T) {
+	server := NewServer()
+	server.MaxFrameBytes = 16 << 10
+	if err := server.Register(&Blob{}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	gated := &gatedConn{Conn: serverConn, waiting: make(chan struct{}, 1), release: make(chan struct{})}
+	go server.ServeConn(gated)
+	client, err := NewClient(clientConn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, MaxFrameBytes: 16 << 10})
+	if err != nil {
+		t.Fatal("client error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	//按16KB分帧时有512帧,每帧的写入都要由测试放行
+	const size = 8 << 20
+	var big []byte
+	bigCall := client.Go("Blob.Big", size, &big, nil)
+	//等第一帧的写入被挡住,此时大响应持有发送权
+	<-gated.waiting
+	released := 0
+	for i := 0; i < 5; i++ {
+		var reply int
+		tiny := client.Go("Blob.Tiny", i, &reply, nil)
+		//小响应排进发送队列后只放行一帧,大响应释放发送权时应当交给小响应,而不是等整个大响应发完
+		waitSendWaiters(t, server, 1)
+		gated.release <- struct{}{}
+		released++
+		select {
+		case <-tiny.Done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tiny call blocked by big response, released frames:", released)
+		}
+		if tiny.Error != nil || reply != i {
+			t.Fatal("tiny call error:", tiny.Error, reply)
+		}
+		//大响应的下一帧被挡住后再发下一个小请求
+		<-gated.waiting
+		select {
+		case <-bigCall.Done:
+			t.Fatal("big call finished before tiny call, released frames:", released)
+		default:
+		}
+	}
+	close(gated.release)
+	<-bigCall.Done
+	if bigCall.Error != nil || len(big) != size || big[size-1] != 'x' {
+		t.Fatal("big call error:", bigCall.Error, len(big))
+	}
+	//分帧的请求在服务端拼接后再解码
+	var n int
+	if err := client.Call("Blob.Size", bytes.Repeat([]byte{'y'}, 100<<10), &n); err != nil || n != 100<<10 {
+		t.Fatal("framed request error:", err, n)
+	}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, info *RequestInfo, next func(ctx context.Context) error) error {
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			return next(ctx)
+		}
+	}
+	//各模块按任意顺序添加,由约束决定执行顺序: auth -> metrics -> log
+	interceptors, err := NewInterceptorChain().
+		Add("log", record("log")).
+		Add("metrics", record("metrics")).Before("log").
+		Add("auth", record("auth")).Before("metrics").
+		Build()
+	if err != nil {
+		t.Fatal("build error:", err)
+	}
+	server := NewServer()
+	server.Interceptors = interceptors
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	lock.Lock()
+	if strings.Join(order, ",") != "auth,metrics,log" {
+		t.Fatal("unexpected order:", order)
+	}
+	lock.Unlock()
+	if _, err := NewInterceptorChain().Add("a", record("a")).After("missing").Build(); err == nil {
+		t.Fatal("expect error for unknown interceptor")
+	}
+	if _, err := NewInterceptorChain().Add("a", record("a")).Before("b").Add("b", record("b")).Before("a").Build(); err == nil {
+		t.Fatal("expect error for cycle")
+	}
+	if _, err := NewInterceptorChain().Add("a", record("a")).Add("a", record("a")).Build(); err == nil {
+		t.Fatal("expect error for duplicate name")
+	}
+}
+
+type Users struct{}
+
+func (u *Users) Get(id int, reply *string) error {
+	if id == 0 {
+		return fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	return errors.New("database exploded")
+}
+
+func TestErrorToHTTPStatus(t *testing.T) {
+	server := NewServer()
+	server.EncodeErrorChains = true
+	client, err := Dial("tcp", startTestServer(t, server, &Users{}))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call("Users.Get", 0, &reply)
+	if status := ErrorToHTTPStatus(err); status != http.StatusNotFound {
+		t.Fatal("expect 404, got", status, err)
+	}
+	err = client.Call("Users.Get", 1, &reply)
+	if status := ErrorToHTTPStatus(err); status != http.StatusInternalServerError {
+		t.Fatal("expect 500, got", status, err)
+	}
+	if status := ErrorToHTTPStatus(nil); status != http.StatusOK {
+		t.Fatal("expect 200, got", status)
+	}
+}
+
+//生成只对127.0.0.1有效的自签名证书
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key error:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate error:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parse certificate error:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	server := NewServer()
+	var foo Foo
+	if err := server.Register(&foo); err != nil {
+		t.Fatal("register error:", err)
+	}
+	resumed := make(chan bool, 2)
+	server.OnConnect = func(conn io.ReadWriteCloser, state *tls.ConnectionState) {
+		resumed <- state != nil && state.DidResume
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	defer func() { _ = l.Close() }()
+	go server.ServeTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	config := &tls.Config{RootCAs: pool, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	for i, want := range []bool{false, true} {
+		client, err := DialTLS("tcp", l.Addr().String(), config)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		//TLS 1.3的会话票据在握手后发送,调用一次使客户端收到票据
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+			t.Fatal("call error:", err, reply)
+		}
+		state, ok := client.TLSConnectionState()
+		if !ok || state.DidResume != want {
+			t.Fatalf("connection %d: client DidResume=%v, want %v", i, state.DidResume, want)
+		}
+		if got := <-resumed; got != want {
+			t.Fatalf("connection %d: server DidResume=%v, want %v", i, got, want)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestMaxConnBytes(t *testing.T) {
+	var foo Foo
+	reasons := make(chan CloseReason, 1)
+	server := NewServer()
+	server.MaxConnBytes = 512
+	server.OnDisconnect = func(conn io.ReadWriteCloser, reason CloseReason) {
+		reasons <- reason
+	}
+	client, err := Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var calls int
+	for ; calls < 100; calls++ {
+		var reply int
+		if err := client.Call("Foo.Sum", Args{Num1: calls, Num2: 1}, &reply); err != nil {
+			break
+		}
+	}
+	if calls == 0 || calls == 100 {
+		t.Fatalf("expect connection closed after some calls, got %d successful calls", calls)
+	}
+	waitReason(t, reasons, BudgetExceeded)
+}
+
+func TestOverflowReject(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.MaxConnections = 1
+	server.OverflowPolicy = OverflowReject
+	addr := startTestServer(t, server, &foo)
+	first, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = first.Close() }()
+	var reply int
+	if err := first.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	second, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = second.Close() }()
+	if err := second.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err == nil {
+		t.Fatal("expect the connection over the limit to be closed")
+	}
+	//已有的连接不受影响
+	if err := first.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+}
+
+func TestOverflowCloseOldestIdle(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.MaxConnections = 1
+	server.OverflowPolicy = OverflowCloseOldestIdle
+	addr := startTestServer(t, server, &foo)
+	idle, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = idle.Close() }()
+	var reply int
+	if err := idle.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if err := idle.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err == nil {
+		t.Fatal("expect the idle connection to be evicted")
+	}
+}
+
+//等待args毫秒后返回请求所在连接的id
+type ConnIdentity struct{}
+
+func (c *ConnIdentity) ID(ctx context.Context, args int, reply *uint64) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	*reply, _ = ConnIDFromContext(ctx)
+	return nil
+}
+
+func TestServerCloseConn(t *testing.T) {
+	var identity ConnIdentity
+	server := NewServer()
+	addr := startTestServer(t, server, &identity)
+	closing, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = closing.Close() }()
+	other, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = other.Close() }()
+	var id uint64
+	if err := closing.Call("ConnIdentity.ID", 0, &id); err != nil {
+		t.Fatal("call error:", err)
+	}
+	//关闭前已在处理的请求仍能收到响应
+	var slowID uint64
+	slow := closing.Go("ConnIdentity.ID", 100, &slowID, nil)
+	time.Sleep(20 * time.Millisecond)
+	if err := server.CloseConn(context.Background(), id); err != nil {
+		t.Fatal("close conn error:", err)
+	}
+	if call := <-slow.Done; call.Error != nil || slowID != id {
+		t.Fatal("in-flight call error:", call.Error, slowID)
+	}
+	var reply uint64
+	if err := closing.Call("ConnIdentity.ID", 0, &reply); err == nil {
+		t.Fatal("expect calls on the closed connection to fail")
+	}
+	if err := other.Call("ConnIdentity.ID", 0, &reply); err != nil || reply == id {
+		t.Fatal("call error on other connection:", err, reply)
+	}
+	if err := server.CloseConn(context.Background(), id+1000); err == nil {
+		t.Fatal("expect error closing an unknown connection")
+	}
+}
+
+//在方法中关闭自己所在的连接
+type SelfCloser struct {
+	server *Server
+}
+
+func (s *SelfCloser) Close(ctx context.Context, args int, reply *int) error {
+	id, _ := ConnIDFromContext(ctx)
+	*reply = args
+	return s.server.CloseConn(ctx, id)
+}
+
+func TestServerCloseConnTimeout(t *testing.T) {
+	var identity ConnIdentity
+	server := NewServer()
+	addr := startTestServer(t, server, &identity, &SelfCloser{server: server})
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var id uint64
+	if err := client.Call("ConnIdentity.ID", 0, &id); err != nil {
+		t.Fatal("call error:", err)
+	}
+	//ctx结束时不再等待正在处理的请求
+	slow := client.Go("ConnIdentity.ID", 1000, new(uint64), nil)
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.CloseConn(ctx, id); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got:", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("CloseConn waited past its ctx")
+	}
+	if call := <-slow.Done; call.Error == nil {
+		t.Fatal("expect in-flight call to fail after forced close")
+	}
+
+	//方法中关闭自己的连接不会死锁,响应发出后连接关闭
+	self, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = self.Close() }()
+	var reply int
+	if err := self.Call("SelfCloser.Close", 7, &reply); err != nil || reply != 7 {
+		t.Fatal("self close call error:", err, reply)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := self.Call("SelfCloser.Close", 7, &reply); err == nil {
+		t.Fatal("expect connection closed after self close")
+	}
+}
+
+type Padded struct {
+	Data string
+}
+
+type Padding struct{}
+
+func (p *Padding) Len(data string, reply *int) error {
+	*reply = len(data)
+	return nil
+}
+
+func (p *Padding) Repeat(n int, reply *Padded) error {
+	reply.Data = strings.Repeat("x", n)
+	return nil
+}
+
+func TestMaxRequestAndReplyBytes(t *testing.T) {
+	var padding Padding
+	server := NewServer()
+	server.MaxRequestBytes = 1024
+	server.MaxReplyBytes = 1024
+	addr := startTestServer(t, server, &padding)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.CborType} {
+		client, err := Dial("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: typ})
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		var n int
+		err = client.Call("Padding.Len", strings.Repeat("x", 64<<10), &n)
+		if err == nil || !strings.Contains(err.Error(), codec.ErrBodyTooLarge.Error()) {
+			t.Fatal(typ, "expect oversized request rejected, got:", err)
+		}
+		if typ != codec.GobType {
+			//json和cbor的解码被中断,服务端在响应错误后关闭连接
+			if err := client.Call("Padding.Len", "small", &n); err == nil {
+				t.Fatal(typ, "expect connection closed after aborted decoding")
+			}
+			_ = client.Close()
+			if client, err = Dial("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: typ}); err != nil {
+				t.Fatal("dial error:", err)
+			}
+		}
+		if err := client.Call("Padding.Len", "small", &n); err != nil || n != 5 {
+			t.Fatal(typ, "call error after oversized request:", err, n)
+		}
+		//第一次响应就超限,其中的类型定义仍需送达,之后的响应才能解码
+		var reply Padded
+		err = client.Call("Padding.Repeat", 4096, &reply)
+		if err == nil || !strings.Contains(err.Error(), codec.ErrBodyTooLarge.Error()) {
+			t.Fatal(typ, "expect oversized reply rejected, got:", err)
+		}
+		if err := client.Call("Padding.Repeat", 10, &reply); err != nil || len(reply.Data) != 10 {
+			t.Fatal(typ, "call error after oversized reply:", err, len(reply.Data))
+		}
+		_ = client.Close()
+	}
+
+	//分帧的响应按完整的消息体检查
+	framed := NewServer()
+	framed.MaxReplyBytes = 1024
+	framed.MaxFrameBytes = 256
+	client, err := Dial("tcp", startTestServer(t, framed, &padding))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply Padded
+	err = client.Call("Padding.Repeat", 4096, &reply)
+	if err == nil || !strings.Contains(err.Error(), codec.ErrBodyTooLarge.Error()) {
+		t.Fatal("expect oversized framed reply rejected, got:", err)
+	}
+	if err := client.Call("Padding.Repeat", 10, &reply); err != nil || len(reply.Data) != 10 {
+		t.Fatal("call error after oversized framed reply:", err, len(reply.Data))
+	}
+}
+
+func TestHandleSignalsDrain(t *testing.T) {
+	var identity ConnIdentity
+	server := NewServer()
+	server.DrainTimeout = time.Second
+	addr := startTestServer(t, server, &identity)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var id uint64
+	if err := client.Call("ConnIdentity.ID", 0, &id); err != nil {
+		t.Fatal("call error:", err)
+	}
+	//模拟收到信号,不真正向进程发送
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	done := server.drainOnSignal(context.Background(), signals, func() { close(stopped) })
+	slow := client.Go("ConnIdentity.ID", 100, new(uint64), nil)
+	time.Sleep(20 * time.Millisecond)
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("drain error:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not finish")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expect signal handling to stop after the first signal")
+	}
+	if !server.Stats().Draining {
+		t.Fatal("expect server to stop accepting connections")
+	}
+	//已在处理的请求正常完成,之后连接被关闭
+	if call := <-slow.Done; call.Error != nil {
+		t.Fatal("in-flight call error:", call.Error)
+	}
+	if err := client.Call("ConnIdentity.ID", 0, &id); err == nil {
+		t.Fatal("expect calls after drain to fail")
+	}
+	//监听器已关闭,新连接不会被接收后挂起
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("expect listener to be closed after drain")
+	}
+}
+
+//ctx结束时停止处理信号,不会Drain
+func TestHandleSignalsStop(t *testing.T) {
+	server := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	done := server.drainOnSignal(ctx, make(chan os.Signal), func() { close(stopped) })
+	cancel()
+	select {
+	case err, ok := <-done:
+		if ok {
+			t.Fatal("expect done to be closed without a result, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signal handling did not stop")
+	}
+	<-stopped
+	if server.Stats().Draining {
+		t.Fatal("expect no drain without a signal")
+	}
+	//真正安装的处理也能通过ctx停止
+	ctx, cancel = context.WithCancel(context.Background())
+	done = server.HandleSignals(ctx, syscall.SIGUSR1)
+	cancel()
+	if _, ok := <-done; ok {
+		t.Fatal("expect done to be closed without a result")
+	}
+}
+
+//Drain唤醒暂停中的Accept并使其返回
+func TestDrainStopsPausedAccept(t *testing.T) {
+	server := NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("network error:", err)
+	}
+	defer func() { _ = l.Close() }()
+	server.Pause()
+	returned := make(chan struct{})
+	go func() {
+		server.Accept(l)
+		close(returned)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := server.Drain(context.Background()); err != nil {
+		t.Fatal("drain error:", err)
+	}
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after drain")
+	}
+	//暂停时已接收的连接被关闭,而不是一直挂起
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatal("expect accepted connection closed, got:", err)
+	}
+	//Drain之后Accept立即返回
+	server.Accept(l)
+}
+
+//ctx结束时Drain强制关闭剩余连接并返回
+func TestDrainTimeout(t *testing.T) {
+	var identity ConnIdentity
+	server := NewServer()
+	client, err := Dial("tcp", startTestServer(t, server, &identity))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	slow := client.Go("ConnIdentity.ID", 1000, new(uint64), nil)
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got:", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("Drain waited past its ctx")
+	}
+	if call := <-slow.Done; call.Error == nil {
+		t.Fatal("expect in-flight call to fail after forced close")
+	}
+}
+
+//共享的依赖
+type counterStore struct {
+	created int32
+}
+
+//每个连接独占的实例,保存该连接上的调用次数
+type Session struct {
+	store *counterStore
+	calls int
+}
+
+func (s *Session) Incr(args int, reply *int) error {
+	s.calls += args
+	*reply = s.calls
+	return nil
+}
+
+func TestRegisterFactory(t *testing.T) {
+	store := new(counterStore)
+	server := NewServer()
+	err := server.RegisterFactory("Session", func() interface{} {
+		atomic.AddInt32(&store.created, 1)
+		return &Session{store: store}
+	})
+	if err != nil {
+		t.Fatal("register error:", err)
+	}
+	addr := startTestServer(t, server)
+	first, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = first.Close() }()
+	second, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = second.Close() }()
+	var reply int
+	for i, expect := range []int{1, 2} {
+		if err := first.Call("Session.Incr", 1, &reply); err != nil || reply != expect {
+			t.Fatalf("call %d on first connection: %v %d", i, err, reply)
+		}
+	}
+	//另一个连接有自己的实例
+	if err := second.Call("Session.Incr", 1, &reply); err != nil || reply != 1 {
+		t.Fatal("call on second connection:", err, reply)
+	}
+	//注册时创建一次,之后每个连接各一次
+	if created := atomic.LoadInt32(&store.created); created != 3 {
+		t.Fatalf("expect 3 instances, got %d", created)
+	}
+	if err := server.RegisterFactory("session", func() interface{} { return &Session{} }); err == nil {
+		t.Fatal("expect error for unexported service name")
+	}
+}
+
+//压缩握手中夹带大量可压缩的数据
+func TestCompressedHandshakeBomb(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(compressedOptionPrefix)
+	zw := gzip.NewWriter(&buf)
+	_, _ = fmt.Fprintf(zw, `{"MagicNumber":%d,"CodecType":"%s","Padding":"`, MagicNumber, codec.GobType)
+	_, _ = zw.Write(bytes.Repeat([]byte{'a'}, 8<<20))
+	_, _ = zw.Write([]byte(`"}`))
+	_ = zw.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := readOption(bytes.NewReader(buf.Bytes()), DefaultMaxDecompressionRatio)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrDecompressionRatio) {
+		t.Fatal("expect ErrDecompressionRatio, got:", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2<<20 {
+		t.Fatalf("expect no large allocation, got %d bytes", allocated)
+	}
+
+	//服务端关闭发送了这种握手的连接
+	addr, reasons := startReasonServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	go func() { _, _ = conn.Write(buf.Bytes()) }()
+	waitReason(t, reasons, DecodeError)
+}
+
+//解码很慢的类型
+type SlowDecoding struct {
+	Value int
+}
+
+func (s SlowDecoding) MarshalBinary() ([]byte, error) {
+	return []byte{byte(s.Value)}, nil
+}
+
+func (s *SlowDecoding) UnmarshalBinary(data []byte) error {
+	time.Sleep(50 * time.Millisecond)
+	s.Value = int(data[0])
+	return nil
+}
+
+func (s *Slow) Decode(args SlowDecoding, reply *int) error {
+	*reply = args.Value
+	return nil
+}
+
+func TestMaxDecodeTime(t *testing.T) {
+	var slow Slow
+	server := NewServer()
+	server.MaxDecodeTime = 10 * time.Millisecond
+	client, err := Dial("tcp", startTestServer(t, server, &slow))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Slow.Decode", SlowDecoding{Value: 1}, &reply)
+	if err == nil || err.Error() != ErrDecodeBudget.Error() {
+		t.Fatal("expect ErrDecodeBudget, got:", err)
+	}
+	//解码快的请求不受影响
+	if err := client.Call("Slow.Encode", 2, new(SlowEncoding)); err != nil {
+		t.Fatal("call error:", err)
+	}
+}
+
+//等待消息体到达的时间不计入MaxDecodeTime
+func TestMaxDecodeTimeExcludesNetworkWait(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.MaxDecodeTime = 10 * time.Millisecond
+	conn, err := net.Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(DefaultOption)
+	buf := new(loopbackConn)
+	if err := codec.NewGobCodecFunc(buf).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal("encode error:", err)
+	}
+	//消息体的最后一个字节延迟发送
+	data := buf.Bytes()
+	_, _ = conn.Write(data[:len(data)-1])
+	time.Sleep(50 * time.Millisecond)
+	_, _ = conn.Write(data[len(data)-1:])
+	cc := codec.NewGobCodecFunc(conn)
+	var h codec.Header
+	var reply int
+	if err := cc.ReadHeader(&h); err != nil || h.Error != "" {
+		t.Fatal("expect request to succeed:", err, h.Error)
+	}
+	if err := cc.ReadBody(&reply); err != nil || reply != 3 {
+		t.Fatal("read reply error:", err, reply)
+	}
+}
+
+func TestSlowHandlerWatchdog(t *testing.T) {
+	var identity ConnIdentity
+	slow := make(chan time.Duration, 1)
+	server := NewServer()
+	server.SlowHandlerThreshold = 20 * time.Millisecond
+	server.OnSlowHandler = func(serviceMethod string, elapsed time.Duration) {
+		if serviceMethod == "ConnIdentity.ID" {
+			slow <- elapsed
+		}
+	}
+	client, err := Dial("tcp", startTestServer(t, server, &identity))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var id uint64
+	if err := client.Call("ConnIdentity.ID", 100, &id); err != nil || id == 0 {
+		t.Fatal("expect slow call to complete normally:", err, id)
+	}
+	select {
+	case elapsed := <-slow:
+		if elapsed < server.SlowHandlerThreshold {
+			t.Fatal("callback fired too early:", elapsed)
+		}
+	default:
+		t.Fatal("expect OnSlowHandler to fire")
+	}
+	//没有超过阈值的调用不回调
+	if err := client.Call("ConnIdentity.ID", 0, &id); err != nil {
+		t.Fatal("call error:", err)
+	}
+	select {
+	case elapsed := <-slow:
+		t.Fatal("unexpected slow handler callback:", elapsed)
+	default:
+	}
+}
+
+func TestBufferSizeHint(t *testing.T) {
+	server := NewServer()
+	var identity ConnIdentity
+	_ = server.Register(&identity)
+	addr := startTestServer(t, server)
+	sizes := func(option *Option) (clientSize, serverSize int) {
+		client, err := Dial("tcp", addr, option)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		defer func() { _ = client.Close() }()
+		var id uint64
+		if err := client.Call("ConnIdentity.ID", 0, &id); err != nil {
+			t.Fatal("call error:", err)
+		}
+		value, ok := server.conns.Load(id)
+		if !ok {
+			t.Fatal("connection not tracked:", id)
+		}
+		return client.c.(codec.BufferSizer).BufferSize(), value.(*serverConn).c.(codec.BufferSizer).BufferSize()
+	}
+	if c, s := sizes(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType}); c != codec.DefaultBufferSize || s != codec.DefaultBufferSize {
+		t.Fatal("expect default buffer sizes:", c, s)
+	}
+	//默认不按客户端的声明扩大服务端的缓冲区
+	if c, s := sizes(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, BufferSize: 256 << 10}); c != 256<<10 || s != codec.DefaultBufferSize {
+		t.Fatal("expect server to ignore the hint by default:", c, s)
+	}
+	server.MaxBufferSize = 64 << 10
+	if c, s := sizes(&Option{MagicNumber: MagicNumber, CodecType: codec.JsonType, BufferSize: 256 << 10}); c != 256<<10 || s != 64<<10 {
+		t.Fatal("expect server buffer clamped to MaxBufferSize:", c, s)
+	}
+	if c, s := sizes(&Option{MagicNumber: MagicNumber, CodecType: codec.JsonType, BufferSize: 32 << 10}); c != 32<<10 || s != 32<<10 {
+		t.Fatal("expect buffers sized by the hint:", c, s)
+	}
+}
+
+//没有导出字段的类型gob无法编码,但可以通过MarshalJSON编码成json
+type Opaque struct {
+	value int
+}
+
+func (o Opaque) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.value)
+}
+
+func (o *Opaque) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &o.value)
+}
+
+type OpaqueService struct{}
+
+func (s *OpaqueService) Wrap(args int, reply *Opaque) error {
+	reply.value = args
+	return nil
+}
+
+func TestFallbackCodec(t *testing.T) {
+	var svc OpaqueService
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &svc, &foo)
+	var reply Opaque
+	plain, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = plain.Close() }()
+	if err := plain.Call("OpaqueService.Wrap", 1, &reply); err == nil {
+		t.Fatal("expect gob to fail without fallback")
+	}
+	client, err := Dial("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, FallbackCodec: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	for i := 1; i <= 3; i++ {
+		if err := client.Call("OpaqueService.Wrap", i, &reply); err != nil || reply.value != i {
+			t.Fatal("expect reply through the json fallback:", err, reply.value)
+		}
+		//回退只影响该消息,之后的gob消息不受影响
+		var sum int
+		if err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &sum); err != nil || sum != i+1 {
+			t.Fatal("expect gob call after fallback:", err, sum)
+		}
+	}
+}
+
+func TestSetDispatchPipeline(t *testing.T) {
+	server := NewServer()
+	server.MethodRewriter = func(serviceMethod string) string {
+		return strings.Replace(serviceMethod, "Alias.", "Foo.", 1)
+	}
+	server.UnknownMethodHandler = func(ctx context.Context, h *codec.Header, body []byte) (interface{}, error) {
+		return -1, nil
+	}
+	var foo Foo
+	client, err := Dial("tcp", startTestServer(t, server, &foo), &Option{CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	sum := func(serviceMethod string) (int, error) {
+		var reply int
+		err := client.Call(serviceMethod, Args{Num1: 1, Num2: 2}, &reply)
+		return reply, err
+	}
+	if reply, err := sum("Alias.Sum"); err != nil || reply != 3 {
+		t.Fatal("expect rewritten call to reach Foo.Sum:", err, reply)
+	}
+	if err := server.SetDispatchPipeline(StageService, StageService); err == nil {
+		t.Fatal("expect error for duplicate stages")
+	}
+	//兜底处理放在查找服务之前,注册的服务不再生效
+	if err := server.SetDispatchPipeline(StageRewrite, StageUnknown, StageService); err != nil {
+		t.Fatal("set pipeline error:", err)
+	}
+	if reply, err := sum("Foo.Sum"); err != nil || reply != -1 {
+		t.Fatal("expect catch-all to handle Foo.Sum:", err, reply)
+	}
+	//去掉改写和兜底处理
+	_ = server.SetDispatchPipeline(StageService)
+	if _, err := sum("Alias.Sum"); err == nil || !strings.Contains(err.Error(), "can't find service") {
+		t.Fatal("expect Alias.Sum not to be rewritten:", err)
+	}
+	if reply, err := sum("Foo.Sum"); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+	//默认顺序下拦截在改写之后,查找服务之前
+	server.Intercept("Foo.", func(ctx context.Context, h *codec.Header, body []byte) ([]byte, error) {
+		return []byte("100"), nil
+	})
+	_ = server.SetDispatchPipeline()
+	if reply, err := sum("Alias.Sum"); err != nil || reply != 100 {
+		t.Fatal("expect rewritten call to be intercepted:", err, reply)
+	}
+	//拦截放在查找服务之后,只处理没有注册的方法
+	if err := server.SetDispatchPipeline(StageRewrite, StageService, StageIntercept); err != nil {
+		t.Fatal("set pipeline error:", err)
+	}
+	if reply, err := sum("Alias.Sum"); err != nil || reply != 3 {
+		t.Fatal("expect registered Foo.Sum before intercept:", err, reply)
+	}
+	if reply, err := sum("Foo.Missing"); err != nil || reply != 100 {
+		t.Fatal("expect missing method to be intercepted:", err, reply)
+	}
+	_ = server.SetDispatchPipeline()
+	if got := fmt.Sprint(server.DispatchPipeline()); got != "[rewrite intercept typed service unknown]" {
+		t.Fatal("expect default pipeline, got", got)
+	}
+}
+
+type Chat struct {
+	//Wait的ctx被取消时通知
+	canceled chan struct{}
+}
+
+//读完客户端的所有消息后,按收到的消息之和依次发送5条回复
+func (c *Chat) Echo(ctx context.Context, stream *ServerStream, reply *struct{}) error {
+	total := 0
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	for i := 0; i < 5; i++ {
+		if err := stream.Send(total + i); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if err := stream.Send(0); err != ErrStreamSendClosed {
+		return fmt.Errorf("expect ErrStreamSendClosed, got %v", err)
+	}
+	return nil
+}
+
+func TestStreamCloseSend(t *testing.T) {
+	var chat Chat
+	var foo Foo
+	addr := startTestServer(t, NewServer(), &chat, &foo)
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := Dial("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: codecType})
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		stream, err := client.OpenStream("Chat.Echo")
+		if err != nil {
+			t.Fatal("open stream error:", err)
+		}
+		for i := 1; i <= 3; i++ {
+			if err := stream.Send(i); err != nil {
+				t.Fatal("send error:", err)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal("close send error:", err)
+		}
+		if err := stream.Send(4); err != ErrStreamSendClosed {
+			t.Fatal("expect ErrStreamSendClosed, got", err)
+		}
+		//半关闭后仍可以接收服务端的回复,同一连接上的其他调用不受影响
+		var sum int
+		if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum); err != nil || sum != 3 {
+			t.Fatal("call error:", err, sum)
+		}
+		for i := 0; i < 5; i++ {
+			var n int
+			if err := stream.Recv(&n); err != nil || n != 6+i {
+				t.Fatal("expect reply after half-close:", err, n)
+			}
+		}
+		var n int
+		if err := stream.Recv(&n); err != io.EOF {
+			t.Fatal("expect io.EOF after server half-close, got", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatal("stream error:", err)
+		}
+		//流方法不能按普通调用调用
+		if err := client.Call("Chat.Echo", 1, new(struct{})); err == nil || !strings.Contains(err.Error(), "stream method") {
+			t.Fatal("expect stream method error, got", err)
+		}
+		_ = client.Close()
+	}
+}
+
+//客户端放弃流时服务端方法的ctx被取消
+func (c *Chat) Wait(ctx context.Context, stream *ServerStream, reply *struct{}) error {
+	<-ctx.Done()
+	c.canceled <- struct{}{}
+	return ctx.Err()
+}
+
+func TestStreamClose(t *testing.T) {
+	chat := Chat{canceled: make(chan struct{}, 1)}
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &chat))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	stream, err := client.OpenStream("Chat.Wait")
+	if err != nil {
+		t.Fatal("open stream error:", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+	if err := stream.Wait(); err != ErrStreamClosed {
+		t.Fatal("expect ErrStreamClosed, got", err)
+	}
+	select {
+	case <-chat.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expect the server ctx to be canceled")
+	}
+	if err := stream.Recv(new(int)); err != ErrStreamClosed {
+		t.Fatal("expect ErrStreamClosed from Recv, got", err)
+	}
+	//服务端找不到方法时Wait返回错误
+	missing, err := client.OpenStream("Chat.Missing")
+	if err != nil {
+		t.Fatal("open stream error:", err)
+	}
+	if err := missing.Wait(); err == nil {
+		t.Fatal("expect error for missing stream method")
+	}
+}
+
+func TestShedInFlight(t *testing.T) {
+	server := NewServer()
+	server.ShedInFlight = 1
+	var slow Slow
+	addr := startTestServer(t, server, &slow)
+	busy, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = busy.Close() }()
+	call := busy.Go("Slow.Wait", 300, new(int), nil)
+	for len(server.InFlight()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	//过载期间新连接被直接关闭
+	rejected, err := Dial("tcp", addr)
+	if err == nil {
+		err = rejected.Call("Slow.Wait", 0, new(int))
+		_ = rejected.Close()
+	}
+	if err == nil {
+		t.Fatal("expect new connection to be rejected while overloaded")
+	}
+	//负载降下来后恢复接收
+	if (<-call.Done).Error != nil {
+		t.Fatal("slow call error:", call.Error)
+	}
+	for len(server.InFlight()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Call("Slow.Wait", 0, new(int)); err != nil {
+		t.Fatal("expect connection accepted after load drops:", err)
+	}
+}
+
+func TestMethodNamer(t *testing.T) {
+	server := NewServer()
+	server.MethodNamer = LowercaseMethodNamer
+	var foo Foo
+	if err := server.Register(&foo); err != nil {
+		t.Fatal("register error:", err)
+	}
+	addr := startTestServer(t, server)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("foo.sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("expect foo.sum to be registered:", err, reply)
+	}
+	//Go的名字不再可用
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err == nil {
+		t.Fatal("expect Foo.Sum not to be registered")
+	}
+	//按方法名分区注册时同样生效
+	partitioned := NewServer()
+	partitioned.MethodNamer = SnakeCaseMethodNamer
+	if err := partitioned.RegisterPartition("FooPart", &foo, []string{"Sum"}); err != nil {
+		t.Fatal("register partition error:", err)
+	}
+	if _, _, err := partitioned.findService("foo_part.sum"); err != nil {
+		t.Fatal("expect foo_part.sum to be registered:", err)
+	}
+	//映射后重名或名字不合法时注册失败
+	collide := NewServer()
+	collide.MethodNamer = LowercaseMethodNamer
+	if err := collide.Register(new(URLs)); err == nil || !strings.Contains(err.Error(), "geturl") {
+		t.Fatal("expect duplicate mapped name error, got:", err)
+	}
+	if _, _, err := collide.findService("urls.geturl"); err == nil {
+		t.Fatal("expect failed service not to be registered")
+	}
+	for _, namer := range []MethodNamer{
+		func(structName, methodName string) (string, string) { return "", methodName },
+		func(structName, methodName string) (string, string) { return structName, "v1." + methodName },
+	} {
+		invalid := NewServer()
+		invalid.MethodNamer = namer
+		if err := invalid.Register(&foo); err == nil || !strings.Contains(err.Error(), "invalid name") {
+			t.Fatal("expect invalid mapped name error, got:", err)
+		}
+	}
+}
+
+//小写后方法名相同
+type URLs struct{}
+
+func (u *URLs) GetURL(args int, reply *int) error {
+	return nil
+}
+
+func (u *URLs) GetUrl(args int, reply *int) error {
+	return nil
+}
+
+//查找服务失败后再查找按类型注册的函数,找不到时仍然返回错误而不是空的方法
+func TestDispatchPipelineTypedAfterService(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	if err := server.SetDispatchPipeline(StageService, StageTyped); err != nil {
+		t.Fatal("set pipeline error:", err)
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("Foo.Missing", Args{Num1: 1, Num2: 2}, &reply); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Fatal("expect can't find method error, got", err)
+	}
+	//连接仍然可用
+	if err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+}
+
+//双方同时持续发送时,连接的读取协程不会因为对端的发送而阻塞
+func (c *Chat) Flood(ctx context.Context, stream *ServerStream, reply *struct{}) error {
+	errs := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 64<<10)
+		for i := 0; i < 100; i++ {
+			if err := stream.Send(payload); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- stream.CloseSend()
+	}()
+	for {
+		var payload []byte
+		err := stream.Recv(&payload)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return <-errs
+}
+
+func TestStreamConcurrentSend(t *testing.T) {
+	var chat Chat
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &chat))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	stream, err := client.OpenStream("Chat.Flood")
+	if err != nil {
+		t.Fatal("open stream error:", err)
+	}
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			var payload []byte
+			if err := stream.Recv(&payload); err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+	payload := make([]byte, 64<<10)
+	for i := 0; i < 100; i++ {
+		if err := stream.Send(payload); err != nil {
+			t.Fatal("send error:", err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal("close send error:", err)
+	}
+	select {
+	case n := <-received:
+		if n != 100 {
+			t.Fatal("expect 100 messages, got", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream deadlocked")
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatal("stream error:", err)
+	}
+}
+
+//未读取的消息超过上限时终止流
+func TestStreamBufferFull(t *testing.T) {
+	defer func(n int) { MaxStreamBufferBytes = n }(MaxStreamBufferBytes)
+	MaxStreamBufferBytes = 256 << 10
+	var chat Chat
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &chat))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	stream, err := client.OpenStream("Chat.Flood")
+	if err != nil {
+		t.Fatal("open stream error:", err)
+	}
+	//不读取服务端的消息
+	if err := stream.Wait(); err != ErrStreamBufferFull {
+		t.Fatal("expect ErrStreamBufferFull, got", err)
+	}
+	if err := stream.Recv(new([]byte)); err != ErrStreamBufferFull {
+		t.Fatal("expect ErrStreamBufferFull from Recv, got", err)
+	}
+}
+
+//逐个处理流式参数,记录服务端缓冲的未处理元素的最大字节数
+type Tally struct {
+	maxQueued int
+}
+
+func (s *Tally) Sum(ctx context.Context, args *ArgStream, reply *int64) error {
+	var item int
+	for count := 1; args.Next(&item); count++ {
+		*reply += int64(item)
+		args.stream.lock.Lock()
+		if args.stream.queued > s.maxQueued {
+			s.maxQueued = args.stream.queued
+		}
+		args.stream.lock.Unlock()
+		//处理得比客户端发送得慢
+		if count%1000 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return args.Err()
+}
+
+//只处理第一个元素就返回
+func (s *Tally) First(ctx context.Context, args *ArgStream, reply *int64) error {
+	var item int
+	if args.Next(&item) {
+		*reply = int64(item)
+	}
+	return args.Err()
+}
+
+func TestCallArgStream(t *testing.T) {
+	defer func(n int) { MaxStreamBufferBytes = n }(MaxStreamBufferBytes)
+	MaxStreamBufferBytes = 16 << 10
+	var tally Tally
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &tally))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	items := make([]int, 100000)
+	var want int64
+	for i := range items {
+		items[i] = i
+		want += int64(i)
+	}
+	var sum int64
+	if err := client.CallArgStream(context.Background(), "Tally.Sum", items, &sum); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if sum != want {
+		t.Fatalf("expect sum %d, got %d", want, sum)
+	}
+	//服务端缓冲的元素不超过客户端的窗口加上一个元素
+	if tally.maxQueued == 0 || tally.maxQueued > MaxStreamBufferBytes/2+64 {
+		t.Fatal("expect bounded server buffer, got", tally.maxQueued)
+	}
+	//方法提前返回时客户端不再发送剩余的元素
+	var first int64
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.CallArgStream(ctx, "Tally.First", []int{7, 8, 9}, &first); err != nil || first != 7 {
+		t.Fatal("expect first item:", err, first)
+	}
+	if err := client.CallArgStream(ctx, "Tally.First", items, &first); err != nil || first != 0 {
+		t.Fatal("expect early return:", err, first)
+	}
+	if err := client.Call("Tally.Sum", items, &sum); err == nil || !strings.Contains(err.Error(), "CallArgStream") {
+		t.Fatal("expect plain call to be rejected, got", err)
+	}
+	if err := client.CallArgStream(ctx, "Tally.Sum", 1, &sum); err == nil {
+		t.Fatal("expect error for non-slice items")
+	}
+}
+
+//分帧请求拼接后同样受MaxRequestBytes限制,正在拼接的请求数也有上限
+func TestFramedRequestLimits(t *testing.T) {
+	//服务端没有开启MaxFrameBytes时拒绝分帧的请求,连接仍可使用
+	disabled, err := Dial("tcp", startTestServer(t, NewServer(), &Blob{}), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, MaxFrameBytes: 16 << 10})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = disabled.Close() }()
+	var n int
+	if err := disabled.Call("Blob.Size", make([]byte, 32<<10), &n); err == nil || !strings.Contains(err.Error(), errFramingDisabled.Error()) {
+		t.Fatal("expect errFramingDisabled, got", err)
+	}
+	if err := disabled.Call("Blob.Size", make([]byte, 1<<10), &n); err != nil || n != 1<<10 {
+		t.Fatal("expect connection usable after rejected framed request:", err, n)
+	}
+
+	server := NewServer()
+	server.MaxFrameBytes = 16 << 10
+	server.MaxRequestBytes = 64 << 10
+	addr := startTestServer(t, server, &Blob{})
+	client, err := Dial("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, MaxFrameBytes: 16 << 10})
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Call("Blob.Size", make([]byte, 256<<10), &n); err == nil || !strings.Contains(err.Error(), codec.ErrBodyTooLarge.Error()) {
+		t.Fatal("expect ErrBodyTooLarge for framed request, got", err)
+	}
+	if err := client.Call("Blob.Size", make([]byte, 32<<10), &n); err != nil || n != 32<<10 {
+		t.Fatal("expect connection usable after oversized request:", err, n)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(DefaultOption)
+	cc := codec.NewGobCodecFunc(conn)
+	//只发送第一帧,不发送最后一帧
+	for seq := uint64(1); seq <= maxPendingFramedRequests+1; seq++ {
+		h := &codec.Header{ServiceMethod: "Blob.Size", Seq: seq, Metadata: map[string]string{FrameKey: frameMore}}
+		if err := cc.Write(h, []byte("x")); err != nil {
+			break
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var h codec.Header
+	if err := cc.ReadHeader(&h); err == nil {
+		t.Fatal("expect connection closed after too many framed requests")
+	}
+}
@@ -1,9 +1,13 @@
 package gorpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -17,6 +21,22 @@ type methodType struct {
 	ReplyType reflect.Type
 	//方法次数
 	numCalls uint64
+	//第一个参数是否为context.Context, func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+	withContext bool
+	//最后一个参数是否为CallOptions, func (t *T) MethodName([ctx context.Context,] argType T1, replyType *T2, opts CallOptions) error
+	withOptions bool
+	//复用arg的对象池,保存指向arg的指针
+	argPool sync.Pool
+	//复用reply的对象池,保存reply指针
+	replyPool sync.Pool
+	//reply为slice或map时预分配的容量,0表示不预分配
+	replyCap int64
+	//方法的类别,决定处理时context的超时时间
+	category int32
+	//限制并发数的信号量,保存chan struct{},为nil时不限制
+	sem atomic.Value
+	//SetArgFactory设置的arg构造函数,保存func() interface{},为nil时通过反射创建
+	argFactory atomic.Value
 }
 
 func (m *methodType) NumCalls() uint64 {
@@ -25,6 +45,14 @@ func (m *methodType) NumCalls() uint64 {
 
 //获取arg的值
 func (m *methodType) newArgv() reflect.Value {
+	if factory, _ := m.argFactory.Load().(func() interface{}); factory != nil {
+		argv := reflect.ValueOf(factory())
+		if m.ArgType.Kind() != reflect.Ptr {
+			//构造函数返回的是指针,取出实际的值
+			argv = argv.Elem()
+		}
+		return argv
+	}
 	//第一个参数值
 	var argv reflect.Value
 	//如果arg的类型为指针
@@ -38,21 +66,75 @@ func (m *methodType) newArgv() reflect.Value {
 	return argv
 }
 
+//从对象池获取arg的值并清零,池为空时新建
+//清零会覆盖整个值(包括嵌套的指针,map和slice),避免gob省略零值字段时残留上一次请求的数据
+func (m *methodType) pooledArgv() reflect.Value {
+	ptr := m.argPool.Get()
+	if ptr == nil {
+		return m.newArgv()
+	}
+	argv := reflect.ValueOf(ptr)
+	if m.ArgType.Kind() == reflect.Ptr {
+		argv.Elem().Set(reflect.Zero(m.ArgType.Elem()))
+		return argv
+	}
+	argv = argv.Elem()
+	argv.Set(reflect.Zero(m.ArgType))
+	return argv
+}
+
+//将用完的arg放回对象池
+func (m *methodType) releaseArgv(argv reflect.Value) {
+	if m.ArgType.Kind() == reflect.Ptr {
+		m.argPool.Put(argv.Interface())
+	} else {
+		m.argPool.Put(argv.Addr().Interface())
+	}
+}
+
 //获取reply的值
 func (m *methodType) newReply() reflect.Value {
 	//reply一定是指针类型
 	reply := reflect.New(m.ReplyType.Elem())
+	capacity := int(atomic.LoadInt64(&m.replyCap))
 	switch m.ReplyType.Elem().Kind() {
 	case reflect.Map:
 		//如果是map,需要实例化
-		reply.Elem().Set(reflect.MakeMap(m.ReplyType.Elem()))
+		reply.Elem().Set(reflect.MakeMapWithSize(m.ReplyType.Elem(), capacity))
 	case reflect.Slice:
 		//同理
-		reply.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
+		reply.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, capacity))
 	}
 	return reply
 }
 
+//从对象池获取reply并重置,池为空时新建
+//slice重置为长度0,map清空所有key,都保留已分配的空间;其他类型整体清零
+func (m *methodType) pooledReply() reflect.Value {
+	ptr := m.replyPool.Get()
+	if ptr == nil {
+		return m.newReply()
+	}
+	reply := reflect.ValueOf(ptr)
+	elem := reply.Elem()
+	switch elem.Kind() {
+	case reflect.Slice:
+		elem.SetLen(0)
+	case reflect.Map:
+		for _, key := range elem.MapKeys() {
+			elem.SetMapIndex(key, reflect.Value{})
+		}
+	default:
+		elem.Set(reflect.Zero(elem.Type()))
+	}
+	return reply
+}
+
+//将已发送完的reply放回对象池
+func (m *methodType) releaseReply(reply reflect.Value) {
+	m.replyPool.Put(reply.Interface())
+}
+
 //结构体映射成服务service
 type service struct {
 	//结构体名称
@@ -63,64 +145,178 @@ type service struct {
 	instance reflect.Value
 	//存储结构体的方法名->方法
 	method map[string]*methodType
+	//不为nil时每个连接使用factory创建的实例,instance只用于注册
+	factory func() interface{}
+	//通过校验的方法名,按方法的顺序,加入Server后由commit注册gob类型和回调
+	names []string
+}
+
+//方法注册回调,每个通过校验的方法注册时调用一次
+type registerMethodFunc func(serviceName, methodName string, mt *methodType)
+
+//根据结构体实例实例化service,onRegister可以为nil
+func newService(structInstance interface{}, onRegister registerMethodFunc) *service {
+	//没有MethodNamer时不会出现重名
+	s, _ := newFilteredService(structInstance, "", methodRules{})
+	s.commit(onRegister)
+	return s
+}
+
+//注册方法时的过滤和命名规则
+type methodRules struct {
+	//只注册其中的方法,为nil时注册全部合法的方法
+	names map[string]bool
+	//不为nil时按它设置服务名和方法名
+	namer MethodNamer
+	//方法数上限,超过时注册失败,0表示不限制
+	max int
 }
 
-//根据结构体实例实例化service
-func newService(structInstance interface{}) *service {
+//按rules过滤和命名注册的方法;name为空时使用结构体的类型名,MethodNamer映射出重名或不合法的名字时返回错误
+//只做校验,还没有注册gob类型和调用回调,见commit
+func newFilteredService(structInstance interface{}, name string, rules methodRules) (*service, error) {
 	s := new(service)
 	s.instance = reflect.ValueOf(structInstance)
-	s.name = reflect.Indirect(s.instance).Type().Name()
+	s.name = name
+	if s.name == "" {
+		s.name = reflect.Indirect(s.instance).Type().Name()
+	}
 	s.typ = reflect.TypeOf(structInstance)
 	//判断该结构体是否合法
 	if !ast.IsExported(s.name) {
 		log.Fatalf("rpc server: %s is not a valid server name", s.name)
 	}
 	//注册方法
-	s.registerMethods()
-	return s
+	if err := s.registerMethods(rules); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 //将方法注册进去
-func (s *service) registerMethods() {
+func (s *service) registerMethods(rules methodRules) error {
 	s.method = make(map[string]*methodType)
+	s.names = nil
+	structName, mapped := s.name, false
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		//获取方法
 		method := s.typ.Method(i)
+		if rules.names != nil && !rules.names[method.Name] {
+			continue
+		}
 		mType := method.Type
-		//判断是否有三个入参(实例本身,入参,指针类型的返回值),是否有一个返回值(也就是error)
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		//判断是否有三个入参(实例本身,入参,指针类型的返回值),或者在入参前多一个context.Context,在最后多一个CallOptions,是否有一个返回值(也就是error)
+		numIn := mType.NumIn()
+		withContext := (numIn == 4 || numIn == 5) && mType.In(1) == typeOfContext
+		withOptions := (numIn == 4 || numIn == 5) && mType.In(numIn-1) == typeOfCallOptions
+		//4个入参时只能是context.Context和CallOptions中的一个,5个入参时两者都要有
+		valid := numIn == 3 || (numIn == 4 && withContext != withOptions) || (numIn == 5 && withContext && withOptions)
+		if !valid || mType.NumOut() != 1 {
 			continue
 		}
 		//判断返回值是否是error类型
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if mType.Out(0) != typeOfError {
 			continue
 		}
 		//获取两个参数
-		argType, replyType := mType.In(1), mType.In(2)
+		argIndex := 1
+		if withContext {
+			argIndex = 2
+		}
+		argType, replyType := mType.In(argIndex), mType.In(argIndex+1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		//reply必须是指针,否则方法无法把结果写回
+		if replyType.Kind() != reflect.Ptr {
+			log.Printf("rpc server: skip %s.%s, reply type %s is not a pointer", s.name, method.Name, replyType)
+			continue
+		}
+		name := method.Name
+		if rules.namer != nil {
+			var serviceName string
+			serviceName, name = rules.namer(structName, method.Name)
+			if invalidMappedName(serviceName) || invalidMappedName(name) {
+				return fmt.Errorf("rpc: MethodNamer maps %s.%s to invalid name %q.%q", structName, method.Name, serviceName, name)
+			}
+			if mapped && serviceName != s.name {
+				log.Printf("rpc server: skip %s.%s, MethodNamer maps it to service %s instead of %s", structName, method.Name, serviceName, s.name)
+				continue
+			}
+			s.name, mapped = serviceName, true
+			if other, dup := s.method[name]; dup {
+				return fmt.Errorf("rpc: MethodNamer maps both %s.%s and %s.%s to %s.%s", structName, other.method.Name, structName, method.Name, s.name, name)
+			}
+		}
+		mt := &methodType{
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
+			withOptions: withOptions,
+		}
+		s.method[name] = mt
+		s.names = append(s.names, name)
+	}
+	if rules.max > 0 && len(s.method) > rules.max {
+		return fmt.Errorf("rpc: service %s has %d methods, exceeds limit %d", s.name, len(s.method), rules.max)
+	}
+	return nil
+}
+
+//服务注册成功后注册gob类型并调用回调,注册失败(如校验不通过或服务名重复)的服务不留下副作用
+func (s *service) commit(onRegister registerMethodFunc) {
+	for _, name := range s.names {
+		mt := s.method[name]
+		registerGobTypes(mt.ArgType)
+		registerGobTypes(mt.ReplyType)
+		if onRegister != nil {
+			onRegister(s.name, name, mt)
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+		log.Printf("rpc server: register %s.%s\n", s.name, name)
 	}
 }
 
+//映射后的名字不能为空,也不能包含分隔服务名和方法名的"."
+func invalidMappedName(name string) bool {
+	return name == "" || strings.Contains(name, ".")
+}
+
+var (
+	typeOfError       = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext     = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfCallOptions = reflect.TypeOf(CallOptions{})
+)
+
 //判断该类型是否暴露
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-//调用方法
-func (s *service) call(m *methodType, argv, reply reflect.Value) error {
+//调用方法,ctx仅传给第一个参数为context.Context的方法
+func (s *service) call(ctx context.Context, m *methodType, argv, reply reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	//根据method获取func
 	f := m.method.Func
 	//调用方法,获取返回值
-	returnValues := f.Call([]reflect.Value{s.instance, argv, reply})
+	in := []reflect.Value{argv, reply}
+	if m.withContext {
+		in = []reflect.Value{reflect.ValueOf(ctx), argv, reply}
+	}
+	if m.withOptions {
+		in = append(in, reflect.ValueOf(callOptionsFromContext(ctx)))
+	}
+	//按类型注册的普通函数没有接收者
+	if s.factory != nil {
+		instance, err := s.scopedInstance(ctx)
+		if err != nil {
+			return err
+		}
+		in = append([]reflect.Value{instance}, in...)
+	} else if s.instance.IsValid() {
+		in = append([]reflect.Value{s.instance}, in...)
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
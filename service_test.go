@@ -1,9 +1,16 @@
 package gorpc
 
 import (
+	"context"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
 	"log"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -19,14 +26,470 @@ func (f *Foo) Sum(args Args, reply *int) error {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s := newService(&foo, nil)
 	mType := s.method["Sum"]
 	argv := mType.newArgv()
 	reply := mType.newReply()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
-	err := s.call(mType, argv, reply)
+	err := s.call(context.Background(), mType, argv, reply)
 	if err != nil {
 		log.Panicln("call error:", err)
 	}
 	log.Println("reply : ", reply.Elem())
 }
+
+//不满足rpc方法签名的方法不应触发注册回调
+func (f *Foo) unexported(args Args, reply *int) error { return nil }
+
+func (f *Foo) NotRPC(args Args) error { return nil }
+
+func TestOnRegisterMethod(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	registered := make(map[string]int)
+	server.OnRegisterMethod = func(serviceName, methodName string, mt *methodType) {
+		registered[serviceName+"."+methodName]++
+		if mt == nil || mt.method.Name != methodName {
+			t.Errorf("unexpected method type for %s", methodName)
+		}
+	}
+	if err := server.Register(&foo); err != nil {
+		t.Fatal("register error:", err)
+	}
+	svc, _ := server.serviceMap.Load("Foo")
+	if len(registered) != len(svc.(*service).method) || registered["Foo.Sum"] != 1 {
+		t.Fatalf("expect each eligible method registered once, got %v", registered)
+	}
+	for name, count := range registered {
+		if count != 1 || name == "Foo.NotRPC" || name == "Foo.unexported" {
+			t.Fatalf("unexpected registration %s x%d", name, count)
+		}
+	}
+}
+
+type NestedArgs struct {
+	Num    *int
+	Labels map[string]string
+	Values []int
+}
+
+func (f *Foo) Nested(args NestedArgs, reply *int) error {
+	*reply = len(args.Labels) + len(args.Values)
+	if args.Num != nil {
+		*reply += *args.Num
+	}
+	return nil
+}
+
+//复用的arg取出时必须已经清零,不能残留上一次的字段
+func TestPooledArgvZeroed(t *testing.T) {
+	var foo Foo
+	s := newService(&foo, nil)
+	mType := s.method["Nested"]
+	num := 1
+	for i := 0; i < 10; i++ {
+		argv := mType.pooledArgv()
+		args := argv.Interface().(NestedArgs)
+		if args.Num != nil || args.Labels != nil || args.Values != nil {
+			t.Fatalf("expect zeroed args, got %+v", args)
+		}
+		argv.Set(reflect.ValueOf(NestedArgs{Num: &num, Labels: map[string]string{"a": "b"}, Values: []int{1}}))
+		mType.releaseArgv(argv)
+	}
+}
+
+func TestExportSchema(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	schema, ok := server.ExportSchema()["Foo.Sum"]
+	if !ok {
+		t.Fatal("expect Foo.Sum in schema")
+	}
+	arg := schema.ArgType
+	if arg.Name != "gorpc.Args" || arg.Kind != "struct" || len(arg.Fields) != 2 {
+		t.Fatalf("unexpected arg schema: %+v", arg)
+	}
+	for i, name := range []string{"Num1", "Num2"} {
+		if f := arg.Fields[i]; f.Name != name || f.Type != "int" || f.Kind != "int" {
+			t.Fatalf("unexpected field schema: %+v", f)
+		}
+	}
+	reply := schema.ReplyType
+	if reply.Name != "*int" || reply.Kind != "ptr" || reply.Elem == nil || reply.Elem.Kind != "int" {
+		t.Fatalf("unexpected reply schema: %+v", reply)
+	}
+}
+
+func TestSetReplyCapacity(t *testing.T) {
+	server := NewServer()
+	var lister Lister
+	var foo Foo
+	_ = server.Register(&lister)
+	_ = server.Register(&foo)
+	if err := server.SetReplyCapacity("Lister.List", 64); err != nil {
+		t.Fatal("set reply capacity error:", err)
+	}
+	if err := server.SetReplyCapacity("Foo.Sum", 64); err == nil {
+		t.Fatal("expect error for non slice reply")
+	}
+	_, mType, _ := server.findService("Lister.List")
+	if reply := mType.newReply(); reply.Elem().Cap() != 64 {
+		t.Fatalf("expect capacity 64, got %d", reply.Elem().Cap())
+	}
+}
+
+//按预期大小预分配reply可以避免append过程中的扩容
+func BenchmarkReplyCapacity(b *testing.B) {
+	for _, capacity := range []int{0, 1000} {
+		b.Run("Cap"+strconv.Itoa(capacity), func(b *testing.B) {
+			server := NewServer()
+			var lister Lister
+			_ = server.Register(&lister)
+			_ = server.SetReplyCapacity("Lister.List", capacity)
+			svc, mType, _ := server.findService("Lister.List")
+			argv := reflect.ValueOf(1000)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := svc.call(context.Background(), mType, argv, mType.newReply()); err != nil {
+					b.Fatal("call error:", err)
+				}
+			}
+		})
+	}
+}
+
+//只暴露Sum的接口
+type Summer interface {
+	Sum(args Args, reply *int) error
+}
+
+func TestRegisterAs(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	if err := server.RegisterAs((*Summer)(nil), &foo); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if _, _, err := server.findService("Foo.Sum"); err != nil {
+		t.Fatal("expect Foo.Sum registered:", err)
+	}
+	if _, _, err := server.findService("Foo.Nested"); err == nil {
+		t.Fatal("expect Foo.Nested not registered")
+	}
+	if err := NewServer().RegisterAs(Summer(nil), &foo); err == nil {
+		t.Fatal("expect error for non pointer interface")
+	}
+	if err := NewServer().RegisterAs((*io.Reader)(nil), &foo); err == nil {
+		t.Fatal("expect error for unimplemented interface")
+	}
+}
+
+func TestRegisterPartition(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	if err := server.RegisterPartition("FooRead", &foo, []string{"Sum"}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if err := server.RegisterPartition("FooWrite", &foo, []string{"Nested"}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if err := server.RegisterPartition("FooBad", &foo, []string{"NotRPC"}); err == nil {
+		t.Fatal("expect error for non rpc method")
+	}
+	if err := server.RegisterPartition("fooLower", &foo, []string{"Sum"}); err == nil {
+		t.Fatal("expect error for unexported service name")
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	if err := client.Call("FooRead.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call error:", err, reply)
+	}
+	if err := client.Call("FooWrite.Sum", Args{Num1: 1, Num2: 2}, &reply); err == nil {
+		t.Fatal("expect FooWrite.Sum not registered")
+	}
+	if err := client.Call("FooWrite.Nested", NestedArgs{}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if _, _, err := server.findService("Foo.Sum"); err == nil {
+		t.Fatal("expect no service under the type name")
+	}
+}
+
+func TestMaxMethodsPerService(t *testing.T) {
+	server := NewServer()
+	server.MaxMethodsPerService = 1
+	var registered []string
+	server.OnRegisterMethod = func(serviceName, methodName string, mt *methodType) {
+		registered = append(registered, serviceName+"."+methodName)
+	}
+	var foo Foo
+	err := server.Register(&foo)
+	if err == nil {
+		t.Fatal("expect method limit error, got", err)
+	}
+	if len(registered) != 0 {
+		t.Fatal("expect no OnRegisterMethod calls for a rejected service, got", registered)
+	}
+	if _, _, err := server.findService("Foo.Sum"); err == nil {
+		t.Fatal("expect service not registered after limit error")
+	}
+	if err := server.RegisterPartition("FooSum", &foo, []string{"Sum"}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if len(registered) != 1 || registered[0] != "FooSum.Sum" {
+		t.Fatal("expect one OnRegisterMethod call, got", registered)
+	}
+}
+
+//服务名重复或分区中有不存在的方法时注册失败,不调用OnRegisterMethod
+func TestRejectedRegisterNoHooks(t *testing.T) {
+	server := NewServer()
+	var registered []string
+	server.OnRegisterMethod = func(serviceName, methodName string, mt *methodType) {
+		registered = append(registered, serviceName+"."+methodName)
+	}
+	var foo Foo
+	if err := server.RegisterPartition("FooSum", &foo, []string{"Sum"}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if len(registered) != 1 || registered[0] != "FooSum.Sum" {
+		t.Fatal("expect one OnRegisterMethod call, got", registered)
+	}
+	registered = nil
+	if err := server.RegisterPartition("FooSum", &foo, []string{"Sum"}); err == nil {
+		t.Fatal("expect duplicate service error")
+	}
+	if err := server.RegisterPartition("FooMissing", &foo, []string{"Sum", "Missing"}); err == nil {
+		t.Fatal("expect missing method error")
+	}
+	if len(registered) != 0 {
+		t.Fatal("expect no OnRegisterMethod calls for rejected services, got", registered)
+	}
+	if _, _, err := server.findService("FooMissing.Sum"); err == nil {
+		t.Fatal("expect rejected partition not registered")
+	}
+}
+
+type Deadlined struct{}
+
+func (d *Deadlined) Remaining(args int, reply *int64, opts CallOptions) error {
+	if opts.Deadline.IsZero() {
+		return errors.New("no deadline")
+	}
+	if opts.RequestID == "" || opts.RequestID != opts.Metadata[RequestIDKey] || opts.ConnID == 0 {
+		return errors.New("missing call options")
+	}
+	*reply = int64(time.Until(opts.Deadline))
+	return nil
+}
+
+//同时接收context.Context和CallOptions
+func (d *Deadlined) WithContext(ctx context.Context, args int, reply *string, opts CallOptions) error {
+	if ctx == nil || opts.ConnID == 0 {
+		return errors.New("missing ctx or call options")
+	}
+	*reply = opts.RequestID
+	return nil
+}
+
+//reply不是指针的方法不会被注册
+func (d *Deadlined) BadReply(ctx context.Context, args int, opts CallOptions) error {
+	return nil
+}
+
+func TestContextAndCallOptionsParam(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(&Deadlined{}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if _, _, err := server.findService("Deadlined.BadReply"); err == nil {
+		t.Fatal("expect method with non pointer reply to be skipped")
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var requestID string
+	if err := client.Call("Deadlined.WithContext", 1, &requestID); err != nil || requestID == "" {
+		t.Fatal("call error:", err, requestID)
+	}
+}
+
+func TestCallOptionsParam(t *testing.T) {
+	server := NewServer()
+	server.FastMethodTimeout = time.Minute
+	if err := server.Register(&Deadlined{}); err != nil {
+		t.Fatal("register error:", err)
+	}
+	if err := server.SetMethodCategory("Deadlined.Remaining", CategoryFast); err != nil {
+		t.Fatal("set category error:", err)
+	}
+	client, err := Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var remaining int64
+	if err := client.Call("Deadlined.Remaining", 1, &remaining); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if d := time.Duration(remaining); d <= 0 || d > time.Minute {
+		t.Fatal("unexpected remaining time:", d)
+	}
+}
+
+func TestBuiltinDescribe(t *testing.T) {
+	var foo Foo
+	//默认不提供
+	disabled, err := Dial("tcp", startTestServer(t, NewServer(), &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = disabled.Close() }()
+	var schema MethodSchema
+	if err := disabled.Call("_rpc_.Describe", "Foo.Sum", &schema); err == nil || !strings.Contains(err.Error(), "can't find service") {
+		t.Fatal("expect describe disabled by default, got", err)
+	}
+
+	server := NewServer()
+	server.EnableDescribe = true
+	server.MethodRewriter = func(serviceMethod string) string {
+		return strings.Replace(serviceMethod, "Alias.", "Foo.", 1)
+	}
+	server.UnknownMethodHandler = func(ctx context.Context, h *codec.Header, body []byte) (interface{}, error) {
+		return nil, nil
+	}
+	client, err := Dial("tcp", startTestServer(t, server, &foo))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Call("_rpc_.Describe", "Foo.Sum", &schema); err != nil {
+		t.Fatal("describe error:", err)
+	}
+	if schema.ArgType.Name != "gorpc.Args" || schema.ArgType.Kind != "struct" || len(schema.ArgType.Fields) != 2 {
+		t.Fatalf("unexpected arg schema: %+v", schema.ArgType)
+	}
+	if schema.ArgType.Fields[0].Name != "Num1" || schema.ArgType.Fields[0].Kind != "int" {
+		t.Fatalf("unexpected arg fields: %+v", schema.ArgType.Fields)
+	}
+	if schema.ReplyType.Name != "*int" || schema.ReplyType.Elem == nil || schema.ReplyType.Elem.Kind != "int" {
+		t.Fatalf("unexpected reply schema: %+v", schema.ReplyType)
+	}
+	//按请求相同的查找顺序,改写后的名字也能查到
+	var aliased MethodSchema
+	if err := client.Call("_rpc_.Describe", "Alias.Sum", &aliased); err != nil || aliased.ReplyType.Name != "*int" {
+		t.Fatal("describe alias error:", err, aliased.ReplyType)
+	}
+	//交给UnknownMethodHandler的方法没有类型描述
+	if err := client.Call("_rpc_.Describe", "Foo.Missing", &schema); err == nil || !strings.Contains(err.Error(), "not a registered method") {
+		t.Fatal("expect error for unknown method, got", err)
+	}
+}
+
+type Address struct {
+	City string
+}
+
+type Person struct {
+	Name    string
+	Address Address
+}
+
+type Envelope struct {
+	Value interface{}
+}
+
+type Directory struct{}
+
+//通过interface字段返回参数中的嵌套结构体,Address没有手动注册到gob
+func (d *Directory) Wrap(person Person, reply *Envelope) error {
+	reply.Value = person.Address
+	return nil
+}
+
+func TestRegisterGobTypes(t *testing.T) {
+	var d Directory
+	client, err := Dial("tcp", startTestServer(t, NewServer(), &d))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply Envelope
+	if err := client.Call("Directory.Wrap", Person{Name: "a", Address: Address{City: "b"}}, &reply); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if addr, ok := reply.Value.(Address); !ok || addr.City != "b" {
+		t.Fatalf("unexpected reply %#v", reply.Value)
+	}
+}
+
+func TestSetArgFactory(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	if err := server.SetArgFactory("Foo.Sum", func() interface{} { return Args{} }); err == nil {
+		t.Fatal("expect error for factory returning a non pointer")
+	}
+	calls := 0
+	factory := func() interface{} {
+		calls++
+		return &Args{Num1: 1}
+	}
+	if err := server.SetArgFactory("Foo.Sum", factory); err != nil {
+		t.Fatal("set arg factory error:", err)
+	}
+	_, mType, _ := server.findService("Foo.Sum")
+	calls = 0
+	argv := mType.newArgv()
+	if calls != 1 || argv.Type() != mType.ArgType || argv.Interface().(Args).Num1 != 1 {
+		t.Fatal("expect argv created by the factory:", calls, argv)
+	}
+	_ = server.SetArgFactory("Foo.Sum", nil)
+	if argv := mType.newArgv(); calls != 1 || argv.Interface().(Args).Num1 != 0 {
+		t.Fatal("expect reflection after clearing the factory")
+	}
+}
+
+//通过构造函数创建arg可以省去反射的开销
+func BenchmarkArgFactory(b *testing.B) {
+	for _, withFactory := range []bool{false, true} {
+		name := "Reflect"
+		if withFactory {
+			name = "Factory"
+		}
+		b.Run(name, func(b *testing.B) {
+			server := NewServer()
+			var foo Foo
+			_ = server.Register(&foo)
+			if withFactory {
+				_ = server.SetArgFactory("Foo.Sum", func() interface{} { return new(Args) })
+			}
+			_, mType, _ := server.findService("Foo.Sum")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = mType.newArgv()
+			}
+		})
+	}
+}
+
+func TestSnakeCaseMethodNamer(t *testing.T) {
+	for name, want := range map[string]string{
+		"Foo":         "foo",
+		"GetUserName": "get_user_name",
+		"HTTPServer":  "http_server",
+		"SumV2Args":   "sum_v2_args",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
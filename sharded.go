@@ -0,0 +1,82 @@
+package gorpc
+
+import (
+	"fmt"
+	"sync"
+)
+
+//根据分片key得到该分片所在服务端的地址
+type ShardResolver func(shardKey string) (address string, err error)
+
+//按分片key把调用路由到对应服务端的客户端,每个地址只保持一个Client
+type ShardedClient struct {
+	network string
+	resolve ShardResolver
+	options []*Option
+	lock    sync.Mutex
+	//地址 -> 客户端
+	clients map[string]*Client
+}
+
+func NewShardedClient(network string, resolve ShardResolver, options ...*Option) *ShardedClient {
+	return &ShardedClient{
+		network: network,
+		resolve: resolve,
+		options: options,
+		clients: make(map[string]*Client),
+	}
+}
+
+//调用shardKey所在分片上的方法
+func (s *ShardedClient) ShardedCall(shardKey, serviceMethod string, args, reply interface{}) error {
+	address, err := s.resolve(shardKey)
+	if err != nil {
+		return fmt.Errorf("rpc client: resolve shard %q: %w", shardKey, err)
+	}
+	client, err := s.client(address)
+	if err != nil {
+		return err
+	}
+	return client.Call(serviceMethod, args, reply)
+}
+
+//获取地址对应的客户端,不存在或已不可用时重新连接
+func (s *ShardedClient) client(address string) (*Client, error) {
+	s.lock.Lock()
+	client := s.clients[address]
+	s.lock.Unlock()
+	if client != nil && client.IsAvailable() {
+		return client, nil
+	}
+	//在锁外连接,避免一个分片连接慢时阻塞其他分片的调用
+	dialed, err := Dial(s.network, address, s.options...)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	//其他协程可能已经连接成功
+	if current := s.clients[address]; current != nil && current != client && current.IsAvailable() {
+		_ = dialed.Close()
+		return current, nil
+	}
+	if client != nil {
+		_ = client.Close()
+	}
+	s.clients[address] = dialed
+	return dialed, nil
+}
+
+//关闭所有分片的客户端
+func (s *ShardedClient) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var firstErr error
+	for address, client := range s.clients {
+		if err := client.Close(); err != nil && firstErr == nil && err != ErrShutdown {
+			firstErr = err
+		}
+		delete(s.clients, address)
+	}
+	return firstErr
+}
@@ -0,0 +1,25 @@
+package gorpc
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+//服务端过载时Accept是否应直接关闭新连接,返回过载的原因
+//正在处理的请求数达到ShedInFlight,或在OverflowQueue中等待名额的连接数达到ShedQueueDepth时过载,负载降下来后自动恢复接收
+func (server *Server) overloaded() (string, bool) {
+	if server.ShedInFlight > 0 {
+		server.inFlightLock.Lock()
+		n := len(server.inFlight)
+		server.inFlightLock.Unlock()
+		if n >= server.ShedInFlight {
+			return fmt.Sprintf("%d requests in flight", n), true
+		}
+	}
+	if server.ShedQueueDepth > 0 {
+		if n := int(atomic.LoadInt64(&server.limiter.queued)); n >= server.ShedQueueDepth {
+			return fmt.Sprintf("%d connections queued", n), true
+		}
+	}
+	return "", false
+}
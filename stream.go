@@ -0,0 +1,375 @@
+package gorpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//流式响应的数据块在响应头Metadata中的标记,同一seq的最后一条普通响应表示流结束
+	StreamKey   = "stream"
+	streamChunk = "chunk"
+	//客户端读取了一部分数据后发给服务端的确认,消息体为读取的字节数,服务端据此继续发送
+	streamAck = "ack"
+	//客户端提前关闭流,服务端不再发送剩余的数据
+	streamCancel = "cancel"
+	//请求头Metadata中客户端的接收窗口,服务端未确认的数据不超过该字节数,为空时不做流量控制
+	StreamWindowKey = "stream-window"
+)
+
+//流式响应每个数据块的最大字节数
+const streamChunkSize = 32 << 10
+
+var typeOfReadCloser = reflect.TypeOf((*io.ReadCloser)(nil)).Elem()
+
+//调用方提前关闭流后再读取时返回的错误
+var ErrStreamClosed = errors.New("rpc client: stream closed")
+
+//返回值是否为流式响应,即reply的类型为*io.ReadCloser
+func (m *methodType) isStreamReply() bool {
+	return m.ReplyType.Kind() == reflect.Ptr && m.ReplyType.Elem() == typeOfReadCloser
+}
+
+//服务端发送流式响应的窗口,客户端确认后增加可发送的字节数
+type streamWindow struct {
+	lock sync.Mutex
+	//还可以发送的字节数
+	credit int
+	//客户端已关闭流或连接已关闭
+	err error
+	//credit增加或流结束时通知
+	more chan struct{}
+}
+
+func newStreamWindow(size int) *streamWindow {
+	return &streamWindow{credit: size, more: make(chan struct{}, 1)}
+}
+
+//增加可发送的字节数,n小于0表示流结束,原因为err
+func (w *streamWindow) grant(n int, err error) {
+	w.lock.Lock()
+	if n >= 0 {
+		w.credit += n
+	} else if w.err == nil {
+		w.err = err
+	}
+	w.lock.Unlock()
+	select {
+	case w.more <- struct{}{}:
+	default:
+	}
+}
+
+//等待可发送的字节数大于0,返回不超过max的可发送字节数
+func (w *streamWindow) wait(ctx context.Context, max int) (int, error) {
+	for {
+		w.lock.Lock()
+		credit, err := w.credit, w.err
+		w.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if credit > 0 {
+			if credit > max {
+				credit = max
+			}
+			return credit, nil
+		}
+		select {
+		case <-w.more:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (w *streamWindow) consume(n int) {
+	w.lock.Lock()
+	w.credit -= n
+	w.lock.Unlock()
+}
+
+//登记一个流式响应的窗口,请求头没有带窗口或连接按顺序处理请求时返回nil
+//Ordered时读取协程在处理请求,读不到客户端的确认,只能不做流量控制
+func (server *Server) openStreamWindow(ctx context.Context, h *codec.Header) *streamWindow {
+	size, err := strconv.Atoi(h.Metadata[StreamWindowKey])
+	if err != nil || size <= 0 || server.Ordered {
+		return nil
+	}
+	v, ok := server.conns.Load(connInfoFromContext(ctx).id)
+	if !ok {
+		return nil
+	}
+	sc := v.(*serverConn)
+	w := newStreamWindow(size)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.closed || sc.windows == nil {
+		return nil
+	}
+	sc.windows[h.Seq] = w
+	return w
+}
+
+func (server *Server) closeStreamWindow(ctx context.Context, seq uint64) {
+	if v, ok := server.conns.Load(connInfoFromContext(ctx).id); ok {
+		sc := v.(*serverConn)
+		sc.lock.Lock()
+		delete(sc.windows, seq)
+		sc.lock.Unlock()
+	}
+}
+
+//读取客户端对流式响应的确认或取消,返回的错误表示连接已不可用
+func (sc *serverConn) receiveStreamAck(h *codec.Header) error {
+	var n int
+	if err := sc.c.ReadBody(&n); err != nil {
+		return err
+	}
+	sc.lock.Lock()
+	w := sc.windows[h.Seq]
+	sc.lock.Unlock()
+	if w == nil {
+		return nil
+	}
+	if h.Metadata[StreamKey] == streamCancel {
+		w.grant(-1, ErrStreamClosed)
+	} else if n > 0 {
+		w.grant(n, nil)
+	}
+	return nil
+}
+
+//连接不再可读,结束所有等待确认的流式响应
+func (sc *serverConn) closeWindows() {
+	sc.lock.Lock()
+	windows := sc.windows
+	sc.windows = nil
+	sc.lock.Unlock()
+	for _, w := range windows {
+		w.grant(-1, ErrShutdown)
+	}
+}
+
+//把方法返回的io.ReadCloser分块发送,每块单独加发送锁,不会阻塞同一连接上的其他响应
+//客户端带了接收窗口时,未确认的数据达到窗口大小后等待客户端确认再继续读取r
+//最后发送一条普通响应表示结束,读取出错时错误放在这条响应中
+func (server *Server) sendStream(ctx context.Context, c codec.Codec, h *codec.Header, r io.ReadCloser, sendLock *sendQueue) time.Duration {
+	var encodeTime time.Duration
+	if r != nil {
+		defer func() { _ = r.Close() }()
+		window := server.openStreamWindow(ctx, h)
+		if window != nil {
+			defer server.closeStreamWindow(ctx, h.Seq)
+		}
+		buf := make([]byte, streamChunkSize)
+		for {
+			chunk := buf
+			if window != nil {
+				n, err := window.wait(ctx, len(buf))
+				if err != nil {
+					h.Error = err.Error()
+					break
+				}
+				chunk = buf[:n]
+			}
+			n, err := r.Read(chunk)
+			if window != nil {
+				window.consume(n)
+			}
+			if n > 0 {
+				h.Metadata[StreamKey] = streamChunk
+				sendLock.Lock()
+				werr := c.Write(h, buf[:n])
+				encodeTime += encodeTimeOf(c)
+				sendLock.Unlock()
+				if werr != nil {
+					//连接已不可用,不再继续读取
+					if server.trace.enabled() {
+						server.trace.printf("send seq=%d method=%s request-id=%s stream write error=%v", h.Seq, h.ServiceMethod, requestIDOf(h), werr)
+					}
+					return encodeTime
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				h.Error = err.Error()
+				break
+			}
+			if ctx.Err() != nil {
+				h.Error = ctx.Err().Error()
+				break
+			}
+		}
+	}
+	delete(h.Metadata, StreamKey)
+	return encodeTime + server.sendResponse(c, h, invalidRequest, sendLock)
+}
+
+//客户端接收流式响应的缓冲区,接收协程只写入不阻塞,调用方按自己的节奏读取
+//缓冲的数据不超过接收窗口,调用方读取一半窗口后向服务端确认,服务端收到确认前不再发送
+type replyStream struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	//已接收未读取的数据
+	buf bytes.Buffer
+	//流结束的原因,正常结束为io.EOF
+	err error
+	//调用方是否已关闭
+	closed bool
+	//接收窗口的字节数
+	window int
+	//已读取还没有确认的字节数
+	unacked int
+	client  *Client
+	call    *Call
+}
+
+func newReplyStream(client *Client) *replyStream {
+	s := &replyStream{client: client, window: MaxStreamBufferBytes}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+//收到一个数据块,服务端不遵守窗口导致缓冲超过窗口时终止该流并返回false
+func (s *replyStream) write(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.cond.Broadcast()
+	if s.closed || s.err != nil {
+		return true
+	}
+	if s.buf.Len()+len(data) > s.window {
+		s.buf.Reset()
+		s.err = ErrStreamBufferFull
+		return false
+	}
+	s.buf.Write(data)
+	return true
+}
+
+func (s *replyStream) finish(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *replyStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	for s.buf.Len() == 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		s.lock.Unlock()
+		return 0, ErrStreamClosed
+	}
+	if s.buf.Len() == 0 {
+		s.lock.Unlock()
+		return 0, s.err
+	}
+	n, _ := s.buf.Read(p)
+	var ack int
+	s.unacked += n
+	if s.unacked >= s.window/2 && s.err == nil {
+		ack, s.unacked = s.unacked, 0
+	}
+	s.lock.Unlock()
+	//写连接时不持有lock,接收协程可以继续写入
+	if ack > 0 {
+		s.client.sendStreamControl(s.call, streamAck, ack)
+	}
+	return n, nil
+}
+
+//提前关闭时丢弃之后收到的数据,并通知服务端不再发送
+func (s *replyStream) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if call := s.client.removeCall(s.call.Seq); call != nil {
+		call.Error = ErrStreamClosed
+		call.done()
+		s.client.sendStreamControl(s.call, streamCancel, 0)
+	}
+	return nil
+}
+
+//缓冲超过窗口时结束调用,并通知服务端不再发送
+func (s *replyStream) abort() {
+	if call := s.client.removeCall(s.call.Seq); call != nil {
+		call.Error = ErrStreamBufferFull
+		call.done()
+		s.client.sendStreamControl(s.call, streamCancel, 0)
+	}
+}
+
+//向服务端发送流式响应的确认或取消,发送失败时连接会被关闭,调用随之结束
+func (client *Client) sendStreamControl(call *Call, kind string, n int) {
+	h := &codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           call.Seq,
+		Metadata:      map[string]string{StreamKey: kind},
+	}
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	_ = client.c.Write(h, n)
+}
+
+//接收流式响应的一个数据块,调用不存在(如已被关闭)时丢弃
+func (client *Client) receiveChunk(seq uint64) error {
+	client.lock.Lock()
+	call := client.pending[seq]
+	client.lock.Unlock()
+	var data []byte
+	if err := client.c.ReadBody(&data); err != nil {
+		return err
+	}
+	if call != nil && call.stream != nil && !call.stream.write(data) {
+		//在新的协程中结束调用并通知服务端,读取协程不能写连接
+		go call.stream.abort()
+	}
+	return nil
+}
+
+//调用reply类型为*io.ReadCloser的方法,返回的reader按块接收服务端发送的数据
+//数据在客户端缓冲,读取慢时不会阻塞同一连接上的其他调用,缓冲达到MaxStreamBufferBytes时服务端暂停发送
+//读完后返回io.EOF,服务端出错时返回该错误;请求没有发送出去时直接返回错误
+func (client *Client) CallStreamReply(serviceMethod string, args interface{}) (io.ReadCloser, error) {
+	stream := newReplyStream(client)
+	call := newCall(serviceMethod, args, new(struct{}), make(chan *Call, 1))
+	call.stream = stream
+	call.metadata = map[string]string{StreamWindowKey: strconv.Itoa(stream.window)}
+	stream.call = call
+	client.start(call)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		stream.finish(nil)
+		return stream, nil
+	default:
+	}
+	go func() {
+		<-call.Done
+		stream.finish(call.Error)
+	}()
+	return stream, nil
+}
@@ -0,0 +1,56 @@
+package gorpc
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//把读写的原始字节复制到tap的连接包装,用于排查分帧等协议问题
+//读和写的字节按发生的顺序写入同一个tap,不区分方向
+type tapConn struct {
+	io.ReadWriteCloser
+	tap io.Writer
+	//tap可能被多个协程同时写入
+	lock *sync.Mutex
+}
+
+func newTapConn(conn io.ReadWriteCloser, tap io.Writer, lock *sync.Mutex) *tapConn {
+	return &tapConn{ReadWriteCloser: conn, tap: tap, lock: lock}
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.copy(p[:n])
+	return n, err
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.copy(p[:n])
+	return n, err
+}
+
+//tap写入出错不影响连接
+func (c *tapConn) copy(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, _ = c.tap.Write(p)
+}
+
+func (c *tapConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := c.ReadWriteCloser.(readDeadlineConn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (c *tapConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(t time.Time) error }); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return errNoDeadline
+}
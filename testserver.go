@@ -0,0 +1,113 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+//集成测试用的临时服务端,监听本机的随机端口
+type TestServer struct {
+	//处理连接的服务端,可以在Dial之前修改配置
+	Server *Server
+	//监听器
+	listener net.Listener
+	//Accept返回时关闭
+	accepting chan struct{}
+	//保护conns
+	lock sync.Mutex
+	//已接收还未关闭的连接
+	conns map[*testServerConn]struct{}
+}
+
+//注册services并在本机的随机端口上启动服务端,用完需要调用Close
+func NewTestServer(services ...interface{}) (*TestServer, error) {
+	server := NewServer()
+	for _, service := range services {
+		if err := server.Register(service); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ts := &TestServer{
+		Server:    server,
+		listener:  l,
+		accepting: make(chan struct{}),
+		conns:     make(map[*testServerConn]struct{}),
+	}
+	go func() {
+		defer close(ts.accepting)
+		server.Accept(&testServerListener{Listener: l, ts: ts})
+	}()
+	return ts, nil
+}
+
+//服务端监听的地址
+func (ts *TestServer) Addr() string {
+	return ts.listener.Addr().String()
+}
+
+//连接该服务端
+func (ts *TestServer) Dial(options ...*Option) (*Client, error) {
+	return Dial("tcp", ts.Addr(), options...)
+}
+
+//停止接收新连接并关闭所有已接收的连接(包括还在握手中的),等处理连接的goroutine都退出后返回
+//正在处理的请求不再等待,客户端收到连接关闭的错误
+func (ts *TestServer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = ts.Server.Drain(ctx)
+	//Accept还未开始时Drain不会关闭监听器,已关闭的不是错误
+	err := ts.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	<-ts.accepting
+	ts.lock.Lock()
+	conns := make([]*testServerConn, 0, len(ts.conns))
+	for conn := range ts.conns {
+		conns = append(conns, conn)
+	}
+	ts.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	ts.Server.gate.serving.Wait()
+	return err
+}
+
+//记录接收的连接
+type testServerListener struct {
+	net.Listener
+	ts *TestServer
+}
+
+func (l *testServerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &testServerConn{TCPConn: conn.(*net.TCPConn), ts: l.ts}
+	l.ts.lock.Lock()
+	l.ts.conns[tc] = struct{}{}
+	l.ts.lock.Unlock()
+	return tc, nil
+}
+
+//关闭时从TestServer中移除,保留*net.TCPConn的方法
+type testServerConn struct {
+	*net.TCPConn
+	ts *TestServer
+}
+
+func (c *testServerConn) Close() error {
+	c.ts.lock.Lock()
+	delete(c.ts.conns, c)
+	c.ts.lock.Unlock()
+	return c.TCPConn.Close()
+}
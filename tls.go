@@ -0,0 +1,62 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+//用TLS监听lis并处理连接
+func (server *Server) ServeTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
+
+//conn为TLS连接时先完成握手,返回握手后的状态,不是TLS连接时返回nil
+func tlsHandshake(conn io.ReadWriteCloser) (*tls.ConnectionState, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+//在方法中获取连接的TLS状态,如是否复用了会话(DidResume),不是TLS连接时返回false
+func TLSStateFromContext(ctx context.Context) (*tls.ConnectionState, bool) {
+	info := connInfoFromContext(ctx)
+	return info.tls, info.tls != nil
+}
+
+//通过TLS连接服务端,config.ClientSessionCache不为空时可以复用会话,减少握手耗时
+func DialTLS(network, address string, config *tls.Config, options ...*Option) (client *Client, err error) {
+	option, err := parseOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if client == nil {
+			_ = conn.Close()
+		}
+	}()
+	return NewClient(conn, option)
+}
+
+//获取客户端TLS连接的状态,不是TLS连接时返回false
+func (client *Client) TLSConnectionState() (tls.ConnectionState, bool) {
+	conn := client.conn.ReadWriteCloser
+	if tap, ok := conn.(*tapConn); ok {
+		conn = tap.ReadWriteCloser
+	}
+	if conn, ok := conn.(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
@@ -0,0 +1,58 @@
+package gorpc
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//协议事件追踪,每个事件输出一行,未设置输出时什么都不做
+type tracer struct {
+	//保存traceOutput,未设置时为nil,读取不加锁
+	w atomic.Value
+	//保证多个协程输出的行不交织,只在写出格式化好的一行时持有
+	lock sync.Mutex
+	//输出的前缀,区分客户端和服务端
+	prefix string
+}
+
+//atomic.Value不能保存nil,也要求每次保存的类型相同
+type traceOutput struct {
+	w io.Writer
+}
+
+//设置追踪输出,w为nil时关闭追踪
+func (t *tracer) setWriter(w io.Writer) {
+	t.w.Store(traceOutput{w: w})
+}
+
+//是否开启了追踪,参数需要额外计算的事件先检查,关闭时不计算参数
+func (t *tracer) enabled() bool {
+	out, _ := t.w.Load().(traceOutput)
+	return out.w != nil
+}
+
+//输出一个事件,多个协程可以同时调用
+func (t *tracer) printf(format string, v ...interface{}) {
+	out, _ := t.w.Load().(traceOutput)
+	if out.w == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s: %s\n", time.Now().Format("15:04:05.000000"), t.prefix, fmt.Sprintf(format, v...))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, _ = io.WriteString(out.w, line)
+}
+
+//将客户端的每个协议事件(请求头发送,响应头接收,消息大小,错误)写入w,w为nil时关闭
+//握手在创建客户端时完成,需要追踪握手时通过Option.Trace设置
+func (client *Client) TraceTo(w io.Writer) {
+	client.trace.setWriter(w)
+}
+
+//将服务端的每个协议事件(握手,请求头接收,响应发送,连接关闭)写入w,w为nil时关闭
+func (server *Server) TraceTo(w io.Writer) {
+	server.trace.setWriter(w)
+}
@@ -0,0 +1,87 @@
+package gorpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TheR1sing3un/gorpc/codec"
+	"reflect"
+	"sync"
+)
+
+//同一个服务方法名下按参数类型区分的处理函数
+type typedMethods struct {
+	lock sync.RWMutex
+	//参数类型名 -> 处理函数
+	handlers map[string]*methodType
+}
+
+//参数类型在报文中的名字,只取类型名而不含包名,方便不同程序之间匹配
+func argTypeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+//为serviceMethod注册一个只处理argType类型参数的函数,同一个serviceMethod可以按不同参数类型注册多个函数
+//fn的签名为 func(args T1, reply *T2) error 或 func(ctx context.Context, args T1, reply *T2) error,其中T1必须为argType
+func (server *Server) RegisterTyped(serviceMethod string, argType reflect.Type, fn interface{}) error {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return errors.New("rpc: typed handler must be a func")
+	}
+	fType := f.Type()
+	withContext := fType.NumIn() == 3 && fType.In(0) == typeOfContext
+	if (fType.NumIn() != 2 && !withContext) || fType.NumOut() != 1 || fType.Out(0) != typeOfError {
+		return fmt.Errorf("rpc: typed handler for %s has invalid signature %s", serviceMethod, fType)
+	}
+	argIndex := 0
+	if withContext {
+		argIndex = 1
+	}
+	if fType.In(argIndex) != argType {
+		return fmt.Errorf("rpc: typed handler for %s takes %s, want %s", serviceMethod, fType.In(argIndex), argType)
+	}
+	replyType := fType.In(argIndex + 1)
+	if replyType.Kind() != reflect.Ptr {
+		return fmt.Errorf("rpc: typed handler for %s reply must be a pointer", serviceMethod)
+	}
+	name := argTypeName(argType)
+	if name == "" {
+		return fmt.Errorf("rpc: typed handler for %s needs a named arg type", serviceMethod)
+	}
+	v, _ := server.typed.LoadOrStore(serviceMethod, &typedMethods{handlers: make(map[string]*methodType)})
+	methods := v.(*typedMethods)
+	methods.lock.Lock()
+	defer methods.lock.Unlock()
+	if _, dup := methods.handlers[name]; dup {
+		return fmt.Errorf("rpc: typed handler for %s with arg %s already defined", serviceMethod, name)
+	}
+	methods.handlers[name] = &methodType{
+		method:      reflect.Method{Name: serviceMethod, Type: fType, Func: f},
+		ArgType:     argType,
+		ReplyType:   replyType,
+		withContext: withContext,
+	}
+	return nil
+}
+
+//根据请求头中的参数类型查找按类型注册的函数,ok表示该服务方法是否按类型注册过
+func (server *Server) findTyped(h *codec.Header) (svc *service, mType *methodType, ok bool, err error) {
+	v, ok := server.typed.Load(h.ServiceMethod)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	methods := v.(*typedMethods)
+	methods.lock.RLock()
+	defer methods.lock.RUnlock()
+	mType = methods.handlers[h.ArgType]
+	if mType == nil {
+		return nil, nil, true, fmt.Errorf("rpc server: no handler of %s for arg type %q", h.ServiceMethod, h.ArgType)
+	}
+	//按类型注册的是普通函数,没有接收者
+	return &service{name: h.ServiceMethod}, mType, true, nil
+}
@@ -0,0 +1,31 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"github.com/TheR1sing3un/gorpc/codec"
+)
+
+//读取未注册方法的原始消息体
+func (server *Server) readRawBody(c codec.Codec, req *request) error {
+	reader, ok := c.(codec.RawBodyReader)
+	if !ok {
+		_ = c.ReadBody(nil)
+		return errors.New("rpc server: codec can not read raw body for " + req.h.ServiceMethod)
+	}
+	var err error
+	req.raw, err = reader.ReadRawBody()
+	return err
+}
+
+//调用UnknownMethodHandler处理未注册的方法
+func (server *Server) handleUnknown(ctx context.Context, c codec.Codec, req *request, sendLock *sendQueue) {
+	reply, err := server.UnknownMethodHandler(ctx, req.h, req.raw)
+	var body interface{} = reply
+	if err != nil {
+		req.h.Error = err.Error()
+		body = invalidRequest
+	}
+	encodeTime := server.sendResponse(c, req.h, body, sendLock)
+	server.reportStats(req, encodeTime)
+}
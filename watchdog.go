@@ -0,0 +1,27 @@
+package gorpc
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//方法运行超过SlowHandlerThreshold时记录日志并回调OnSlowHandler,CancelSlowHandlers为true时同时取消方法的context
+//返回的函数在方法返回后调用,停止计时
+func (server *Server) watchSlowHandler(serviceMethod string, cancel context.CancelFunc) func() {
+	if server.SlowHandlerThreshold <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	timer := time.AfterFunc(server.SlowHandlerThreshold, func() {
+		elapsed := time.Since(start)
+		log.Printf("rpc server: slow handler %s running for %s", serviceMethod, elapsed)
+		if server.OnSlowHandler != nil {
+			server.OnSlowHandler(serviceMethod, elapsed)
+		}
+		if server.CancelSlowHandlers {
+			cancel()
+		}
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,99 @@
+package gorpc
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+//WebSocket二进制消息的类型,与RFC 6455及常见实现(如gorilla/websocket)的取值一致
+const webSocketBinaryMessage = 2
+
+//WebSocket连接的最小接口,*websocket.Conn(gorilla/websocket)直接实现了该接口
+//框架本身不依赖具体的WebSocket实现
+type WebSocketConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+//将HTTP请求升级为WebSocket连接,升级失败时需要自行写出HTTP响应
+type WebSocketUpgradeFunc func(w http.ResponseWriter, r *http.Request) (WebSocketConn, error)
+
+//建立到url的WebSocket连接
+type WebSocketDialFunc func(url string) (WebSocketConn, error)
+
+//DialWebSocket使用的拨号函数,使用前需要设置
+var WebSocketDialer WebSocketDialFunc
+
+//把WebSocket连接包装成字节流,每次Write作为一个二进制帧发送,Read依次读出各帧的数据
+type webSocketStream struct {
+	ws WebSocketConn
+	//当前帧还未读完的数据
+	buf []byte
+}
+
+func newWebSocketStream(ws WebSocketConn) *webSocketStream {
+	return &webSocketStream{ws: ws}
+}
+
+func (s *webSocketStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		messageType, data, err := s.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		//忽略非二进制的帧
+		if messageType == webSocketBinaryMessage {
+			s.buf = data
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *webSocketStream) Write(p []byte) (int, error) {
+	if err := s.ws.WriteMessage(webSocketBinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *webSocketStream) Close() error {
+	return s.ws.Close()
+}
+
+//返回处理WebSocket连接的http.Handler,升级成功后在该连接上提供rpc服务
+func (server *Server) WebSocketHandler(upgrade WebSocketUpgradeFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrade(w, r)
+		if err != nil {
+			log.Println("rpc server: websocket upgrade error:", err)
+			return
+		}
+		server.ServeConn(newWebSocketStream(ws))
+	})
+}
+
+//通过WebSocketDialer连接url,创建client实例
+func DialWebSocket(url string, options ...*Option) (client *Client, err error) {
+	if WebSocketDialer == nil {
+		return nil, errors.New("rpc client: WebSocketDialer is not set")
+	}
+	option, err := parseOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := WebSocketDialer(url)
+	if err != nil {
+		return nil, err
+	}
+	conn := newWebSocketStream(ws)
+	defer func() {
+		if client == nil {
+			_ = conn.Close()
+		}
+	}()
+	return newClient(conn, option)
+}